@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// applyOverrides writes the override files described by the CSV in r,
+// with rows of rank, stage and segment IDs separated by spaces or
+// semicolons. A header row starting with rank is skipped. Every row is
+// checked before any file is written.
+func applyOverrides(ctx context.Context, st store, r io.Reader) error {
+	reqs, err := st.requests(ctx, requestFilter{})
+	if err != nil {
+		return err
+	}
+	byRank := make(map[int]request, len(reqs))
+	for _, req := range reqs {
+		byRank[req.rank] = req
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return err
+	}
+	first := 1 // line number of rows[0]
+	if len(rows) > 0 && strings.EqualFold(rows[0][0], "rank") {
+		rows = rows[1:]
+		first++
+	}
+
+	type override struct {
+		path string
+		ids  []int
+	}
+	var overrides []override
+	for i, row := range rows {
+		line := i + first
+		rank, err := strconv.Atoi(row[0])
+		if err != nil {
+			return fmt.Errorf("row %d: %w", line, err)
+		}
+		req, ok := byRank[rank]
+		if !ok {
+			return fmt.Errorf("row %d: no request with rank %d", line, rank)
+		}
+
+		stage := strings.ToLower(strings.TrimSpace(row[1]))
+		if !slices.Contains(overrideWhens, stage) {
+			return fmt.Errorf("row %d: unknown stage %q, want one of %v", line, row[1], overrideWhens)
+		}
+
+		var ids []int
+		for _, f := range strings.FieldsFunc(row[2], func(r rune) bool { return r == ' ' || r == ';' }) {
+			id, err := strconv.Atoi(f)
+			if err != nil {
+				return fmt.Errorf("row %d: %w", line, err)
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("row %d: no segment ids", line)
+		}
+
+		segs, err := st.filterSegments(ctx, segmentFilter{ids: ids})
+		if err != nil {
+			return err
+		}
+		if len(segs) != len(ids) {
+			return fmt.Errorf("row %d: only %d of %d segment ids exist", line, len(segs), len(ids))
+		}
+
+		overrides = append(overrides, override{path: overridePath(req.stableID(), stage), ids: ids})
+	}
+
+	if err := os.MkdirAll(overrideDir, 0o755); err != nil {
+		return err
+	}
+	for _, o := range overrides {
+		var b strings.Builder
+		for _, id := range o.ids {
+			b.WriteString(strconv.Itoa(id) + "\n")
+		}
+		if err := os.WriteFile(o.path, []byte(b.String()), 0o644); err != nil {
+			return err
+		}
+		slog.Info("wrote override", "path", o.path)
+	}
+	return nil
+}
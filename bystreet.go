@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/mazznoer/colorgrad"
+	"github.com/twpayne/go-kml"
+)
+
+// exportByStreet writes one placemark per street with any resolved
+// request, covering the segments of all of its requests' routes once each.
+func exportByStreet(ctx context.Context, st store, w io.Writer, opts exportOptions) error {
+	reqs, err := st.requests(ctx, opts.requestFilter)
+	if err != nil {
+		return err
+	}
+
+	gradient := opts.gradient
+	if len(gradient) == 0 {
+		gradient = defaultGradient
+	}
+	grad, err := colorgrad.NewGradient().HtmlColors(gradient...).Build()
+	if err != nil {
+		return err
+	}
+
+	type street struct {
+		name  string
+		ranks []string
+		segs  []segment
+		seen  map[int]bool
+	}
+	var (
+		streets []*street
+		byName  = make(map[string]*street)
+		failed  int
+	)
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		res, err := newDefaultRequestHandler(st, req, opts.handlerOptions).handle(ctx)
+		if err != nil {
+			failed++
+			logRequestError(req, err)
+			continue
+		}
+
+		key := normalizeStreetName(req.streetName)
+		s := byName[key]
+		if s == nil {
+			s = &street{name: req.streetName, seen: make(map[int]bool)}
+			byName[key] = s
+			streets = append(streets, s)
+		}
+		s.ranks = append(s.ranks, strconv.Itoa(req.rank))
+		for _, seg := range res.routeSegments {
+			if !s.seen[seg.id] {
+				s.seen[seg.id] = true
+				s.segs = append(s.segs, seg)
+			}
+		}
+	}
+
+	folder := kml.Folder(kml.Name("Streets with calming requests"))
+	for _, s := range streets {
+		folder.Add(kml.Placemark(
+			kml.Name(s.name),
+			kml.Description("Ranks "+strings.Join(s.ranks, ", ")),
+			kml.StyleURL("#street"),
+			kml.MultiGeometry(routeLineStrings(s.segs, true, opts.coordPrecision)...),
+		))
+	}
+
+	doc := kml.Document(kml.SharedStyle("street", routeLineStyle(grad.Colors(1)[0], opts)), folder)
+	if err := writeKML(w, kml.KML(doc), opts.kmz, opts.pretty); err != nil {
+		return err
+	}
+
+	slog.Info("by-street export summary", "streets", len(streets), "errors", failed)
+	return nil
+}
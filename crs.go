@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/project"
+)
+
+// crs is a coordinate reference system exports can write geometry in.
+type crs struct {
+	epsg int
+	name string
+	// definition is the OGC WKT for the system, as GeoPackage records.
+	definition string
+	// project converts a lon/lat point to the system, nil for WGS 84.
+	project orb.Projection
+}
+
+const wgs84WKT = `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]`
+
+var wgs84 = crs{epsg: 4326, name: "WGS 84 geodetic", definition: wgs84WKT}
+
+// parseCRS returns the system for an EPSG code, with or without an
+// "EPSG:" prefix. Supported are 4326, 3857 web mercator and the WGS 84
+// UTM zones, 32601 to 32660 north and 32701 to 32760 south.
+func parseCRS(s string) (crs, error) {
+	code, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(s), "EPSG:"))
+	if err != nil {
+		return crs{}, fmt.Errorf("invalid crs %q, want an EPSG code such as 4326", s)
+	}
+
+	switch {
+	case code == 4326:
+		return wgs84, nil
+	case code == 3857:
+		return crs{
+			epsg:       code,
+			name:       "WGS 84 / Pseudo-Mercator",
+			definition: `PROJCS["WGS 84 / Pseudo-Mercator",` + wgs84WKT + `,PROJECTION["Mercator_1SP"],PARAMETER["central_meridian",0],PARAMETER["scale_factor",1],PARAMETER["false_easting",0],PARAMETER["false_northing",0],UNIT["metre",1,AUTHORITY["EPSG","9001"]],AUTHORITY["EPSG","3857"]]`,
+			project:    project.WGS84.ToMercator,
+		}, nil
+	case code > 32600 && code <= 32660, code > 32700 && code <= 32760:
+		zone, south := code%100, code > 32700
+		hemi, falseNorthing := "N", 0
+		if south {
+			hemi, falseNorthing = "S", 10000000
+		}
+		name := fmt.Sprintf("WGS 84 / UTM zone %d%s", zone, hemi)
+		return crs{
+			epsg:       code,
+			name:       name,
+			definition: fmt.Sprintf(`PROJCS["%s",%s,PROJECTION["Transverse_Mercator"],PARAMETER["latitude_of_origin",0],PARAMETER["central_meridian",%d],PARAMETER["scale_factor",0.9996],PARAMETER["false_easting",500000],PARAMETER["false_northing",%d],UNIT["metre",1,AUTHORITY["EPSG","9001"]],AUTHORITY["EPSG","%d"]]`, name, wgs84WKT, utmCentralMeridian(zone), falseNorthing, code),
+			project:    utmProjection(zone, south),
+		}, nil
+	}
+	return crs{}, fmt.Errorf("unsupported crs %q, want 4326, 3857 or a WGS 84 UTM zone such as 32620", s)
+}
+
+func utmCentralMeridian(zone int) int {
+	return zone*6 - 183
+}
+
+// utmProjection returns the transverse mercator projection for a WGS 84
+// UTM zone, using the series from Snyder's Map Projections: A Working
+// Manual, good to well under a metre within the zone.
+func utmProjection(zone int, south bool) orb.Projection {
+	const (
+		a  = 6378137.0
+		f  = 1 / 298.257223563
+		k0 = 0.9996
+	)
+	e2 := f * (2 - f)
+	ep2 := e2 / (1 - e2)
+	lon0 := float64(utmCentralMeridian(zone)) * math.Pi / 180
+	falseNorthing := 0.0
+	if south {
+		falseNorthing = 10000000
+	}
+
+	return func(p orb.Point) orb.Point {
+		phi := p.Lat() * math.Pi / 180
+		sin, cos, tan := math.Sin(phi), math.Cos(phi), math.Tan(phi)
+
+		n := a / math.Sqrt(1-e2*sin*sin)
+		t := tan * tan
+		c := ep2 * cos * cos
+		ax := cos * (p.Lon()*math.Pi/180 - lon0)
+		m := a * ((1-e2/4-3*e2*e2/64-5*e2*e2*e2/256)*phi -
+			(3*e2/8+3*e2*e2/32+45*e2*e2*e2/1024)*math.Sin(2*phi) +
+			(15*e2*e2/256+45*e2*e2*e2/1024)*math.Sin(4*phi) -
+			(35*e2*e2*e2/3072)*math.Sin(6*phi))
+
+		x := k0*n*(ax+(1-t+c)*math.Pow(ax, 3)/6+(5-18*t+t*t+72*c-58*ep2)*math.Pow(ax, 5)/120) + 500000
+		y := k0*(m+n*tan*(ax*ax/2+(5-t+9*c+4*c*c)*math.Pow(ax, 4)/24+(61-58*t+t*t+600*c-330*ep2)*math.Pow(ax, 6)/720)) + falseNorthing
+		return orb.Point{x, y}
+	}
+}
+
+// projectGeometry returns a copy of g in c, or g itself for WGS 84. Only
+// points and lines can be projected.
+func (c crs) projectGeometry(g orb.Geometry) (orb.Geometry, error) {
+	if c.project == nil {
+		return g, nil
+	}
+
+	projectLine := func(ls orb.LineString) orb.LineString {
+		out := make(orb.LineString, len(ls))
+		for i, p := range ls {
+			out[i] = c.project(p)
+		}
+		return out
+	}
+
+	switch g := g.(type) {
+	case orb.Point:
+		return c.project(g), nil
+	case orb.LineString:
+		return projectLine(g), nil
+	case orb.MultiLineString:
+		out := make(orb.MultiLineString, len(g))
+		for i, ls := range g {
+			out[i] = projectLine(ls)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("can't project %T to EPSG:%d", g, c.epsg)
+}
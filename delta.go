@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+
+	"github.com/twpayne/go-kml"
+)
+
+// Colors of the routes in an override delta export, before overrides as
+// discovered and after with them applied.
+var (
+	deltaBeforeColor = color.RGBA{R: 0xaa, G: 0x00, B: 0x26, A: 0xff}
+	deltaAfterColor  = color.RGBA{R: 0x1a, G: 0x98, B: 0x50, A: 0xff}
+)
+
+// exportOverrideDelta resolves each request with overrides both ignored and
+// applied and writes KML of just those whose routes differ, with the route
+// as discovered in a "Before" folder and as overridden in an "After" one.
+func exportOverrideDelta(ctx context.Context, st store, w io.Writer, opts exportOptions) error {
+	if opts.coordPrecision < 0 {
+		return fmt.Errorf("coordinate precision must not be negative, got %d", opts.coordPrecision)
+	}
+
+	reqs, err := st.requests(ctx, opts.requestFilter)
+	if err != nil {
+		return err
+	}
+
+	discoverOpts := opts.handlerOptions
+	discoverOpts.noOverrides = true
+
+	var (
+		before, after []kml.Element
+		overridden    int
+	)
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Only requests with overrides can differ.
+		if !hasOverrides(req) {
+			continue
+		}
+		overridden++
+
+		discovered, derr := newDefaultRequestHandler(st, req, discoverOpts).handle(ctx)
+		res, err := newDefaultRequestHandler(st, req, opts.handlerOptions).handle(ctx)
+		if derr != nil && err != nil {
+			logRequestError(req, err)
+			continue
+		}
+		if derr == nil && err == nil && slices.Equal(sortedSegmentIDs(discovered.routeSegments), sortedSegmentIDs(res.routeSegments)) {
+			continue
+		}
+
+		before = append(before, deltaPlacemark(req, discovered, derr, "#delta-before", opts))
+		after = append(after, deltaPlacemark(req, res, err, "#delta-after", opts))
+	}
+
+	doc := kml.Document(
+		kml.SharedStyle("delta-before", routeLineStyle(deltaBeforeColor, opts)),
+		kml.SharedStyle("delta-after", routeLineStyle(deltaAfterColor, opts)),
+		kml.Folder(kml.Name("Before, as discovered")).Add(before...),
+		kml.Folder(kml.Name("After, with overrides")).Add(after...),
+	)
+	if err := writeKML(w, kml.KML(doc), opts.kmz, opts.pretty); err != nil {
+		return err
+	}
+
+	slog.Info("override delta summary", "changed", len(after), "overridden", overridden)
+	return nil
+}
+
+// hasOverrides reports whether req has any override files.
+func hasOverrides(req request) bool {
+	for _, when := range overrideWhens {
+		if _, err := os.Stat(overridePath(req.stableID(), when)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// deltaPlacemark returns a placemark of res's route styled by styleURL, or
+// one with no geometry describing err if it failed to resolve.
+func deltaPlacemark(req request, res requestResult, err error, styleURL string, opts exportOptions) kml.Element {
+	if err != nil {
+		return kml.Placemark(
+			kml.Name(req.String()),
+			kml.Description("Unresolved: "+err.Error()),
+		)
+	}
+
+	return kml.Placemark(
+		kml.Name(req.String()),
+		kml.Description(fmt.Sprintf("Segments %v", sortedSegmentIDs(res.routeSegments))),
+		kml.StyleURL(styleURL),
+		kml.MultiGeometry(routeLineStrings(res.routeSegments, opts.mergeSegments, opts.coordPrecision)...),
+	)
+}
+
+// sortedSegmentIDs returns the IDs of segs in ascending order.
+func sortedSegmentIDs(segs []segment) []int {
+	ids := make([]int, 0, len(segs))
+	for _, seg := range segs {
+		ids = append(ids, seg.id)
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// resolution is the outcome of handling a request in one build.
+type resolution struct {
+	req        request
+	segmentIDs []int
+	err        error
+}
+
+// requestKey identifies a request across builds, where its rank may have
+// changed.
+func requestKey(req request) string {
+	return req.streetName + "\x00" + req.from + "\x00" + req.to
+}
+
+func resolveAll(ctx context.Context, st store, opts handlerOptions) (map[string]resolution, error) {
+	reqs, err := st.requests(ctx, requestFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]resolution, len(reqs))
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		res, err := newDefaultRequestHandler(st, req, opts).handle(ctx)
+
+		out[requestKey(req)] = resolution{req: req, segmentIDs: sortedSegmentIDs(res.routeSegments), err: err}
+	}
+	return out, nil
+}
+
+// diffDatabases resolves the requests in the databases named by args and
+// reports the requests whose resolution differs between them. Each is
+// resolved with a copy of base using its database.
+func diffDatabases(ctx context.Context, w io.Writer, opts handlerOptions, base sqliteStore, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("need old and new database files")
+	}
+
+	var builds [2]map[string]resolution
+	for i, name := range args {
+		db, err := sql.Open("sqlite", name)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		st := base
+		st.db = db
+		if err := st.checkSchema(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := st.migrate(ctx); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		builds[i], err = resolveAll(ctx, st, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	oldRes, newRes := builds[0], builds[1]
+
+	keys := make(map[string]bool)
+	for k := range oldRes {
+		keys[k] = true
+	}
+	for k := range newRes {
+		keys[k] = true
+	}
+
+	type line struct {
+		rank int
+		text string
+	}
+	var lines []line
+
+	for k := range keys {
+		o, inOld := oldRes[k]
+		n, inNew := newRes[k]
+
+		switch {
+		case !inOld:
+			lines = append(lines, line{n.req.rank, fmt.Sprintf("added: %v", n.req)})
+		case !inNew:
+			lines = append(lines, line{o.req.rank, fmt.Sprintf("removed: %v", o.req)})
+		case o.err == nil && n.err != nil:
+			lines = append(lines, line{n.req.rank, fmt.Sprintf("newly failing: %v: %v", n.req, n.err)})
+		case o.err != nil && n.err == nil:
+			lines = append(lines, line{n.req.rank, fmt.Sprintf("newly resolving: %v", n.req)})
+		case o.err == nil && n.err == nil:
+			removed, added := diffIDs(o.segmentIDs, n.segmentIDs)
+			if len(removed) > 0 || len(added) > 0 {
+				lines = append(lines, line{n.req.rank, fmt.Sprintf("changed: %v: removed %v, added %v", n.req, removed, added)})
+			}
+		}
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].rank != lines[j].rank {
+			return lines[i].rank < lines[j].rank
+		}
+		return lines[i].text < lines[j].text
+	})
+
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(w, l.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffIDs returns the IDs only in a and the IDs only in b.
+func diffIDs(a, b []int) (onlyA, onlyB []int) {
+	for _, id := range a {
+		if !contains(b, id) {
+			onlyA = append(onlyA, id)
+		}
+	}
+	for _, id := range b {
+		if !contains(a, id) {
+			onlyB = append(onlyB, id)
+		}
+	}
+	return onlyA, onlyB
+}
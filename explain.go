@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type traceKey struct{}
+
+// withTrace returns a context in which the steps of handling a request
+// are described to w.
+func withTrace(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, traceKey{}, w)
+}
+
+// tracef describes a step of handling a request, if ctx is traced.
+func tracef(ctx context.Context, format string, args ...interface{}) {
+	if w, ok := ctx.Value(traceKey{}).(io.Writer); ok {
+		fmt.Fprintf(w, format+"\n", args...)
+	}
+}
+
+// explainRequest resolves the request with the rank in args, tracing
+// each step, then prints the segments found at each stage.
+func explainRequest(ctx context.Context, st store, w io.Writer, opts handlerOptions, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("need request rank")
+	}
+
+	rank, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+
+	reqs, err := st.requests(ctx, requestFilter{rankMin: rank, rankMax: rank})
+	if err != nil {
+		return err
+	}
+	if len(reqs) == 0 {
+		return fmt.Errorf("no request with rank %d", rank)
+	}
+
+	for _, req := range reqs {
+		fmt.Fprintf(w, "%s (id %s)\n", req, req.stableID())
+
+		att := newDefaultRequestHandler(st, req, opts).handleAttempt(withTrace(ctx, w))
+		for _, stage := range []struct {
+			name string
+			segs []segment
+			err  error
+		}{
+			{"start", att.startSegments, att.startErr},
+			{"end", att.endSegments, att.endErr},
+			{"route", att.routeSegments, att.routeErr},
+		} {
+			fmt.Fprintf(w, "\n%s segments:\n", stage.name)
+			if stage.err != nil {
+				fmt.Fprintf(w, "  error: %v\n", stage.err)
+				continue
+			}
+			for _, seg := range stage.segs {
+				fmt.Fprintf(w, "  %s\n", seg)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+type exportCSVOptions struct {
+	requestFilter  requestFilter
+	handlerOptions handlerOptions
+
+	// tsv uses tabs rather than commas to separate fields.
+	tsv bool
+}
+
+// exportCSV writes one row per resolved route segment of each request.
+func exportCSV(ctx context.Context, st store, w io.Writer, opts exportCSVOptions, _ []string) error {
+	reqs, err := st.requests(ctx, opts.requestFilter)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	if opts.tsv {
+		cw.Comma = '\t'
+	}
+
+	if err := cw.Write([]string{"rank", "street", "district", "raw_from", "raw_to", "resolved_from", "resolved_to", "segment_id", "segment_name", "length_m", "sequence"}); err != nil {
+		return err
+	}
+
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hand := newDefaultRequestHandler(st, req, opts.handlerOptions)
+
+		res, err := hand.handle(ctx)
+		if err != nil {
+			logRequestError(req, err)
+			continue
+		}
+
+		resolvedFrom, resolvedTo := resolvedCrossStreets(req, res)
+		for i, seg := range res.routeSegments {
+			if err := cw.Write([]string{
+				strconv.Itoa(req.rank),
+				req.streetName,
+				req.district,
+				req.rawFrom,
+				req.rawTo,
+				resolvedFrom,
+				resolvedTo,
+				strconv.Itoa(seg.id),
+				seg.name,
+				strconv.FormatFloat(seg.length, 'f', 1, 64),
+				strconv.Itoa(i + 1),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
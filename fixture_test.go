@@ -0,0 +1,2094 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/twpayne/go-kml"
+)
+
+// loadFixture builds an in-memory store from the centreline KML and
+// request TSV in testdata.
+func loadFixture(t *testing.T) *sqliteStore {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	kf, err := os.Open(filepath.Join("testdata", "centrelines.kml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kf.Close()
+
+	if _, err := loadKMLSegments(st, kf, kmlOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rf, err := os.Open(filepath.Join("testdata", "requests.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	if _, err := loadTSVRequests(st, rf, tsvOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return st
+}
+
+func TestFixtureRoutes(t *testing.T) {
+	st := loadFixture(t)
+
+	reqs, err := st.requests(context.Background(), requestFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int][]int{
+		1: {101, 102},
+		3: {101, 102, 103},
+	}
+
+	got := make(map[int][]int)
+	for _, req := range reqs {
+		res, err := newDefaultRequestHandler(st, req, handlerOptions{}).handle(context.Background())
+		if err != nil {
+			t.Fatalf("%v: %v", req, err)
+		}
+
+		for _, seg := range res.routeSegments {
+			got[req.rank] = append(got[req.rank], seg.id)
+		}
+	}
+
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("resolved route mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestLoadTSVRequestsEmptyStreet(t *testing.T) {
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tsv := "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\n" +
+		"1\tTest St\tA Ave\tEnd\t7\n" +
+		"2\t \tA Ave\tEnd\t7\n"
+
+	skipped, err := loadTSVRequests(st, strings.NewReader(tsv), tsvOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 {
+		t.Errorf("got %d skipped, want 1", len(skipped))
+	}
+
+	reqs, err := st.requests(context.Background(), requestFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].rank != 1 {
+		t.Errorf("got requests %v, want only rank 1", reqs)
+	}
+}
+
+func TestLoadTSVRequestsHeader(t *testing.T) {
+	cases := []struct {
+		name    string
+		tsv     string
+		want    []request
+		wantErr bool
+	}{
+		{
+			name: "Reordered",
+			tsv: "District\tExtra\tStreet Name\tRank\tLimit To\tLimit From\n" +
+				"7\tx\tTest St\t1\tC Ave\tA Ave\n",
+			want: []request{{streetName: "Test St", from: "A Ave", to: "C Ave", district: "7", rank: 1, rawFrom: "A Ave", rawTo: "C Ave", extra: map[string]string{"Extra": "x"}}},
+		},
+		{
+			name: "ExtraColumns",
+			tsv: "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\tPetitions\tNotes\n" +
+				"1\tTest St\tA Ave\tC Ave\t7\t42\t \n",
+			want: []request{{streetName: "Test St", from: "A Ave", to: "C Ave", district: "7", rank: 1, rawFrom: "A Ave", rawTo: "C Ave", extra: map[string]string{"Petitions": "42"}}},
+		},
+		{
+			name:    "MissingColumn",
+			tsv:     "Rank\tStreet Name\tLimit From\tLimit To\n1\tTest St\tA Ave\tC Ave\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite", "file::memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			st := &sqliteStore{db: db}
+			if err := st.init(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = loadTSVRequests(st, strings.NewReader(tc.tsv), tsvOptions{})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("wanted error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reqs, err := st.requests(context.Background(), requestFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d := cmp.Diff(tc.want, reqs, cmp.AllowUnexported(request{})); d != "" {
+				t.Errorf("loaded request mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestLoadTSVRequestsSentinels(t *testing.T) {
+	cases := []struct {
+		name     string
+		from, to string
+		opts     tsvOptions
+		want     request
+	}{
+		{
+			name: "Default",
+			from: "All", to: "End",
+			want: request{streetName: "Test St", rank: 1, rawFrom: "All", rawTo: "End"},
+		},
+		{
+			name: "DefaultAlternate",
+			from: "ENTIRE", to: "terminus",
+			want: request{streetName: "Test St", rank: 1, rawFrom: "ENTIRE", rawTo: "terminus"},
+		},
+		{
+			name: "Custom",
+			from: "Beginning", to: "End",
+			opts: tsvOptions{fromSentinels: []string{"beginning"}, toSentinels: []string{"finish"}},
+			want: request{streetName: "Test St", to: "End", rank: 1, rawFrom: "Beginning", rawTo: "End"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite", "file::memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			st := &sqliteStore{db: db}
+			if err := st.init(); err != nil {
+				t.Fatal(err)
+			}
+
+			tsv := "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\n" +
+				"1\tTest St\t" + tc.from + "\t" + tc.to + "\t\n"
+			if _, err := loadTSVRequests(st, strings.NewReader(tsv), tc.opts); err != nil {
+				t.Fatal(err)
+			}
+
+			reqs, err := st.requests(context.Background(), requestFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d := cmp.Diff([]request{tc.want}, reqs, cmp.AllowUnexported(request{})); d != "" {
+				t.Errorf("loaded request mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestRequestsDistrict(t *testing.T) {
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tsv := "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\n" +
+		"1\tTest St\tA Ave\tEnd\t Harbour East \n" +
+		"2\tOther St\tA Ave\tEnd\tHarbour West\n"
+
+	if _, err := loadTSVRequests(st, strings.NewReader(tsv), tsvOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := st.requests(context.Background(), requestFilter{district: "harbour east"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []request{{streetName: "Test St", from: "A Ave", district: "HARBOUR EAST", rank: 1, rawFrom: "A Ave", rawTo: "End"}}
+	if d := cmp.Diff(want, reqs, cmp.AllowUnexported(request{})); d != "" {
+		t.Errorf("filtered request mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestHashInput(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "requests.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(b)
+	want := hex.EncodeToString(sum[:])
+
+	// load reads only part of the input, as the KML decoder may.
+	got, err := hashInput(bytes.NewReader(b), func(r io.Reader) error {
+		_, err := r.Read(make([]byte, 10))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got hash %s, want %s", got, want)
+	}
+}
+
+func TestExportGPKG(t *testing.T) {
+	st := loadFixture(t)
+
+	path := filepath.Join(t.TempDir(), "out.gpkg")
+	if err := exportGPKG(context.Background(), st, path, exportGPKGOptions{network: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	got := make(map[string]int)
+	for _, table := range []string{"requests", "rtree_requests_geom", "network", "gpkg_geometry_columns"} {
+		var n int
+		if err := db.QueryRow("select count(*) from " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		got[table] = n
+	}
+
+	want := map[string]int{
+		"requests":              2,
+		"rtree_requests_geom":   2,
+		"network":               4,
+		"gpkg_geometry_columns": 2,
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("table row count mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestExportGPKGCRS(t *testing.T) {
+	st := loadFixture(t)
+
+	c, err := parseCRS("32620")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "out.gpkg")
+	if err := exportGPKG(context.Background(), st, path, exportGPKGOptions{crs: c}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var srsID int
+	var minX float64
+	if err := db.QueryRow("select srs_id, min_x from gpkg_contents where table_name = 'requests'").Scan(&srsID, &minX); err != nil {
+		t.Fatal(err)
+	}
+	if srsID != 32620 {
+		t.Errorf("got srs_id %d, want 32620", srsID)
+	}
+	// Eastings are hundreds of kilometres, not degrees.
+	if minX < 1000 {
+		t.Errorf("got min_x %v, want a projected easting", minX)
+	}
+
+	rows, err := db.Query("select srs_id from gpkg_spatial_ref_sys order by srs_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff([]int{-1, 0, 4326, 32620}, ids); d != "" {
+		t.Errorf("spatial ref systems mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestBuildDBMemory(t *testing.T) {
+	db, err := openDB("data.db", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := buildDB(context.Background(), st, filepath.Join("testdata", "centrelines.kml"), filepath.Join("testdata", "requests.tsv"), buildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat("data.db"); !os.IsNotExist(err) {
+		t.Errorf("got stat error %v, want data.db not to exist", err)
+	}
+
+	reqs, err := st.requests(context.Background(), requestFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) == 0 {
+		t.Error("got no requests from in-memory database")
+	}
+}
+
+func TestOpenDBMemory(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := openDB("data.db", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, "create table t (n integer); insert into t values (1), (2)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Querying while rows are open needs a second connection to the same
+	// database.
+	rows, err := db.QueryContext(ctx, "select n from t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var count int
+		if err := db.QueryRowContext(ctx, "select count(*) from t").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("got count %d, want 2", count)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another in-memory database is separate.
+	other, err := openDB("data.db", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.ExecContext(ctx, "create table t (n integer)"); err != nil {
+		t.Errorf("creating table in a second in-memory database: %v", err)
+	}
+}
+
+func TestCompleteStreetNames(t *testing.T) {
+	st := loadFixture(t)
+
+	cases := []struct {
+		prefix string
+		want   string
+	}{
+		{"te", "TEST ST\n"},
+		{"", "OTHER RD\nTEST ST\n"},
+		{"%", ""},
+	}
+
+	for _, tc := range cases {
+		var buf bytes.Buffer
+		if err := completeStreetNames(context.Background(), st, &buf, []string{tc.prefix}); err != nil {
+			t.Fatal(err)
+		}
+		if d := cmp.Diff(tc.want, buf.String()); d != "" {
+			t.Errorf("%q: completion mismatch (-want +got):\n%s", tc.prefix, d)
+		}
+	}
+}
+
+func TestResolvedCrossStreets(t *testing.T) {
+	st := loadFixture(t)
+
+	reqs, err := st.requests(context.Background(), requestFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type crossStreets struct{ rawFrom, rawTo, from, to string }
+	got := make(map[int]crossStreets)
+	for _, req := range reqs {
+		res, err := newDefaultRequestHandler(st, req, handlerOptions{}).handle(context.Background())
+		if err != nil {
+			t.Fatalf("%v: %v", req, err)
+		}
+		from, to := resolvedCrossStreets(req, res)
+		got[req.rank] = crossStreets{req.rawFrom, req.rawTo, from, to}
+	}
+
+	want := map[int]crossStreets{
+		1: {"A Ave", "C Ave", "A AVE", "C AVE"},
+		3: {"All", "End", "", ""},
+	}
+	if d := cmp.Diff(want, got, cmp.AllowUnexported(crossStreets{})); d != "" {
+		t.Errorf("cross street mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestExportFewRequests(t *testing.T) {
+	st := loadFixture(t)
+
+	var buf bytes.Buffer
+	opts := exportOptions{gradientSteps: 20, orderBy: "rank", maxFailures: 1}
+	if err := export(context.Background(), st, &buf, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, style := range []string{"#line-group-0", "#line-group-13"} {
+		if !strings.Contains(buf.String(), "<styleUrl>"+style+"</styleUrl>") {
+			t.Errorf("output has no placemark styled %s", style)
+		}
+	}
+}
+
+func TestExportEndpoints(t *testing.T) {
+	st := loadFixture(t)
+
+	var buf bytes.Buffer
+	opts := exportOptions{gradientSteps: 20, orderBy: "rank", maxFailures: 1, endpoints: true}
+	if err := export(context.Background(), st, &buf, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	_, endpoints, ok := strings.Cut(out, "<name>Endpoints</name>")
+	if !ok {
+		t.Fatalf("output has no Endpoints folder:\n%s", out)
+	}
+	for _, name := range []string{"A AVE", "C AVE", "Start of Test St", "End of Test St"} {
+		if !strings.Contains(endpoints, "<name>"+name+"</name>") {
+			t.Errorf("endpoints missing %q:\n%s", name, endpoints)
+		}
+	}
+	if n := strings.Count(endpoints, "<Point>"); n != 4 {
+		t.Errorf("got %d endpoint points, want 4", n)
+	}
+}
+
+func TestListSegmentsWKT(t *testing.T) {
+	st := loadFixture(t)
+
+	var buf bytes.Buffer
+	if err := listSegments(context.Background(), st, &buf, "wkt", []string{"Test", "St"}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3:\n%s", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		if _, geom, _ := strings.Cut(line, "\t"); !strings.HasPrefix(geom, "LINESTRING(") {
+			t.Errorf("got line %q, want ID and LINESTRING", line)
+		}
+	}
+}
+
+func TestSegmentLinks(t *testing.T) {
+	st := loadFixture(t)
+
+	got, err := st.segmentLinks(context.Background(), 102)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []segmentLink{
+		{exit: segmentEnd{101, endLast}, entry: segmentEnd{102, endFirst}},
+		{exit: segmentEnd{102, endFirst}, entry: segmentEnd{101, endLast}},
+		{exit: segmentEnd{102, endLast}, entry: segmentEnd{103, endFirst}},
+		{exit: segmentEnd{103, endFirst}, entry: segmentEnd{102, endLast}},
+	}
+	if d := cmp.Diff(want, got, cmp.AllowUnexported(segmentLink{}, segmentEnd{})); d != "" {
+		t.Errorf("links mismatch (-want +got):\n%s", d)
+	}
+
+	var buf bytes.Buffer
+	if err := listLinks(context.Background(), st, &buf, []string{"102"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "103  TEST ST") {
+		t.Errorf("output missing link to 103:\n%s", buf.String())
+	}
+}
+
+func TestWriteSnapReport(t *testing.T) {
+	st := loadFixture(t)
+
+	var buf bytes.Buffer
+	if err := writeSnapReport(context.Background(), st, &buf, snapTolerance); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, want header and 4 links:\n%s", len(lines), buf.String())
+	}
+	if want := "101,last,102,first,0.000,0.00"; !slices.Contains(lines[1:], want) {
+		t.Errorf("report missing %q:\n%s", want, buf.String())
+	}
+}
+
+func TestExportSplitFilesResume(t *testing.T) {
+	st := loadFixture(t)
+	dir := t.TempDir()
+
+	// A file from an earlier, interrupted run.
+	existing := filepath.Join(dir, "1.kml")
+	if err := os.WriteFile(existing, []byte("earlier"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := exportOptions{gradientSteps: 20}
+	if err := exportSplitFiles(context.Background(), st, dir, opts, true); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "earlier" {
+		t.Errorf("existing file was rewritten: %q", b)
+	}
+
+	b, err = os.ReadFile(filepath.Join(dir, "3.kml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "<Placemark>") {
+		t.Errorf("3.kml has no placemark:\n%s", b)
+	}
+}
+
+func TestExportSplitFilesSelection(t *testing.T) {
+	st := loadFixture(t)
+	dir := t.TempDir()
+
+	opts := exportOptions{gradientSteps: 20, requestFilter: requestFilter{rankMin: 3, rankMax: 3}}
+	if err := exportSplitFiles(context.Background(), st, dir, opts, false); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if d := cmp.Diff([]string{"3.kml"}, names); d != "" {
+		t.Fatalf("files mismatch (-want +got):\n%s", d)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "3.kml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0o644 {
+		t.Errorf("got mode %v, want -rw-r--r--", got)
+	}
+}
+
+func TestMigrateOverrideFiles(t *testing.T) {
+	st := loadFixture(t)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if err := os.Mkdir(overrideDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"1.route", "1.loopstart"} {
+		if err := os.WriteFile(filepath.Join(overrideDir, name), []byte("101\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrateOverrideFiles(context.Background(), st); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := st.requests(context.Background(), requestFilter{rankMin: 1, rankMax: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := reqs[0]
+
+	if _, err := os.Stat(overridePath(req.stableID(), "loopstart")); err != nil {
+		t.Errorf("loopstart override wasn't migrated: %v", err)
+	}
+
+	// Re-ranking doesn't change which override applies.
+	req.rank = 2
+	res, err := newDefaultRequestHandler(st, req, handlerOptions{}).handle(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.routeSegments) != 1 || res.routeSegments[0].id != 101 {
+		t.Errorf("got route %v, want override of 101", res.routeSegments)
+	}
+}
+
+func TestExplainRequest(t *testing.T) {
+	st := loadFixture(t)
+
+	var buf bytes.Buffer
+	if err := explainRequest(context.Background(), st, &buf, handlerOptions{}, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`start: 1 segments named TEST ST ending at ["A AVE"]`,
+		`end: 2 segments on route`,
+		`route: search from segment 101`,
+		"route segments:\n  101 TEST ST",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("trace missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	st := loadFixture(t)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if err := applyOverrides(context.Background(), st, strings.NewReader("rank,stage,segment_ids\n1,route,101 102\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := st.requests(context.Background(), requestFilter{rankMin: 1, rankMax: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(overridePath(reqs[0].stableID(), "route"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "101\n102\n" {
+		t.Errorf("got override %q, want %q", b, "101\n102\n")
+	}
+
+	for _, csv := range []string{
+		"2,route,101\n",
+		"1,middle,101\n",
+		"1,start,999\n",
+	} {
+		if err := applyOverrides(context.Background(), st, strings.NewReader(csv)); err == nil {
+			t.Errorf("%q: wanted error", csv)
+		}
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	st := loadFixture(t)
+
+	var buf bytes.Buffer
+	if err := exportNDJSON(context.Background(), st, &buf, exportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ranks []float64
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		f, err := geojson.UnmarshalFeature([]byte(line))
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if _, ok := f.Geometry.(orb.MultiLineString); !ok {
+			t.Errorf("got geometry %T, want MultiLineString", f.Geometry)
+		}
+		ranks = append(ranks, f.Properties["rank"].(float64))
+	}
+	if d := cmp.Diff([]float64{1, 3}, ranks); d != "" {
+		t.Errorf("feature ranks mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestLoadKMLSegmentsLayouts(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "centrelines.kml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := string(b)
+
+	cases := []struct {
+		name string
+		kml  string
+	}{
+		{"Folder", orig},
+		{"Document", strings.NewReplacer("<Folder><name>Street_Centrelines</name>", "", "</Folder>", "").Replace(orig)},
+		{"Nested", strings.NewReplacer("<Folder>", "<Folder><Folder>", "</Folder>", "</Folder><Folder></Folder></Folder>").Replace(orig)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite", "file::memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			st := &sqliteStore{db: db}
+			if err := st.init(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := loadKMLSegments(st, strings.NewReader(tc.kml), kmlOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			segs, err := st.filterSegments(context.Background(), segmentFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segs) != 4 {
+				t.Errorf("got %d segments, want 4", len(segs))
+			}
+		})
+	}
+}
+
+func TestBuildDBRequestsURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("output") != "csv" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "Rank,Street Name,Limit From,Limit To,District\n1,Test St,A Ave,\"C Ave, north\",7\n")
+	}))
+	defer srv.Close()
+
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	kml := filepath.Join("testdata", "centrelines.kml")
+	if err := buildDB(context.Background(), st, kml, srv.URL+"/missing", buildOptions{}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("got error %v, want 404 status", err)
+	}
+
+	if err := buildDB(context.Background(), st, kml, srv.URL+"/pub?output=csv", buildOptions{fetchTimeout: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := st.requests(context.Background(), requestFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []request{{streetName: "Test St", from: "A Ave", to: "C Ave, north", district: "7", rank: 1, rawFrom: "A Ave", rawTo: "C Ave, north"}}
+	if d := cmp.Diff(want, reqs, cmp.AllowUnexported(request{})); d != "" {
+		t.Errorf("loaded request mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestExportByStreet(t *testing.T) {
+	st := loadFixture(t)
+
+	var buf bytes.Buffer
+	if err := exportByStreet(context.Background(), st, &buf, exportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if n := strings.Count(out, "<Placemark>"); n != 1 {
+		t.Errorf("got %d placemarks, want 1", n)
+	}
+	if !strings.Contains(out, "<description>Ranks 1, 3</description>") {
+		t.Errorf("output missing ranks description:\n%s", out)
+	}
+	// The three segments touch, so merge into one line string.
+	if n := strings.Count(out, "<LineString>"); n != 1 {
+		t.Errorf("got %d line strings, want 1", n)
+	}
+}
+
+func TestPrintTop(t *testing.T) {
+	st := loadFixture(t)
+
+	for _, tc := range []struct {
+		name     string
+		shortest bool
+		want     string
+	}{
+		{"longest", false, "3 "},
+		{"shortest", true, "1 "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := printTop(context.Background(), st, &buf, topOptions{by: "length", n: 1, shortest: tc.shortest}); err != nil {
+				t.Fatal(err)
+			}
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("got %d lines, want header and 1 row:\n%s", len(lines), buf.String())
+			}
+			if !strings.HasPrefix(lines[1], tc.want) {
+				t.Errorf("got row %q, want rank %s", lines[1], tc.want)
+			}
+		})
+	}
+}
+
+func TestUnknownStreetRequests(t *testing.T) {
+	st := loadFixture(t)
+
+	extra := "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\n" +
+		"9\tNowhere Rd\tAll\tEnd\t7\n" +
+		"10\ttest  st\tAll\tEnd\t7\n"
+	if _, err := loadTSVRequests(st, strings.NewReader(extra), tsvOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	unknown, err := unknownStreetRequests(context.Background(), st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ranks []int
+	for _, req := range unknown {
+		ranks = append(ranks, req.rank)
+	}
+	if d := cmp.Diff([]int{9}, ranks); d != "" {
+		t.Errorf("unknown street request ranks mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestLoadKMLSegmentsMultiGeometry(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "centrelines.kml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Split segment 101 into two line strings meeting at its middle.
+	kml := strings.Replace(string(b),
+		"<LineString><coordinates>-63.580,44.640 -63.580,44.641</coordinates></LineString>",
+		"<LineString><coordinates>-63.580,44.640 -63.580,44.6405</coordinates></LineString><LineString><coordinates>-63.580,44.6405 -63.580,44.641</coordinates></LineString>",
+		1)
+
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKMLSegments(st, strings.NewReader(kml), kmlOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	segs, err := st.filterSegments(context.Background(), segmentFilter{ids: []int{101}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 1 {
+		t.Fatalf("got %d segments, want 1", len(segs))
+	}
+
+	want := orb.LineString{{-63.580, 44.640}, {-63.580, 44.6405}, {-63.580, 44.641}}
+	if d := cmp.Diff(want, segs[0].lineString); d != "" {
+		t.Errorf("line string mismatch (-want +got):\n%s", d)
+	}
+
+	// The joined segment still links to the next one.
+	links, err := st.segmentLinks(context.Background(), 101)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var linked bool
+	for _, l := range links {
+		if l.exit.id == 101 && l.entry.id == 102 {
+			linked = true
+		}
+	}
+	if !linked {
+		t.Errorf("segment 101 not linked to 102: %v", links)
+	}
+
+	// Parts that don't touch are an error rather than being bridged.
+	gap := strings.Replace(string(b),
+		"<LineString><coordinates>-63.580,44.640 -63.580,44.641</coordinates></LineString>",
+		"<LineString><coordinates>-63.580,44.640 -63.580,44.6403</coordinates></LineString><LineString><coordinates>-63.580,44.6407 -63.580,44.641</coordinates></LineString>",
+		1)
+	if _, err := loadKMLSegments(st, strings.NewReader(gap), kmlOptions{}); err == nil || !strings.Contains(err.Error(), "disconnected parts") {
+		t.Errorf("loading disconnected parts: got err %v, want disconnected parts error", err)
+	}
+}
+
+func TestLoadSkipErrors(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "centrelines.kml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	badKML := strings.Replace(string(b), `<SimpleData name="ROUTE_ID">1</SimpleData>`, `<SimpleData name="ROUTE_ID">one</SimpleData>`, 1)
+	badTSV := "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\n" +
+		"1\tTest St\tA Ave\tEnd\t7\n" +
+		"x\tTest St\tAll\tEnd\t7\n"
+
+	for _, skip := range []bool{false, true} {
+		t.Run(strconv.FormatBool(skip), func(t *testing.T) {
+			db, err := sql.Open("sqlite", "file::memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			st := &sqliteStore{db: db}
+			if err := st.init(); err != nil {
+				t.Fatal(err)
+			}
+
+			kmlSkipped, err := loadKMLSegments(st, strings.NewReader(badKML), kmlOptions{skipErrors: skip})
+			if !skip {
+				if err == nil || !strings.Contains(err.Error(), "placemark 1") {
+					t.Errorf("got KML error %v, want one naming placemark 1", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if len(kmlSkipped) != 1 {
+				t.Errorf("got %d skipped placemarks, want 1", len(kmlSkipped))
+			}
+
+			tsvSkipped, err := loadTSVRequests(st, strings.NewReader(badTSV), tsvOptions{skipErrors: skip})
+			if !skip {
+				if err == nil || !strings.Contains(err.Error(), "row 3") {
+					t.Errorf("got TSV error %v, want one naming row 3", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tsvSkipped) != 1 {
+				t.Errorf("got %d skipped rows, want 1", len(tsvSkipped))
+			}
+
+			segs, err := st.filterSegments(context.Background(), segmentFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			reqs, err := st.requests(context.Background(), requestFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segs) != 3 || len(reqs) != 1 {
+				t.Errorf("got %d segments and %d requests, want 3 and 1", len(segs), len(reqs))
+			}
+		})
+	}
+}
+
+func TestRouteVizRequest(t *testing.T) {
+	st := loadFixture(t)
+
+	var buf bytes.Buffer
+	if err := routeViz(context.Background(), st, &buf, routeVizOptions{request: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		`n101 [label="A AVE to B AVE", style=filled, fillcolor=palegreen];`,
+		`n102 [label="B AVE to C AVE", style=filled, fillcolor=lightpink];`,
+		"n101 -> n102 [color=blue, penwidth=3];",
+		"n102 -> n101 [color=grey];",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+// fakeGeocoder geocodes queries it has a point for.
+type fakeGeocoder map[string]orb.Point
+
+func (g fakeGeocoder) geocode(_ context.Context, query string) (orb.Point, bool, error) {
+	p, ok := g[query]
+	return p, ok, nil
+}
+
+func TestGeocheck(t *testing.T) {
+	st := loadFixture(t)
+
+	gc := fakeGeocoder{
+		"Test St and A Ave": {-63.580, 44.640},
+		// About a kilometre east of the end of the route.
+		"Test St and C Ave": {-63.567, 44.642},
+	}
+
+	var buf bytes.Buffer
+	if err := geocheck(context.Background(), st, gc, &buf, geocheckOptions{maxDistance: 200}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want header and 2 rows:\n%s", len(lines), buf.String())
+	}
+	for i, want := range []string{"ok", "far"} {
+		if f := strings.Fields(lines[i+1]); f[len(f)-1] != want {
+			t.Errorf("got row %q, want status %s", lines[i+1], want)
+		}
+	}
+}
+
+func TestNominatimGeocoder(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "test" {
+			t.Errorf("got user agent %q, want test", r.Header.Get("User-Agent"))
+		}
+		if r.URL.Query().Get("q") == "Test St and A Ave" {
+			io.WriteString(w, `[{"lat":"44.640","lon":"-63.580"}]`)
+			return
+		}
+		io.WriteString(w, `[]`)
+	}))
+	defer srv.Close()
+
+	gc := &nominatimGeocoder{client: srv.Client(), baseURL: srv.URL, userAgent: "test"}
+
+	p, ok, err := gc.geocode(context.Background(), "Test St and A Ave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || p != (orb.Point{-63.580, 44.640}) {
+		t.Errorf("got %v, %v, want found at -63.580, 44.640", p, ok)
+	}
+
+	if _, ok, err := gc.geocode(context.Background(), "Nowhere"); err != nil || ok {
+		t.Errorf("got found %v, error %v, want not found", ok, err)
+	}
+}
+
+func TestExportSegmentLabels(t *testing.T) {
+	st := loadFixture(t)
+
+	var buf bytes.Buffer
+	opts := exportOptions{gradientSteps: 20, orderBy: "rank", maxFailures: 1, segmentLabels: true}
+	if err := export(context.Background(), st, &buf, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	_, labels, ok := strings.Cut(out, "<name>Segment labels</name>")
+	if !ok {
+		t.Fatalf("output has no Segment labels folder:\n%s", out)
+	}
+	for _, name := range []string{"A AVE → B AVE", "B AVE → C AVE", "C AVE → D AVE"} {
+		if !strings.Contains(labels, "<name>"+name+"</name>") {
+			t.Errorf("labels missing %q:\n%s", name, labels)
+		}
+	}
+	// Two segments for rank 1 and three for the whole of Test St.
+	if n := strings.Count(labels, "<Point>"); n != 5 {
+		t.Errorf("got %d label points, want 5", n)
+	}
+}
+
+func TestExportGroupByDistrict(t *testing.T) {
+	st := loadFixture(t)
+
+	for _, tc := range []struct {
+		groupBy string
+		folders int
+	}{
+		{groupBy: "district", folders: 2},
+		{groupBy: "none", folders: 1},
+	} {
+		t.Run(tc.groupBy, func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := exportOptions{gradientSteps: 20, orderBy: "rank", maxFailures: 1, groupBy: tc.groupBy}
+			if err := export(context.Background(), st, &buf, opts, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			out := buf.String()
+			if n := strings.Count(out, "<Folder>"); n != tc.folders {
+				t.Errorf("got %d folders, want %d:\n%s", n, tc.folders, out)
+			}
+			if got := strings.Contains(out, "<name>District 7</name>"); got != (tc.groupBy == "district") {
+				t.Errorf("got District 7 folder %v, want %v", got, !got)
+			}
+		})
+	}
+}
+
+func TestDistrictFolders(t *testing.T) {
+	var placemarks []districtPlacemark
+	for _, d := range []string{"10", "", "2", "10"} {
+		placemarks = append(placemarks, districtPlacemark{district: d, placemark: kml.Placemark()})
+	}
+
+	var got []string
+	for _, f := range districtFolders(placemarks) {
+		var buf bytes.Buffer
+		if err := f.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(buf.String(), xml.Header+"<Folder><name>"), "</name>")
+		got = append(got, fmt.Sprintf("%s %d", name, strings.Count(buf.String(), "<Placemark>")))
+	}
+
+	want := []string{"District 2 1", "District 10 2", "No district 1"}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("folders mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestInMemoryStoreMatchesSQLite(t *testing.T) {
+	ctx := context.Background()
+	st := loadFixture(t)
+
+	segs, err := st.filterSegments(ctx, segmentFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs, err := st.requests(ctx, requestFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, err := newInMemoryStore(segs, reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bound := orb.Bound{Min: orb.Point{-63.581, 44.6405}, Max: orb.Point{-63.579, 44.6415}}
+	for i, filter := range []segmentFilter{
+		{},
+		{ids: []int{102, 201}},
+		{fullNames: []string{"test st"}},
+		{baseNames: []string{"TEST"}},
+		{baseNames: []string{"TEST"}, streetTypes: []string{"st"}},
+		{routeIDs: []int{2}},
+		{fullNames: []string{"Test St"}, endStreets: []string{"B AVE"}},
+		{bbox: &bound},
+	} {
+		want, err := st.filterSegments(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := mem.filterSegments(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := cmp.Diff(want, got, cmp.AllowUnexported(segment{})); d != "" {
+			t.Errorf("filter %d: segments mismatch (-sqlite +memory):\n%s", i, d)
+		}
+	}
+
+	wantNames, err := st.streetNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotNames, err := mem.streetNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(wantNames, gotNames); d != "" {
+		t.Errorf("street names mismatch (-sqlite +memory):\n%s", d)
+	}
+
+	wantLinks, err := st.routeLinks(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotLinks, err := mem.routeLinks(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(wantLinks, gotLinks); d != "" {
+		t.Errorf("route links mismatch (-sqlite +memory):\n%s", d)
+	}
+
+	for _, req := range reqs {
+		want, err := newDefaultRequestHandler(st, req, handlerOptions{}).handle(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := newDefaultRequestHandler(mem, req, handlerOptions{}).handle(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := cmp.Diff(want, got, cmp.AllowUnexported(requestResult{}, segment{})); d != "" {
+			t.Errorf("%s: result mismatch (-sqlite +memory):\n%s", req, d)
+		}
+	}
+}
+
+func TestExportOverrideDelta(t *testing.T) {
+	st := loadFixture(t)
+
+	reqs, err := st.requests(context.Background(), requestFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if err := os.Mkdir(overrideDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// Rank 1 is discovered as 101 and 102; the override cuts it short.
+	if err := os.WriteFile(overridePath(reqs[0].stableID(), "route"), []byte("101\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Rank 3's override matches what's discovered, so it's left out.
+	if err := os.WriteFile(overridePath(reqs[1].stableID(), "route"), []byte("101\n102\n103\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := exportOverrideDelta(context.Background(), st, &buf, exportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	beforeFolder, afterFolder, ok := strings.Cut(out, "<name>After, with overrides</name>")
+	if !ok {
+		t.Fatalf("output has no After folder:\n%s", out)
+	}
+	for _, tc := range []struct {
+		folder, style string
+		lines         int
+	}{
+		{beforeFolder, "#delta-before", 2},
+		{afterFolder, "#delta-after", 1},
+	} {
+		if n := strings.Count(tc.folder, "<Placemark>"); n != 1 {
+			t.Errorf("got %d %s placemarks, want 1", n, tc.style)
+		}
+		if !strings.Contains(tc.folder, "<name>"+reqs[0].String()+"</name>") {
+			t.Errorf("%s placemark isn't for %s:\n%s", tc.style, reqs[0], tc.folder)
+		}
+		if n := strings.Count(tc.folder, "<LineString>"); n != tc.lines {
+			t.Errorf("got %d %s line strings, want %d", n, tc.style, tc.lines)
+		}
+	}
+}
+
+func TestLoadKMLSegmentsFieldNames(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "centrelines.kml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another city's schema, naming the ID and route fields differently.
+	kml := strings.NewReplacer(`"FDMID"`, `"OBJECTID"`, `"ROUTE_ID"`, `"RTE"`).Replace(string(b))
+
+	fields, err := parseKMLFields("id=OBJECTID, route_id=RTE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadKMLSegments(st, strings.NewReader(kml), kmlOptions{}); err == nil {
+		t.Fatal("got no error loading with the default field names, want one")
+	}
+	if _, err := loadKMLSegments(st, strings.NewReader(kml), kmlOptions{fields: fields}); err != nil {
+		t.Fatal(err)
+	}
+
+	segs, err := st.filterSegments(context.Background(), segmentFilter{routeIDs: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, seg := range segs {
+		ids = append(ids, seg.id)
+	}
+	if d := cmp.Diff([]int{101, 102, 103}, ids); d != "" {
+		t.Errorf("route 1 segment IDs mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestParseKMLFieldsErrors(t *testing.T) {
+	for _, s := range []string{"objectid", "id=", "segment_id=OBJECTID"} {
+		if _, err := parseKMLFields(s); err == nil {
+			t.Errorf("parseKMLFields(%q): got no error, want one", s)
+		}
+	}
+}
+
+func TestCheckSegmentLinks(t *testing.T) {
+	ctx := context.Background()
+	st := loadFixture(t)
+
+	violations, err := st.checkSegmentLinks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) > 0 {
+		t.Fatalf("got violations for the fixture, want none: %v", violations)
+	}
+
+	for _, q := range []string{
+		"insert into segment_links (id, route_id, next_id, exit_end, entry_end) values (101, 1, 101, 'last', 'first')",
+		"insert into segment_links (id, route_id, next_id, exit_end, entry_end) values (102, 1, 999, 'last', 'first')",
+		"insert into segment_links (id, route_id, next_id, exit_end, entry_end) values (101, 1, 201, 'first', 'first')",
+	} {
+		if _, err := st.db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	violations, err = st.checkSegmentLinks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []linkViolation{
+		{id: 101, nextID: 101, problem: "links to itself"},
+		{id: 102, nextID: 999, problem: "refers to a missing segment"},
+		{id: 101, nextID: 201, problem: "crosses routes"},
+	}
+	if d := cmp.Diff(want, violations, cmp.AllowUnexported(linkViolation{})); d != "" {
+		t.Errorf("violations mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestExportTopoJSON(t *testing.T) {
+	st := loadFixture(t)
+
+	var buf bytes.Buffer
+	opts := topoJSONOptions{quantization: 1000}
+	if err := exportTopoJSON(context.Background(), st, &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var topo struct {
+		Type      string
+		Transform *topoTransform
+		Arcs      [][][2]float64
+		Objects   map[string]struct {
+			Geometries []struct {
+				ID         int
+				Arcs       json.RawMessage
+				Properties map[string]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &topo); err != nil {
+		t.Fatalf("decoding %s: %v", buf.String(), err)
+	}
+
+	if topo.Type != "Topology" {
+		t.Errorf("got type %q, want Topology", topo.Type)
+	}
+	if topo.Transform == nil {
+		t.Fatal("quantized topology has no transform")
+	}
+	if len(topo.Arcs) != 4 {
+		t.Fatalf("got %d arcs, want one per segment", len(topo.Arcs))
+	}
+	for _, p := range topo.Arcs[0] {
+		if p[0] != math.Trunc(p[0]) || p[1] != math.Trunc(p[1]) {
+			t.Errorf("quantized arc has fractional position %v", p)
+		}
+	}
+
+	arcs := make(map[int]int)
+	for _, g := range topo.Objects["network"].Geometries {
+		var idx []int
+		if err := json.Unmarshal(g.Arcs, &idx); err != nil {
+			t.Fatal(err)
+		}
+		arcs[g.ID] = idx[0]
+	}
+
+	var rank1 [][]int
+	for _, g := range topo.Objects["requests"].Geometries {
+		if g.ID != 1 {
+			continue
+		}
+		if err := json.Unmarshal(g.Arcs, &rank1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diff := cmp.Diff([][]int{{arcs[101]}, {arcs[102]}}, rank1); diff != "" {
+		t.Errorf("rank 1 arcs mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRelink(t *testing.T) {
+	ctx := context.Background()
+	st := loadFixture(t)
+
+	links := func() []segmentLink {
+		t.Helper()
+		var out []segmentLink
+		for _, id := range []int{101, 102, 103} {
+			l, err := st.segmentLinks(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, l...)
+		}
+		return out
+	}
+	built := links()
+
+	// Stale links are dropped.
+	if _, err := st.db.Exec("insert into segment_links (id, route_id, next_id, exit_end, entry_end) values (101, 1, 101, 'last', 'first')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.relink(ctx, snapTolerance); err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(built, links(), cmp.AllowUnexported(segmentLink{}, segmentEnd{})); d != "" {
+		t.Errorf("relinked links mismatch (-built +relinked):\n%s", d)
+	}
+
+	// Segments are about 110m long, so a wider tolerance links ends
+	// that don't meet.
+	if err := st.relink(ctx, 500); err != nil {
+		t.Fatal(err)
+	}
+	if got := links(); len(got) <= len(built) {
+		t.Errorf("got %d links with a 500m tolerance, want more than %d", len(got), len(built))
+	}
+
+	if err := st.relink(ctx, 0); err == nil {
+		t.Error("relink with zero tolerance succeeded, want error")
+	}
+}
+
+func TestExportExtraData(t *testing.T) {
+	st := loadFixture(t)
+
+	tsv := "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\tNotes\tPetitions\n" +
+		"5\tTest St\tB Ave\tD Ave\t7\tnear the school\t12\n"
+	if _, err := loadTSVRequests(st, strings.NewReader(tsv), tsvOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, extraData := range []bool{false, true} {
+		var buf bytes.Buffer
+		opts := exportOptions{gradientSteps: 20, orderBy: "rank", maxFailures: 1, extraData: extraData}
+		if err := export(context.Background(), st, &buf, opts, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		out := buf.String()
+		for _, data := range []string{
+			`<Data name="Notes"><value>near the school</value></Data>`,
+			`<Data name="Petitions"><value>12</value></Data>`,
+		} {
+			if got := strings.Contains(out, data); got != extraData {
+				t.Errorf("with extraData %v, output contains %s: %v", extraData, data, got)
+			}
+		}
+	}
+}
+
+func TestParseTile(t *testing.T) {
+	cases := []struct {
+		s       string
+		want    maptile.Tile
+		wantErr bool
+	}{
+		{s: "14/5298/5916", want: maptile.New(5298, 5916, 14)},
+		{s: "0/0/0", want: maptile.New(0, 0, 0)},
+		{s: "14/5298", wantErr: true},
+		{s: "14/x/5916", wantErr: true},
+		{s: "1/2/0", wantErr: true},
+		{s: "33/0/0", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := parseTile(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseTile(%q) = %v, want error", tc.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTile(%q): %v", tc.s, err)
+		} else if got != tc.want {
+			t.Errorf("parseTile(%q) = %v, want %v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestMVTLineGeometry(t *testing.T) {
+	// The north-east quarter of the world, with the equator along its
+	// bottom edge.
+	tile := maptile.New(1, 0, 1)
+	mls := orb.MultiLineString{{{0, 0}, {0, 0.00001}, {90, 0}}}
+
+	// MoveTo (0, 4096), then LineTo (2048, 4096), with the point
+	// rounding to the first dropped.
+	want := []uint32{9, 0, 8192, 10, 4096, 0}
+	if diff := cmp.Diff(want, mvtLineGeometry(tile, mls)); diff != "" {
+		t.Errorf("geometry mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestExportMVT(t *testing.T) {
+	ctx := context.Background()
+	st := loadFixture(t)
+	opts := exportOptions{maxFailures: 1}
+
+	layer, err := requestTileLayer(ctx, st, opts, maptile.At(orb.Point{-63.580, 44.6405}, 14))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint64
+	for _, f := range layer.features {
+		ids = append(ids, f.id)
+	}
+	if diff := cmp.Diff([]uint64{1, 3}, ids); diff != "" {
+		t.Errorf("feature ids mismatch (-want +got):\n%s", diff)
+	}
+
+	var buf bytes.Buffer
+	if err := exportMVT(ctx, st, &buf, opts, maptile.At(orb.Point{0, 0}, 14)); err != nil {
+		t.Fatal(err)
+	}
+	// A tile holding only an empty requests layer.
+	var empty protoBuffer
+	empty.varint(15, 2)
+	empty.string(1, "requests")
+	empty.varint(5, mvtExtent)
+	var want protoBuffer
+	want.bytes(3, empty)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("got tile % x far from the fixture, want an empty layer % x", buf.Bytes(), []byte(want))
+	}
+}
+
+func TestExportDedupeRoutes(t *testing.T) {
+	st := loadFixture(t)
+
+	// The same whole street as rank 3, given differently.
+	tsv := "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\n" +
+		"5\tTest St\tEntire\tEnd\t7\n"
+	if _, err := loadTSVRequests(st, strings.NewReader(tsv), tsvOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		dedupe bool
+		routes int
+	}{
+		{dedupe: false, routes: 3},
+		{dedupe: true, routes: 2},
+	} {
+		var buf bytes.Buffer
+		opts := exportOptions{gradientSteps: 20, orderBy: "rank", maxFailures: 1, dedupeRoutes: tc.dedupe}
+		if err := export(context.Background(), st, &buf, opts, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		out := buf.String()
+		if n := strings.Count(out, "<MultiGeometry>"); n != tc.routes {
+			t.Errorf("with dedupe %v, got %d route placemarks, want %d", tc.dedupe, n, tc.routes)
+		}
+		merged := strings.Contains(out, "<name>3 Test St (all) (2 requests)</name>") &&
+			strings.Contains(out, "Requests resolving to this route: 3 Test St (all); 5 Test St (all)")
+		if merged != tc.dedupe {
+			t.Errorf("with dedupe %v, got merged placemark %v:\n%s", tc.dedupe, merged, out)
+		}
+	}
+}
+
+func TestFuzzyMatches(t *testing.T) {
+	st := loadFixture(t)
+
+	tsv := "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\n" +
+		"5\tTestt St\tA Ave\tC Ave\t7\n" +
+		"6\tQwerty Rd\tA Ave\tC Ave\t7\n"
+	if _, err := loadTSVRequests(st, strings.NewReader(tsv), tsvOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := printFuzzyMatches(context.Background(), st, &buf, handlerOptions{fuzzy: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want a header and 2 requests:\n%s", len(lines), buf.String())
+	}
+	for i, want := range [][]string{
+		{"5", "Testt St", "TEST ST", "0.88", "resolved"},
+		{"6", "Qwerty Rd", "below threshold"},
+	} {
+		for _, w := range want {
+			if !strings.Contains(lines[i+1], w) {
+				t.Errorf("line %q missing %q", lines[i+1], w)
+			}
+		}
+	}
+
+	if err := printFuzzyMatches(context.Background(), st, io.Discard, handlerOptions{fuzzy: true, fuzzyThreshold: 1.5}); err == nil {
+		t.Error("threshold above 1 succeeded, want error")
+	}
+}
+
+func TestExportHeatmap(t *testing.T) {
+	st := loadFixture(t)
+
+	var buf bytes.Buffer
+	opts := exportOptions{gradientSteps: 3}
+	if err := exportHeatmap(context.Background(), st, &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ranks 1 and 3 both pass through 101 and 102, and only rank 3
+	// continues on through 103.
+	out := buf.String()
+	for _, want := range []string{
+		`<Placemark><name>101 TEST ST from A AVE to B AVE</name><description>Ranks 1, 3</description><styleUrl>#heat-group-0</styleUrl><ExtendedData><Data name="request_count"><value>2</value></Data></ExtendedData>`,
+		`<Placemark><name>102 TEST ST from B AVE to C AVE</name><description>Ranks 1, 3</description><styleUrl>#heat-group-0</styleUrl><ExtendedData><Data name="request_count"><value>2</value></Data></ExtendedData>`,
+		`<Placemark><name>103 TEST ST from C AVE to D AVE</name><description>Ranks 3</description><styleUrl>#heat-group-1</styleUrl><ExtendedData><Data name="request_count"><value>1</value></Data></ExtendedData>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %s:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "<Placemark>"); n != 3 {
+		t.Errorf("got %d placemarks, want 3", n)
+	}
+}
+
+func TestExportRequireRank(t *testing.T) {
+	st := loadFixture(t)
+
+	tsv := "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\n" +
+		"5\tTest St\tNowhere Rd\tC Ave\t7\n"
+	if _, err := loadTSVRequests(st, strings.NewReader(tsv), tsvOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		ranks   []int
+		rankMax int
+		wantErr string
+	}{
+		{ranks: nil},
+		{ranks: []int{1, 3}},
+		{ranks: []int{1, 5}, wantErr: "failed to resolve: ranks 5"},
+		{ranks: []int{9, 5}, wantErr: "failed to resolve: ranks 5; not selected: ranks 9"},
+		{ranks: []int{1, 3}, rankMax: 1, wantErr: "not selected: ranks 3"},
+	} {
+		opts := exportOptions{gradientSteps: 20, orderBy: "rank", maxFailures: 1, requireRanks: tc.ranks}
+		opts.requestFilter.rankMax = tc.rankMax
+		err := export(context.Background(), st, io.Discard, opts, nil)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("requiring %v: %v", tc.ranks, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("requiring %v: got error %v, want one mentioning %q", tc.ranks, err, tc.wantErr)
+		}
+
+		err = exportSplitFiles(context.Background(), st, t.TempDir(), opts, false)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("split requiring %v: %v", tc.ranks, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("split requiring %v: got error %v, want one mentioning %q", tc.ranks, err, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateRequireRank(t *testing.T) {
+	st := loadFixture(t)
+
+	tsv := "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\n" +
+		"5\tTest St\tNowhere Rd\tC Ave\t7\n"
+	if _, err := loadTSVRequests(st, strings.NewReader(tsv), tsvOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		ranks   []int
+		rankMax int
+		wantErr string
+	}{
+		{ranks: nil},
+		{ranks: []int{1, 3}},
+		{ranks: []int{1, 5}, wantErr: "failed to resolve: ranks 5"},
+		{ranks: []int{1, 3}, rankMax: 1, wantErr: "not selected: ranks 3"},
+	} {
+		opts := validateOptions{requireRanks: tc.ranks}
+		opts.requestFilter.rankMax = tc.rankMax
+
+		var buf bytes.Buffer
+		err := printValidate(context.Background(), st, &buf, opts)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("requiring %v: %v", tc.ranks, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("requiring %v: got error %v, want one mentioning %q", tc.ranks, err, tc.wantErr)
+		case tc.wantErr != "" && !errors.As(err, new(outputWrittenError)):
+			t.Errorf("requiring %v: error %v doesn't keep the report", tc.ranks, err)
+		}
+		if !strings.Contains(buf.String(), "backtracking routes:") {
+			t.Errorf("requiring %v: report incomplete:\n%s", tc.ranks, buf.String())
+		}
+	}
+}
+
+func TestIntList(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	l := intListFlag(fs, "n", "")
+	if err := fs.Parse([]string{"-n", "3", "-n", "1, 2"}); err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(intList{3, 1, 2}, *l); d != "" {
+		t.Errorf("list mismatch (-want +got):\n%s", d)
+	}
+	if got := l.String(); got != "3,1,2" {
+		t.Errorf("got String %q, want 3,1,2", got)
+	}
+
+	if err := fs.Parse([]string{"-n", "x"}); err == nil {
+		t.Error("parsing a non-int succeeded, want error")
+	}
+}
+
+func TestLoadKMLSegmentsDegenerateGeometry(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "centrelines.kml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const seg101 = "<coordinates>-63.580,44.640 -63.580,44.641</coordinates>"
+
+	load := func(t *testing.T, coords string, opts kmlOptions) (*sqliteStore, []recordError, error) {
+		t.Helper()
+		db, err := sql.Open("sqlite", "file::memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		st := &sqliteStore{db: db}
+		if err := st.init(); err != nil {
+			t.Fatal(err)
+		}
+		kml := strings.Replace(string(b), seg101, "<coordinates>"+coords+"</coordinates>", 1)
+		skipped, err := loadKMLSegments(st, strings.NewReader(kml), opts)
+		return st, skipped, err
+	}
+
+	t.Run("RepeatedPoints", func(t *testing.T) {
+		st, _, err := load(t, "-63.580,44.640 -63.580,44.640 -63.580,44.641 -63.580,44.641", kmlOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		segs, err := st.filterSegments(context.Background(), segmentFilter{ids: []int{101}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := orb.LineString{{-63.580, 44.640}, {-63.580, 44.641}}
+		if len(segs) != 1 {
+			t.Fatalf("got %d segments, want 1", len(segs))
+		}
+		if d := cmp.Diff(want, segs[0].lineString); d != "" {
+			t.Errorf("line string mismatch (-want +got):\n%s", d)
+		}
+	})
+
+	t.Run("SinglePoint", func(t *testing.T) {
+		if _, _, err := load(t, "-63.580,44.640 -63.580,44.640", kmlOptions{}); err == nil || !strings.Contains(err.Error(), "fewer than two distinct points") {
+			t.Errorf("got error %v, want one about distinct points", err)
+		}
+
+		st, skipped, err := load(t, "-63.580,44.640 -63.580,44.640", kmlOptions{skipErrors: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(skipped) != 1 {
+			t.Errorf("got %d skipped, want 1", len(skipped))
+		}
+		segs, err := st.filterSegments(context.Background(), segmentFilter{ids: []int{101}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segs) != 0 {
+			t.Errorf("got segment 101 loaded, want it skipped")
+		}
+	})
+}
+
+func TestRequestsTouchingSegment(t *testing.T) {
+	st := loadFixture(t)
+
+	for _, tc := range []struct {
+		id    int
+		ranks []int
+	}{
+		{id: 102, ranks: []int{1, 3}},
+		{id: 103, ranks: []int{3}},
+		{id: 201},
+	} {
+		reqs, err := requestsTouchingSegment(context.Background(), st, tc.id, handlerOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ranks []int
+		for _, req := range reqs {
+			ranks = append(ranks, req.rank)
+		}
+		if d := cmp.Diff(tc.ranks, ranks); d != "" {
+			t.Errorf("segment %d ranks mismatch (-want +got):\n%s", tc.id, d)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := printTouching(context.Background(), st, &buf, []string{"999"}, handlerOptions{}); err == nil {
+		t.Error("printing a missing segment succeeded, want error")
+	}
+	if err := printTouching(context.Background(), st, &buf, []string{"103"}, handlerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "requests: 1") || !strings.Contains(buf.String(), "Test St") {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestExportYearTimeSpan(t *testing.T) {
+	st := loadFixture(t)
+
+	tsv := "Rank\tStreet Name\tLimit From\tLimit To\tDistrict\tYear\n" +
+		"5\tTest St\tB Ave\tD Ave\t7\t2025\n" +
+		"6\tTest St\tA Ave\tB Ave\t7\tsoon\n"
+	if _, err := loadTSVRequests(st, strings.NewReader(tsv), tsvOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	const span = "<TimeSpan><begin>2025-01-01T00:00:00Z</begin></TimeSpan>"
+	for _, tc := range []struct {
+		field  string
+		extras bool
+		spans  int
+	}{
+		{field: "year", spans: 1},
+		// Rank 5's route has two segments, each with an arrow and label,
+		// and two endpoints.
+		{field: "year", extras: true, spans: 7},
+		{field: "", spans: 0},
+		{field: "Planned", spans: 0},
+	} {
+		var buf bytes.Buffer
+		opts := exportOptions{gradientSteps: 20, orderBy: "rank", maxFailures: 1, yearField: tc.field, arrows: tc.extras, endpoints: tc.extras, segmentLabels: tc.extras}
+		if err := export(context.Background(), st, &buf, opts, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		out := buf.String()
+		if n := strings.Count(out, "<TimeSpan>"); n != tc.spans {
+			t.Errorf("with year field %q, got %d time spans, want %d", tc.field, n, tc.spans)
+		}
+		if tc.spans > 0 && !strings.Contains(out, "<name>5 Test St from B Ave to D Ave</name>"+span) {
+			t.Errorf("with year field %q, rank 5 has no time span from 2025:\n%s", tc.field, out)
+		}
+	}
+}
+
+func TestKMZRoundTrip(t *testing.T) {
+	st := loadFixture(t)
+	ctx := context.Background()
+
+	opts := exportOptions{gradientSteps: 20, orderBy: "rank", maxFailures: 1}
+	var plain, zipped bytes.Buffer
+	if err := export(ctx, st, &plain, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	opts.kmz = true
+	if err := export(ctx, st, &zipped, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(zipped.Bytes(), kmzMagic) {
+		t.Fatal("KMZ export doesn't start with a zip header")
+	}
+
+	kr, err := openKMZ(&zipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kr.Close()
+	got, err := io.ReadAll(kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(plain.String(), string(got)); d != "" {
+		t.Errorf("KMZ document mismatch with KML export (-want +got):\n%s", d)
+	}
+
+	// Load the fixture's centrelines from a KMZ whose document isn't
+	// doc.kml and isn't its first file.
+	b, err := os.ReadFile(filepath.Join("testdata", "centrelines.kml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kmz bytes.Buffer
+	zw := zip.NewWriter(&kmz)
+	for _, f := range []struct{ name, body string }{
+		{"files/readme.txt", "not KML"},
+		{"centrelines.kml", string(b)},
+	} {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(fw, f.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	kst := &sqliteStore{db: db}
+	if err := kst.init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKMLSegments(kst, &kmz, kmlOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := st.filterSegments(ctx, segmentFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := kst.filterSegments(ctx, segmentFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(want, loaded, cmp.AllowUnexported(segment{})); d != "" {
+		t.Errorf("segments loaded from KMZ mismatch (-want +got):\n%s", d)
+	}
+}
@@ -2,44 +2,82 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 )
 
-func fixup(_ context.Context, st store, _ []string) error {
-	reqs, err := st.requests()
+type fixupOptions struct {
+	requestFilter  requestFilter
+	handlerOptions handlerOptions
+
+	// noColor draws without color, marking request status with symbols.
+	noColor bool
+
+	// watch refreshes requests when their override files change outside
+	// of fixup, checking every watchInterval.
+	watch         bool
+	watchInterval time.Duration
+}
+
+// fixupKeyHelp describes the keys fixup's request list takes.
+const fixupKeyHelp = `In the request list, n and N jump to the next and previous failing
+requests, p pins the selected request's route as an override, x removes
+its overrides, and u undoes the last pin or removal for it.`
+
+func fixup(ctx context.Context, st store, opts fixupOptions, _ []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	reqs, err := st.requests(ctx, opts.requestFilter)
 	if err != nil {
 		return err
 	}
+	if len(reqs) == 0 {
+		return fmt.Errorf("no requests found")
+	}
 
 	app := tview.NewApplication()
 
 	list := tview.NewList().ShowSecondaryText(false)
-	list.SetBorder(true).SetTitle("requests")
+	list.SetBorder(true).SetTitle("requests (n/N: failing, p: pin, x: remove, u: undo)")
 
 	startText := tview.NewTextView()
-	startText.SetDynamicColors(true)
+	startText.SetDynamicColors(!opts.noColor)
 
 	start := tview.NewFlex()
 	start.AddItem(startText, 0, 1, false)
 
 	endText := tview.NewTextView()
-	endText.SetDynamicColors(true)
+	endText.SetDynamicColors(!opts.noColor)
 
 	end := tview.NewFlex()
 	end.AddItem(endText, 0, 1, false)
 
 	infoText := tview.NewTextView()
-	infoText.SetDynamicColors(true)
+	infoText.SetDynamicColors(!opts.noColor)
 
 	info := tview.NewFlex()
 	info.AddItem(infoText, 0, 1, false)
 
+	mapText := tview.NewTextView()
+	mapText.SetDynamicColors(!opts.noColor)
+	mapText.SetBorder(true).SetTitle("map")
+
 	bottom := tview.NewFlex()
 	bottom.AddItem(start, 0, 1, false)
 	bottom.AddItem(end, 0, 1, false)
 	bottom.AddItem(info, 0, 1, false)
+	bottom.AddItem(mapText, 0, 1, false)
 
 	flex := tview.NewFlex().
 		AddItem(list, 0, 1, true).
@@ -47,38 +85,254 @@ func fixup(_ context.Context, st store, _ []string) error {
 	flex.SetDirection(tview.FlexRow)
 
 	rrs := make([]requestRenderer, 0, len(reqs))
+	statuses := make([]requestStatus, 0, len(reqs))
 	for _, req := range reqs {
 		rr := requestRenderer{
+			ctx:       ctx,
 			req:       req,
-			handler:   newDefaultRequestHandler(st, req),
+			handler:   newDefaultRequestHandler(st, req, opts.handlerOptions),
 			startText: startText,
 			endText:   endText,
 			infoText:  infoText,
+			mapText:   mapText,
+			noColor:   opts.noColor,
 		}
 
-		list.AddItem(rr.req.String(), "", 0, rr.selected)
+		status := rr.status()
+		list.AddItem(rr.listText(status), "", 0, rr.selected)
 
 		rrs = append(rrs, rr)
+		statuses = append(statuses, status)
 	}
 
 	list.SetChangedFunc(func(index int, mainText string, secondaryText string, shortcut rune) {
 		rrs[index].changed()
 	})
 
+	// jump selects the next failing request in the direction of step,
+	// wrapping around.
+	jump := func(step int) {
+		n, cur := len(rrs), list.GetCurrentItem()
+		for i := 1; i < n; i++ {
+			j := ((cur+step*i)%n + n) % n
+			if statuses[j] == statusFailing {
+				list.SetCurrentItem(j)
+				return
+			}
+		}
+	}
+
+	// Keys are as fixupKeyHelp describes.
+	history := newOverrideHistory()
+	list.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		if ev.Key() != tcell.KeyRune {
+			return ev
+		}
+
+		idx := list.GetCurrentItem()
+		rr := rrs[idx]
+		var err error
+		switch ev.Rune() {
+		case 'n':
+			jump(1)
+			return nil
+		case 'N':
+			jump(-1)
+			return nil
+		case 'p':
+			err = pinRoute(rr, history)
+		case 'x':
+			err = history.change(rr.req.stableID(), overrideWhens, func() error {
+				return removeOverrides(rr.req.stableID())
+			})
+		case 'u':
+			err = history.undo(rr.req.stableID())
+		default:
+			return ev
+		}
+
+		statuses[idx] = rr.status()
+		list.SetItemText(idx, rr.listText(statuses[idx]), "")
+		rr.changed()
+		if err != nil {
+			fmt.Fprintln(rr.infoText, rr.tag("red")+"Error:", err)
+		}
+		return nil
+	})
+
+	if opts.watch {
+		byID := make(map[string][]int)
+		for i, rr := range rrs {
+			byID[rr.req.stableID()] = append(byID[rr.req.stableID()], i)
+		}
+
+		go watchOverrides(ctx, opts.watchInterval, func(ids []string) {
+			app.QueueUpdateDraw(func() {
+				cur := list.GetCurrentItem()
+				for _, id := range ids {
+					for _, idx := range byID[id] {
+						statuses[idx] = rrs[idx].status()
+						list.SetItemText(idx, rrs[idx].listText(statuses[idx]), "")
+						if idx == cur {
+							rrs[idx].changed()
+						}
+					}
+				}
+			})
+		})
+	}
+
 	rrs[0].changed()
 
 	return app.SetRoot(flex, true).Run()
 }
 
+// watchOverrides checks overrideDir every interval until ctx is done,
+// calling changed with the stable IDs of the requests whose override files
+// were added, changed or removed since the last check.
+//
+// It polls, listing overrideDir and comparing each file's modification
+// time, rather than using a filesystem watcher: the directory holds a few
+// small files per request, so listing it is cheap, and polling behaves the
+// same on every platform and with editors that replace files on save.
+func watchOverrides(ctx context.Context, interval time.Duration, changed func(ids []string)) {
+	prev, _ := overrideModTimes()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		cur, err := overrideModTimes()
+		if err != nil {
+			continue
+		}
+		if ids := changedOverrideIDs(prev, cur); len(ids) > 0 {
+			changed(ids)
+		}
+		prev = cur
+	}
+}
+
+// overrideModTimes returns the modification time of each file in
+// overrideDir, by name.
+func overrideModTimes() (map[string]time.Time, error) {
+	entries, err := os.ReadDir(overrideDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	times := make(map[string]time.Time, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			// Removed since it was listed.
+			continue
+		}
+		times[e.Name()] = info.ModTime()
+	}
+	return times, nil
+}
+
+// changedOverrideIDs returns the sorted stable IDs of the requests whose
+// override files differ between prev and cur.
+func changedOverrideIDs(prev, cur map[string]time.Time) []string {
+	var ids []string
+	add := func(name string) {
+		id, _, _ := strings.Cut(name, ".")
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	for name, t := range cur {
+		if p, ok := prev[name]; !ok || !p.Equal(t) {
+			add(name)
+		}
+	}
+	for name := range prev {
+		if _, ok := cur[name]; !ok {
+			add(name)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
 type requestRenderer struct {
+	ctx     context.Context
 	req     request
 	handler requestHandler
 
 	startText *tview.TextView
 	endText   *tview.TextView
 	infoText  *tview.TextView
+	mapText   *tview.TextView
+
+	noColor bool
+}
+
+// requestStatus is how a request resolves, for coloring the list.
+type requestStatus int
+
+const (
+	statusClean requestStatus = iota
+	statusOverridden
+	statusFailing
+)
+
+var statusColors = map[requestStatus]string{
+	statusClean:      "green",
+	statusOverridden: "yellow",
+	statusFailing:    "red",
+}
+
+// statusSymbols mark each status in the list when drawing without color.
+var statusSymbols = map[requestStatus]string{
+	statusClean:      " ",
+	statusOverridden: "*",
+	statusFailing:    "!",
+}
+
+// status resolves the request to find its status. Failing takes
+// precedence over having overrides.
+func (r requestRenderer) status() requestStatus {
+	if _, err := r.handler.handle(r.ctx); err != nil {
+		return statusFailing
+	}
+	if hasOverrides(r.req) {
+		return statusOverridden
+	}
+	return statusClean
+}
+
+// listText is the request's list item text, colored or marked by status.
+func (r requestRenderer) listText(status requestStatus) string {
+	if r.noColor {
+		return statusSymbols[status] + " " + tview.Escape(r.req.String())
+	}
+	return "[" + statusColors[status] + "]" + tview.Escape(r.req.String())
+}
+
+// tag returns the tview tag switching text to color, or nothing when
+// drawing without color.
+func (r requestRenderer) tag(color string) string {
+	if r.noColor {
+		return ""
+	}
+	return "[" + color + "]"
 }
 
+// Minimap size used before the map pane has been drawn and has a size.
+const (
+	defaultMapWidth  = 40
+	defaultMapHeight = 15
+)
+
 func (r requestRenderer) selected() {
 	r.changed()
 }
@@ -87,33 +341,163 @@ func (r requestRenderer) changed() {
 	r.startText.Clear()
 	r.endText.Clear()
 	r.infoText.Clear()
+	r.mapText.Clear()
 
-	attempt := r.handler.handleAttempt()
+	attempt := r.handler.handleAttempt(r.ctx)
+
+	_, _, w, h := r.mapText.GetInnerRect()
+	if w <= 0 || h <= 0 {
+		w, h = defaultMapWidth, defaultMapHeight
+	}
+	cells := mapCells
+	if r.noColor {
+		cells = plainMapCells
+	}
+	fmt.Fprint(r.mapText, minimap(cells, w, h, attempt.routeSegments, attempt.startSegments, attempt.endSegments))
 
 	if attempt.startErr != nil {
-		fmt.Fprintln(r.startText, "[red]Error:", attempt.startErr)
+		fmt.Fprintln(r.startText, r.tag("red")+"Error:", attempt.startErr)
 		return
 	}
 
+	if ids := offStreet(r.req.streetName, attempt.startSegments); len(ids) > 0 {
+		fmt.Fprintln(r.startText, r.tag("yellow")+"Warning:"+r.tag("-"), "segments not on", r.req.streetName, ids)
+	}
 	for _, seg := range attempt.startSegments {
 		fmt.Fprintln(r.startText, seg)
 	}
 
 	if attempt.endErr != nil {
-		fmt.Fprintln(r.endText, "[red]Error:", attempt.endErr, "[white]")
+		fmt.Fprintln(r.endText, r.tag("red")+"Error:", attempt.endErr, r.tag("white"))
 		return
 	}
 
+	if ids := offStreet(r.req.streetName, attempt.endSegments); len(ids) > 0 {
+		fmt.Fprintln(r.endText, r.tag("yellow")+"Warning:"+r.tag("-"), "segments not on", r.req.streetName, ids)
+	}
 	for _, seg := range attempt.endSegments {
 		fmt.Fprintln(r.endText, seg)
 	}
 
 	if attempt.routeErr != nil {
-		fmt.Fprintln(r.infoText, "[red]Error:", attempt.routeErr)
+		fmt.Fprintln(r.infoText, r.tag("red")+"Error:", attempt.routeErr)
 		return
 	}
 
+	if ratio, ok := detourRatio(attempt.routeSegments); ok {
+		fmt.Fprintf(r.infoText, "Detour ratio: %.1f\n", ratio)
+	}
+
+	if ids := backtracks(attempt.routeSegments); len(ids) > 0 {
+		fmt.Fprintln(r.infoText, r.tag("yellow")+"Warning:"+r.tag("-"), "route backtracks over segments", ids)
+	}
+
 	for _, seg := range attempt.routeSegments {
 		fmt.Fprintln(r.infoText, seg)
 	}
 }
+
+// overrideWhens are the kinds of override file a request may have.
+var overrideWhens = []string{"start", "end", "route", "loopstart"}
+
+// pinRoute writes the currently resolved route of rr as its route
+// override.
+func pinRoute(rr requestRenderer, history *overrideHistory) error {
+	res, err := rr.handler.handle(rr.ctx)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for _, seg := range res.routeSegments {
+		b.WriteString(strconv.Itoa(seg.id) + "\n")
+	}
+
+	return history.change(rr.req.stableID(), []string{"route"}, func() error {
+		if err := os.MkdirAll(overrideDir, 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(overridePath(rr.req.stableID(), "route"), []byte(b.String()), 0o644)
+	})
+}
+
+func removeOverrides(id string) error {
+	for _, when := range overrideWhens {
+		if err := os.Remove(overridePath(id, when)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxOverrideUndo is how many changes to each request's overrides are kept
+// for undo.
+const maxOverrideUndo = 10
+
+// overrideFile is the contents of an override file before a change, or
+// that it didn't exist.
+type overrideFile struct {
+	path    string
+	exists  bool
+	content []byte
+}
+
+// overrideHistory records the override files of requests, by stable ID, as
+// they were before each change so the changes can be undone.
+type overrideHistory struct {
+	changes map[string][][]overrideFile
+}
+
+func newOverrideHistory() *overrideHistory {
+	return &overrideHistory{changes: make(map[string][][]overrideFile)}
+}
+
+// change records the request's override files for whens, then runs fn to
+// change them.
+func (h *overrideHistory) change(id string, whens []string, fn func() error) error {
+	var files []overrideFile
+	for _, when := range whens {
+		path := overridePath(id, when)
+		content, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			files = append(files, overrideFile{path: path})
+		case err != nil:
+			return err
+		default:
+			files = append(files, overrideFile{path: path, exists: true, content: content})
+		}
+	}
+
+	changes := append(h.changes[id], files)
+	if len(changes) > maxOverrideUndo {
+		changes = changes[1:]
+	}
+	h.changes[id] = changes
+
+	return fn()
+}
+
+// undo restores the request's override files as they were before its
+// last change.
+func (h *overrideHistory) undo(id string) error {
+	changes := h.changes[id]
+	if len(changes) == 0 {
+		return fmt.Errorf("nothing to undo")
+	}
+	files := changes[len(changes)-1]
+	h.changes[id] = changes[:len(changes)-1]
+
+	for _, f := range files {
+		if !f.exists {
+			if err := os.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if err := os.WriteFile(f.path, f.content, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
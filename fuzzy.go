@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// printFuzzyMatches prints each request whose street name matches no
+// segments with the most similar street name, their similarity, and
+// whether resolving it with opts, which should have fuzzy set, uses that
+// name and succeeds. It's for auditing fuzzy matches, which may be wrong.
+func printFuzzyMatches(ctx context.Context, st store, w io.Writer, opts handlerOptions) error {
+	threshold := opts.fuzzyThreshold
+	if threshold == 0 {
+		threshold = defaultFuzzyThreshold
+	}
+	if threshold < 0 || threshold > 1 {
+		return fmt.Errorf("fuzzy threshold must be from 0 to 1, got %v", threshold)
+	}
+
+	unknown, err := unknownStreetRequests(ctx, st)
+	if err != nil {
+		return err
+	}
+	names, err := st.streetNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tSTREET\tMATCH\tSIMILARITY\tSTATUS")
+	for _, req := range unknown {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		match, sim := closestStreetName(normalizeStreetName(req.streetName), names)
+		status := "below threshold"
+		if sim >= threshold {
+			status = "resolved"
+			if _, err := newDefaultRequestHandler(st, req, opts).handle(ctx); err != nil {
+				status = "unresolved: " + err.Error()
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%.2f\t%s\n", req.rank, req.streetName, match, sim, status)
+	}
+	return tw.Flush()
+}
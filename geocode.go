@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+)
+
+// geocoder finds the location of a place described by query, such as an
+// intersection. ok is false if nothing was found.
+type geocoder interface {
+	geocode(ctx context.Context, query string) (p orb.Point, ok bool, err error)
+}
+
+// nominatimGeocoder geocodes using a Nominatim search API.
+type nominatimGeocoder struct {
+	client    *http.Client
+	baseURL   string
+	userAgent string
+
+	// interval is the minimum time between requests, as the public
+	// Nominatim usage policy requires a second.
+	interval time.Duration
+	last     time.Time
+}
+
+func (g *nominatimGeocoder) geocode(ctx context.Context, query string) (orb.Point, bool, error) {
+	if wait := g.interval - time.Since(g.last); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return orb.Point{}, false, ctx.Err()
+		}
+	}
+	g.last = time.Now()
+
+	u := g.baseURL + "/search?" + url.Values{"q": {query}, "format": {"jsonv2"}, "limit": {"1"}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return orb.Point{}, false, err
+	}
+	req.Header.Set("User-Agent", g.userAgent)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return orb.Point{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return orb.Point{}, false, fmt.Errorf("geocoding %q: unexpected status %s", query, resp.Status)
+	}
+
+	var places []struct {
+		Lat string `json:"lat"`
+		Lon string `json:"lon"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&places); err != nil {
+		return orb.Point{}, false, fmt.Errorf("geocoding %q: %w", query, err)
+	}
+	if len(places) == 0 {
+		return orb.Point{}, false, nil
+	}
+
+	lat, err := strconv.ParseFloat(places[0].Lat, 64)
+	if err != nil {
+		return orb.Point{}, false, err
+	}
+	lon, err := strconv.ParseFloat(places[0].Lon, 64)
+	if err != nil {
+		return orb.Point{}, false, err
+	}
+	return orb.Point{lon, lat}, true, nil
+}
+
+type geocheckOptions struct {
+	requestFilter  requestFilter
+	handlerOptions handlerOptions
+
+	// area is appended to each query to narrow it, such as a city.
+	area string
+	// maxDistance is how far, in metres, a geocoded cross street may be
+	// from the resolved route's end before it's flagged.
+	maxDistance float64
+}
+
+// geocheck geocodes the intersection of each request's street with its
+// from and to cross streets and prints how far each is from the
+// corresponding end of the resolved route, flagging those farther than
+// opts.maxDistance, which may have resolved to the wrong place.
+func geocheck(ctx context.Context, st store, gc geocoder, w io.Writer, opts geocheckOptions) error {
+	reqs, err := st.requests(ctx, opts.requestFilter)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tSTREET\tEND\tCROSS STREET\tDISTANCE M\tSTATUS")
+
+	var flagged int
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		res, err := newDefaultRequestHandler(st, req, opts.handlerOptions).handle(ctx)
+		if err != nil {
+			logRequestError(req, err)
+			continue
+		}
+		lines := mergeLineStrings(res.routeSegments)
+		if len(lines) == 0 {
+			continue
+		}
+		last := lines[len(lines)-1]
+
+		for _, end := range []struct {
+			name, cross string
+			p           orb.Point
+		}{
+			{"from", req.from, lines[0][0]},
+			{"to", req.to, last[len(last)-1]},
+		} {
+			if end.cross == "" {
+				continue
+			}
+
+			query := req.streetName + " and " + end.cross
+			if opts.area != "" {
+				query += ", " + opts.area
+			}
+			p, ok, err := gc.geocode(ctx, query)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				slog.Warn("cross street not found by geocoder", "rank", req.rank, "query", query)
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t\tnot found\n", req.rank, req.streetName, end.name, end.cross)
+				continue
+			}
+
+			status := "ok"
+			d := geo.Distance(p, end.p)
+			if d > opts.maxDistance {
+				status = "far"
+				flagged++
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%.0f\t%s\n", req.rank, req.streetName, end.name, end.cross, d, status)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if flagged > 0 {
+		slog.Warn("route ends far from geocoded cross streets", "count", flagged, "max_distance_m", opts.maxDistance)
+	}
+	return nil
+}
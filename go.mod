@@ -1,13 +1,29 @@
 module github.com/danp/calmmap
 
-go 1.16
+go 1.21
 
 require (
+	github.com/gdamore/tcell/v2 v2.0.1-0.20201017141208-acf90d56d591
 	github.com/google/go-cmp v0.5.4
-	github.com/mazznoer/colorgrad v0.8.1 // indirect
-	github.com/paulmach/orb v0.2.1 // indirect
-	github.com/peterbourgon/ff/v3 v3.0.0 // indirect
+	github.com/mazznoer/colorgrad v0.8.1
+	github.com/paulmach/orb v0.2.1
+	github.com/peterbourgon/ff/v3 v3.0.0
 	github.com/rivo/tview v0.0.0-20210217110421-8a8f78a6dd01
-	github.com/twpayne/go-kml v1.5.2 // indirect
+	github.com/twpayne/go-kml v1.5.2
 	modernc.org/sqlite v1.8.7
 )
+
+require (
+	github.com/gdamore/encoding v1.0.0 // indirect
+	github.com/lucasb-eyer/go-colorful v1.0.3 // indirect
+	github.com/mattn/go-isatty v0.0.12 // indirect
+	github.com/mattn/go-runewidth v0.0.10 // indirect
+	github.com/mazznoer/csscolorparser v0.1.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20200410134404-eec4a21b6bb0 // indirect
+	github.com/rivo/uniseg v0.2.0 // indirect
+	golang.org/x/sys v0.0.0-20210113181707-4bcb84eeeb78 // indirect
+	golang.org/x/text v0.3.5 // indirect
+	modernc.org/libc v0.0.0-20210126194511-2b2d365b45c2 // indirect
+	modernc.org/mathutil v1.2.2 // indirect
+	modernc.org/memory v1.0.4 // indirect
+)
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+)
+
+type exportGPKGOptions struct {
+	requestFilter  requestFilter
+	handlerOptions handlerOptions
+
+	// network adds a layer with every segment.
+	network bool
+	// crs is the coordinate system to write geometry in, WGS 84 if unset.
+	crs crs
+}
+
+// exportGPKG writes resolved request routes, and optionally the full
+// street network, to a GeoPackage at path, replacing any existing file.
+func exportGPKG(ctx context.Context, st store, path string, opts exportGPKGOptions, _ []string) error {
+	reqs, err := st.requests(ctx, opts.requestFilter)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	gp := geoPackage{tx: tx, crs: opts.crs}
+	if gp.crs.epsg == 0 {
+		gp.crs = wgs84
+	}
+	if err := gp.init(); err != nil {
+		return err
+	}
+
+	routes, err := gp.createLayer("requests", "MULTILINESTRING", "rank integer", "street text", "from_street text", "to_street text", "district text", "raw_from text", "raw_to text", "resolved_from text", "resolved_to text")
+	if err != nil {
+		return err
+	}
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		res, err := newDefaultRequestHandler(st, req, opts.handlerOptions).handle(ctx)
+		if err != nil {
+			logRequestError(req, err)
+			continue
+		}
+
+		resolvedFrom, resolvedTo := resolvedCrossStreets(req, res)
+		if err := routes.insert(orb.MultiLineString(mergeLineStrings(res.routeSegments)), req.rank, req.streetName, req.from, req.to, req.district, req.rawFrom, req.rawTo, resolvedFrom, resolvedTo); err != nil {
+			return err
+		}
+	}
+	if err := routes.finish(); err != nil {
+		return err
+	}
+
+	if opts.network {
+		segs, err := st.filterSegments(ctx, segmentFilter{})
+		if err != nil {
+			return err
+		}
+
+		network, err := gp.createLayer("network", "LINESTRING", "segment_id integer", "name text", "direction text", "route_id integer", "street_class text")
+		if err != nil {
+			return err
+		}
+		for _, seg := range segs {
+			if err := network.insert(seg.lineString, seg.id, seg.name, seg.direction, seg.routeID, seg.streetClass); err != nil {
+				return err
+			}
+		}
+		if err := network.finish(); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// geoPackage writes an OGC GeoPackage, which is itself a SQLite database.
+// All geometries are in crs.
+type geoPackage struct {
+	tx  *sql.Tx
+	crs crs
+}
+
+// init creates the GeoPackage metadata tables.
+func (g geoPackage) init() error {
+	for _, q := range []string{
+		"pragma application_id = 1196444487", // "GPKG"
+		"pragma user_version = 10300",        // version 1.3.0
+		"create table gpkg_spatial_ref_sys (srs_name text not null, srs_id integer primary key, organization text not null, organization_coordsys_id integer not null, definition text not null, description text)",
+		"create table gpkg_contents (table_name text not null primary key, data_type text not null, identifier text unique, description text default '', last_change datetime not null default (strftime('%Y-%m-%dT%H:%M:%fZ','now')), min_x double, min_y double, max_x double, max_y double, srs_id integer, constraint fk_gc_r_srs_id foreign key (srs_id) references gpkg_spatial_ref_sys(srs_id))",
+		"create table gpkg_geometry_columns (table_name text not null, column_name text not null, geometry_type_name text not null, srs_id integer not null, z tinyint not null, m tinyint not null, constraint pk_geom_cols primary key (table_name, column_name), constraint fk_gc_tn foreign key (table_name) references gpkg_contents(table_name), constraint fk_gc_srs foreign key (srs_id) references gpkg_spatial_ref_sys (srs_id))",
+		"create table gpkg_extensions (table_name text, column_name text, extension_name text not null, definition text not null, scope text not null, constraint ge_tce unique (table_name, column_name, extension_name))",
+	} {
+		if _, err := g.tx.Exec(q); err != nil {
+			return err
+		}
+	}
+
+	// The spec requires WGS 84 and the two undefined systems whatever
+	// the layers use.
+	type srs struct {
+		name, org  string
+		id, orgID  int
+		definition string
+	}
+	systems := []srs{
+		{wgs84.name, "EPSG", wgs84.epsg, wgs84.epsg, wgs84.definition},
+		{"Undefined cartesian SRS", "NONE", -1, -1, "undefined"},
+		{"Undefined geographic SRS", "NONE", 0, 0, "undefined"},
+	}
+	if g.crs.epsg != wgs84.epsg {
+		systems = append(systems, srs{g.crs.name, "EPSG", g.crs.epsg, g.crs.epsg, g.crs.definition})
+	}
+	for _, sys := range systems {
+		if _, err := g.tx.Exec("insert into gpkg_spatial_ref_sys (srs_name, srs_id, organization, organization_coordsys_id, definition) values (?, ?, ?, ?, ?)", sys.name, sys.id, sys.org, sys.orgID, sys.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gpkgLayer is a features table with a geom column and a spatial index.
+type gpkgLayer struct {
+	tx      *sql.Tx
+	crs     crs
+	table   string
+	columns []string
+
+	bound orb.Bound
+	empty bool
+}
+
+// createLayer creates a features table with geometries of geomType and
+// the other columns, each a name and type.
+func (g geoPackage) createLayer(table, geomType string, columns ...string) (*gpkgLayer, error) {
+	for _, q := range []string{
+		"create table " + table + " (fid integer primary key autoincrement, geom " + geomType + ", " + strings.Join(columns, ", ") + ")",
+		"create virtual table rtree_" + table + "_geom using rtree(id, minx, maxx, miny, maxy)",
+	} {
+		if _, err := g.tx.Exec(q); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := g.tx.Exec("insert into gpkg_contents (table_name, data_type, identifier, srs_id) values (?, 'features', ?, ?)", table, table, g.crs.epsg); err != nil {
+		return nil, err
+	}
+	if _, err := g.tx.Exec("insert into gpkg_geometry_columns (table_name, column_name, geometry_type_name, srs_id, z, m) values (?, 'geom', ?, ?, 0, 0)", table, geomType, g.crs.epsg); err != nil {
+		return nil, err
+	}
+	if _, err := g.tx.Exec("insert into gpkg_extensions (table_name, column_name, extension_name, definition, scope) values (?, 'geom', 'gpkg_rtree_index', 'http://www.geopackage.org/spec120/#extension_rtree', 'write-only')", table); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, col := range columns {
+		names = append(names, strings.Fields(col)[0])
+	}
+
+	return &gpkgLayer{tx: g.tx, crs: g.crs, table: table, columns: names, empty: true}, nil
+}
+
+// insert adds a feature with lon/lat geometry geom, projected to the
+// layer's crs, and values for the layer's other columns.
+func (l *gpkgLayer) insert(geom orb.Geometry, values ...interface{}) error {
+	geom, err := l.crs.projectGeometry(geom)
+	if err != nil {
+		return err
+	}
+	b, err := gpkgGeometry(geom, l.crs.epsg)
+	if err != nil {
+		return err
+	}
+
+	args := append([]interface{}{b}, values...)
+	res, err := l.tx.Exec("insert into "+l.table+" (geom, "+strings.Join(l.columns, ", ")+") values ("+placeholders(len(args), "?")+")", args...)
+	if err != nil {
+		return err
+	}
+	fid, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	bound := geom.Bound()
+	if _, err := l.tx.Exec("insert into rtree_"+l.table+"_geom (id, minx, maxx, miny, maxy) values (?, ?, ?, ?, ?)", fid, bound.Min.Lon(), bound.Max.Lon(), bound.Min.Lat(), bound.Max.Lat()); err != nil {
+		return err
+	}
+
+	if l.empty {
+		l.bound, l.empty = bound, false
+	} else {
+		l.bound = l.bound.Union(bound)
+	}
+	return nil
+}
+
+// finish records the layer's extent.
+func (l *gpkgLayer) finish() error {
+	if l.empty {
+		return nil
+	}
+	_, err := l.tx.Exec("update gpkg_contents set min_x = ?, min_y = ?, max_x = ?, max_y = ? where table_name = ?", l.bound.Min.Lon(), l.bound.Min.Lat(), l.bound.Max.Lon(), l.bound.Max.Lat(), l.table)
+	return err
+}
+
+// gpkgGeometry encodes geom as GeoPackage binary: a header with the SRS
+// and envelope followed by little-endian WKB.
+func gpkgGeometry(geom orb.Geometry, srsID int) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("GP")
+	b.WriteByte(0) // version 1
+	// Little-endian, with a [minx, maxx, miny, maxy] envelope.
+	b.WriteByte(0x03)
+
+	bound := geom.Bound()
+	for _, v := range []interface{}{int32(srsID), bound.Min.Lon(), bound.Max.Lon(), bound.Min.Lat(), bound.Max.Lat()} {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	w, err := wkb.Marshal(geom, binary.LittleEndian)
+	if err != nil {
+		return nil, err
+	}
+	b.Write(w)
+	return b.Bytes(), nil
+}
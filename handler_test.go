@@ -1,11 +1,26 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"image/color"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/twpayne/go-kml"
 )
 
 func TestStartDiscovery(t *testing.T) {
@@ -14,13 +29,22 @@ func TestStartDiscovery(t *testing.T) {
 		s2  = segment{id: 2, name: "TEST LN", from: "B ST", to: "C ST", routeID: 1, direction: "BOTH"}
 		qs1 = segment{id: 5, name: "TESTN LN", from: "AN ST", to: "B ST", routeID: 1, direction: "BOTH"}
 		irr = segment{id: 10, name: "IRRELEVANT PL", from: "A ST", to: "B ST", routeID: 2, direction: "BOTH"}
+
+		// Two streets sharing the base name MAIN.
+		ms1 = segment{id: 20, name: "MAIN ST", streetName: "MAIN", streetType: "ST", from: "A ST", to: "B ST", routeID: 3, direction: "BOTH"}
+		ma1 = segment{id: 21, name: "MAIN AVE", streetName: "MAIN", streetType: "AVE", from: "A ST", to: "C ST", routeID: 4, direction: "BOTH"}
+
+		// A crescent whose type is abbreviated unusually.
+		sc1 = segment{id: 30, name: "SUMMIT CRS", streetName: "SUMMIT", streetType: "CRS", from: "A ST", to: "B ST", routeID: 5, direction: "BOTH"}
 	)
 
 	cases := []struct {
-		name string
-		in   []segment
-		req  request
-		want []segment
+		name      string
+		in        []segment
+		req       request
+		fuzzy     bool
+		threshold float64
+		want      []segment
 	}{
 		{
 			name: "Easy",
@@ -51,6 +75,63 @@ func TestStartDiscovery(t *testing.T) {
 			in:   []segment{s1},
 			req:  request{streetName: "Test Ln", from: "Nonexistent St", to: "Nowhere Crs"},
 		},
+		{
+			name: "BaseName",
+			in:   []segment{ms1, ma1},
+			req:  request{streetName: "Main", from: "A St", to: "B St"},
+			want: []segment{ms1},
+		},
+		{
+			name: "BaseNameByTo",
+			in:   []segment{ms1, ma1},
+			req:  request{streetName: "Main", from: "A St", to: "C St"},
+			want: []segment{ma1},
+		},
+		{
+			name: "StreetTypeSpelledOut",
+			in:   []segment{ms1, ma1},
+			req:  request{streetName: "Main Street", from: "A St", to: "B St"},
+			want: []segment{ms1},
+		},
+		{
+			name: "StreetTypeOtherAbbreviation",
+			in:   []segment{sc1, irr},
+			req:  request{streetName: "Summit Cres", from: "A St", to: "A St"},
+			want: []segment{sc1},
+		},
+		{
+			name:  "Fuzzy",
+			in:    []segment{s1, irr},
+			req:   request{streetName: "Testt Ln", from: "A St", to: "Nowhere Crs"},
+			fuzzy: true,
+			want:  []segment{s1},
+		},
+		{
+			name: "FuzzyDisabled",
+			in:   []segment{s1, irr},
+			req:  request{streetName: "Testt Ln", from: "A St", to: "Nowhere Crs"},
+		},
+		{
+			name:  "FuzzyTooDifferent",
+			in:    []segment{s1, irr},
+			req:   request{streetName: "Other Rd", from: "A St", to: "Nowhere Crs"},
+			fuzzy: true,
+		},
+		{
+			name:      "FuzzyBelowRaisedThreshold",
+			in:        []segment{s1, irr},
+			req:       request{streetName: "Testt Ln", from: "A St", to: "Nowhere Crs"},
+			fuzzy:     true,
+			threshold: 0.9,
+		},
+		{
+			name:      "FuzzyLoweredThreshold",
+			in:        []segment{s1, irr},
+			req:       request{streetName: "Tastt Ln", from: "A St", to: "Nowhere Crs"},
+			fuzzy:     true,
+			threshold: 0.7,
+			want:      []segment{s1},
+		},
 	}
 
 	for _, tc := range cases {
@@ -70,13 +151,17 @@ func TestStartDiscovery(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			sd := startDiscovery(st)
+			threshold := tc.threshold
+			if threshold == 0 {
+				threshold = defaultFuzzyThreshold
+			}
+			sd := startDiscovery(st, tc.fuzzy, threshold)
 
 			preq := processingRequest{
 				req: tc.req,
 			}
 
-			segs, err := sd(preq)
+			segs, err := sd(context.Background(), preq)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -92,6 +177,9 @@ func TestStartDiscoveryError(t *testing.T) {
 	var (
 		a1 = segment{id: 1, name: "TEST LN", from: "A ST", to: "B ST", routeID: 1, direction: "BOTH"}
 		a2 = segment{id: 2, name: "TEST LN", from: "A ST", to: "B ST", routeID: 2, direction: "BOTH"}
+
+		ms1 = segment{id: 20, name: "MAIN ST", streetName: "MAIN", streetType: "ST", from: "A ST", to: "B ST", routeID: 3, direction: "BOTH"}
+		ma1 = segment{id: 21, name: "MAIN AVE", streetName: "MAIN", streetType: "AVE", from: "A ST", to: "B ST", routeID: 4, direction: "BOTH"}
 	)
 
 	cases := []struct {
@@ -104,6 +192,11 @@ func TestStartDiscoveryError(t *testing.T) {
 			in:   []segment{a1, a2},
 			req:  request{streetName: "Test Ln", from: "A St", to: "Nowhere Crs"},
 		},
+		{
+			name: "AmbiguousBaseName",
+			in:   []segment{ms1, ma1},
+			req:  request{streetName: "Main", from: "A St", to: "B St"},
+		},
 	}
 
 	for _, tc := range cases {
@@ -123,13 +216,13 @@ func TestStartDiscoveryError(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			sd := startDiscovery(st)
+			sd := startDiscovery(st, false, defaultFuzzyThreshold)
 
 			preq := processingRequest{
 				req: tc.req,
 			}
 
-			_, err = sd(preq)
+			_, err = sd(context.Background(), preq)
 			if err == nil {
 				t.Fatal("wanted error")
 			}
@@ -187,6 +280,13 @@ func TestEndDiscovery(t *testing.T) {
 			req:   request{streetName: "Test Ln", from: "A St", to: "B'n St"},
 			want:  []segment{qs1},
 		},
+		{
+			name:  "MultipleTo",
+			in:    []segment{s2, s3, irr},
+			start: []segment{s1},
+			req:   request{streetName: "Test Ln", from: "A St", to: "Nowhere St|D St"},
+			want:  []segment{s3},
+		},
 	}
 
 	for _, tc := range cases {
@@ -211,9 +311,77 @@ func TestEndDiscovery(t *testing.T) {
 				req:           tc.req,
 			}
 
-			ed := endDiscovery(st)
+			ed := endDiscovery(st, false)
+
+			segs, err := ed(context.Background(), preq)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d := cmp.Diff(tc.want, segs, cmp.AllowUnexported(segment{})); d != "" {
+				t.Errorf("discovered segment mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestEndDiscoveryRelaxed(t *testing.T) {
+	var (
+		s1 = segment{id: 1, name: "TEST LN", from: "A ST", to: "B ST", routeID: 1, direction: "BOTH", lastPoint: orb.Point{0, 1}}
+		s2 = segment{id: 2, name: "TEST LN", from: "B ST", to: "C ST", routeID: 1, direction: "BOTH", firstPoint: orb.Point{0, 1}, lastPoint: orb.Point{0, 2}}
+		s3 = segment{id: 3, name: "TEST LN", from: "C ST", to: "D ST", routeID: 1, direction: "BOTH", firstPoint: orb.Point{0, 2}, lastPoint: orb.Point{0, 3}}
+	)
+
+	cases := []struct {
+		name    string
+		relaxed bool
+		req     request
+		want    []segment
+	}{
+		{
+			name:    "Strict",
+			relaxed: false,
+			req:     request{streetName: "Test Ln", from: "A St", to: "Nowhere St"},
+		},
+		{
+			name:    "Relaxed",
+			relaxed: true,
+			req:     request{streetName: "Test Ln", from: "A St", to: "Nowhere St"},
+			want:    []segment{s3},
+		},
+		{
+			name:    "RelaxedMatch",
+			relaxed: true,
+			req:     request{streetName: "Test Ln", from: "A St", to: "C St"},
+			want:    []segment{s2, s3},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite", "file::memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			st := &sqliteStore{db: db}
+			if err := st.init(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := st.loadSegments([]segment{s1, s2, s3}); err != nil {
+				t.Fatal(err)
+			}
+
+			preq := processingRequest{
+				startSegments: []segment{s1},
+				req:           tc.req,
+			}
+
+			ed := endDiscovery(st, tc.relaxed)
 
-			segs, err := ed(preq)
+			segs, err := ed(context.Background(), preq)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -225,6 +393,38 @@ func TestEndDiscovery(t *testing.T) {
 	}
 }
 
+func TestRouteGraphSearchLollipop(t *testing.T) {
+	// Segment 2 leads into a loop, 3 and 4, which comes back into 2 by its
+	// other end, from where 9 is closest. A path may not pass through 2
+	// twice, so it must take the longer way around through 5, 6 and 7.
+	link := func(exitID int, exitEnd string, entryID int, entryEnd string) segmentLink {
+		return segmentLink{exit: segmentEnd{id: exitID, end: exitEnd}, entry: segmentEnd{id: entryID, end: entryEnd}}
+	}
+	from := segment{id: 1, routeID: 1, direction: "FOTD"}
+	g := newRouteGraph(from)
+	for _, l := range []segmentLink{
+		link(1, endLast, 2, endFirst),
+		link(2, endLast, 3, endFirst),
+		link(3, endLast, 4, endFirst),
+		link(4, endLast, 2, endLast),
+		link(2, endFirst, 9, endFirst),
+		link(3, endLast, 5, endFirst),
+		link(5, endLast, 6, endFirst),
+		link(6, endLast, 7, endFirst),
+		link(7, endLast, 9, endFirst),
+	} {
+		g.add(l, false)
+	}
+
+	got, err := g.search(context.Background(), from, []segment{{id: 9}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff([]int{1, 2, 3, 5, 6, 7, 9}, got); d != "" {
+		t.Errorf("path mismatch (-want +got):\n%s", d)
+	}
+}
+
 func TestRouteDiscovery(t *testing.T) {
 	var (
 		s1 = segment{id: 1, name: "TEST LN", from: "A ST", to: "B ST", routeID: 1, direction: "BOTH", lastPoint: orb.Point{0, 1}}
@@ -236,6 +436,9 @@ func TestRouteDiscovery(t *testing.T) {
 		j1 = segment{id: 1, name: "TEST LN", from: "A ST", to: "B ST", routeID: 1, direction: "BOTH", lastPoint: orb.Point{0, 1}}
 		j2 = segment{id: 2, name: "TEST LN", from: "B ST", to: "A ST", routeID: 1, direction: "BOTH", firstPoint: orb.Point{0, 1}, lastPoint: orb.Point{0, 2}}
 
+		o1 = segment{id: 1, name: "TEST LN", from: "A ST", to: "B ST", routeID: 1, direction: "FOTD", lastPoint: orb.Point{0, 1}}
+		o2 = segment{id: 2, name: "TEST LN", from: "B ST", to: "C ST", routeID: 1, direction: "FOTD", firstPoint: orb.Point{0, 1}, lastPoint: orb.Point{0, 2}}
+
 		irr = segment{id: 10, name: "IRRELEVANT PL", from: "A ST", to: "B ST", routeID: 2, direction: "BOTH"}
 	)
 
@@ -283,6 +486,14 @@ func TestRouteDiscovery(t *testing.T) {
 			req:   request{streetName: "Test Ln", from: "A St"},
 			want:  []segment{s2, s3, s4, s5}, // longer than s2,s1
 		},
+		{
+			name:  "FromStart",
+			in:    []segment{s1, s2, s3, s4, s5, irr},
+			start: []segment{s1, s2, s3, s4, s5},
+			end:   []segment{s4, s5},
+			req:   request{streetName: "Test Ln", to: "E St"},
+			want:  []segment{s1, s2, s3, s4}, // longer than s5
+		},
 		{
 			name:  "PreferOtherWhenToFromMatch",
 			in:    []segment{j1, j2},
@@ -291,6 +502,246 @@ func TestRouteDiscovery(t *testing.T) {
 			req:   request{streetName: "Test Ln", from: "A St", to: "A St"},
 			want:  []segment{j1, j2},
 		},
+		{
+			name:  "MultipleTo",
+			in:    []segment{s1, s2, s3, s4, s5, irr},
+			start: []segment{s1},
+			end:   []segment{s2, s3, s4, s5},
+			req:   request{streetName: "Test Ln", from: "A St", to: "E St|C St"},
+			want:  []segment{s1, s2}, // C St is reached before E St
+		},
+		{
+			name:  "Reversed",
+			in:    []segment{o1, o2},
+			start: []segment{o2},
+			end:   []segment{o1},
+			req:   request{streetName: "Test Ln", from: "C St", to: "A St"},
+			want:  []segment{o2, o1},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, ns := range routeTestStores(t, tc.in) {
+				t.Run(ns.name, func(t *testing.T) {
+					preq := processingRequest{
+						startSegments: tc.start,
+						endSegments:   tc.end,
+						req:           tc.req,
+					}
+
+					rd := routeDiscovery(ns.st, true)
+
+					route, err := rd(context.Background(), preq)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if d := cmp.Diff(tc.want, route, cmp.AllowUnexported(segment{})); d != "" {
+						t.Errorf("discovered route mismatch (-want +got):\n%s", d)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestFilterSegmentsEndStreetsCase(t *testing.T) {
+	seg := segment{id: 1, name: "TEST LN", from: "a St", to: "B st", routeID: 1, direction: "BOTH", lineString: orb.LineString{{0, 0}, {0, 1}}, firstPoint: orb.Point{0, 0}, lastPoint: orb.Point{0, 1}}
+
+	for _, ns := range routeTestStores(t, []segment{seg}) {
+		t.Run(ns.name, func(t *testing.T) {
+			for _, es := range []string{"A ST", "b ST"} {
+				segs, err := ns.st.filterSegments(context.Background(), segmentFilter{endStreets: []string{es}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(segs) != 1 {
+					t.Errorf("end street %q: got %d segments, want 1", es, len(segs))
+				}
+			}
+		})
+	}
+}
+
+// namedStore is a store and the name of its implementation.
+type namedStore struct {
+	name string
+	st   store
+}
+
+// routeTestStores returns a sqliteStore and an inMemoryStore holding segs,
+// for tests both should pass.
+func routeTestStores(t *testing.T, segs []segment) []namedStore {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	sst := &sqliteStore{db: db}
+	if err := sst.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sst.loadSegments(segs); err != nil {
+		t.Fatal(err)
+	}
+
+	mst, err := newInMemoryStore(segs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []namedStore{{"sqlite", sst}, {"memory", mst}}
+}
+
+func TestRouteDiscoveryCanceled(t *testing.T) {
+	var (
+		s1 = segment{id: 1, name: "TEST LN", from: "A ST", to: "B ST", routeID: 1, direction: "BOTH", lastPoint: orb.Point{0, 1}}
+		s2 = segment{id: 2, name: "TEST LN", from: "B ST", to: "C ST", routeID: 1, direction: "BOTH", firstPoint: orb.Point{0, 1}, lastPoint: orb.Point{0, 2}}
+	)
+
+	st, err := newInMemoryStore([]segment{s1, s2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Every start segment fails to route, but not for want of a path.
+	preq := processingRequest{
+		startSegments: []segment{s1, s2},
+		endSegments:   []segment{s2},
+		req:           request{streetName: "Test Ln", to: "C St"},
+	}
+	if _, err := routeDiscovery(st, false)(ctx, preq); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRouteDiscoveryReversedMaxExplored(t *testing.T) {
+	// Routing forward from C St runs on to G St, exceeding the search
+	// limit, while routing back from A St wouldn't.
+	var (
+		o1 = segment{id: 1, name: "TEST LN", from: "A ST", to: "B ST", routeID: 1, direction: "FOTD", lastPoint: orb.Point{0, 1}}
+		o2 = segment{id: 2, name: "TEST LN", from: "B ST", to: "C ST", routeID: 1, direction: "FOTD", firstPoint: orb.Point{0, 1}, lastPoint: orb.Point{0, 2}}
+		o3 = segment{id: 3, name: "TEST LN", from: "C ST", to: "D ST", routeID: 1, direction: "FOTD", firstPoint: orb.Point{0, 2}, lastPoint: orb.Point{0, 3}}
+		o4 = segment{id: 4, name: "TEST LN", from: "D ST", to: "E ST", routeID: 1, direction: "FOTD", firstPoint: orb.Point{0, 3}, lastPoint: orb.Point{0, 4}}
+		o5 = segment{id: 5, name: "TEST LN", from: "E ST", to: "F ST", routeID: 1, direction: "FOTD", firstPoint: orb.Point{0, 4}, lastPoint: orb.Point{0, 5}}
+		o6 = segment{id: 6, name: "TEST LN", from: "F ST", to: "G ST", routeID: 1, direction: "FOTD", firstPoint: orb.Point{0, 5}, lastPoint: orb.Point{0, 6}}
+	)
+
+	st, err := newInMemoryStore([]segment{o1, o2, o3, o4, o5, o6}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.maxExplored = 3
+
+	preq := processingRequest{
+		startSegments: []segment{o3},
+		endSegments:   []segment{o1},
+		req:           request{streetName: "Test Ln", from: "C St", to: "A St"},
+	}
+	_, err = routeDiscovery(st, false)(context.Background(), preq)
+	if err == nil || !strings.Contains(err.Error(), "exceeded 3 explored") {
+		t.Fatalf("got error %v, want search limit exceeded", err)
+	}
+}
+
+func TestRouteDiscoveryLoopStart(t *testing.T) {
+	// A crescent of three segments meeting A St at both ends, which A
+	// St's own segments may join into a ring.
+	var (
+		r1 = segment{id: 1, name: "TEST CRES", from: "A ST", to: "B ST", routeID: 1, direction: "BOTH", firstPoint: orb.Point{0, 0}, lastPoint: orb.Point{0, 1}}
+		r2 = segment{id: 2, name: "TEST CRES", from: "B ST", to: "C ST", routeID: 1, direction: "BOTH", firstPoint: orb.Point{0, 1}, lastPoint: orb.Point{1, 1}}
+		r3 = segment{id: 3, name: "TEST CRES", from: "C ST", to: "A ST", routeID: 1, direction: "BOTH", firstPoint: orb.Point{1, 1}, lastPoint: orb.Point{1, 0}}
+
+		// ring closes the crescent, meeting it at both ends.
+		ring = segment{id: 10, name: "A ST", from: "TEST CRES", to: "TEST CRES", routeID: 2, direction: "BOTH", firstPoint: orb.Point{0, 0}, lastPoint: orb.Point{1, 0}}
+		// east only meets the crescent at r3's end.
+		east = segment{id: 11, name: "A ST", from: "Z ST", to: "TEST CRES", routeID: 2, direction: "BOTH", firstPoint: orb.Point{2, 0}, lastPoint: orb.Point{1, 0}}
+	)
+
+	req := request{streetName: "Test Cres", from: "A St", to: "A St"}
+
+	cases := []struct {
+		name     string
+		cross    segment
+		start    []segment
+		override string
+		want     []int
+	}{
+		{name: "LeavingCrossStreet", cross: ring, start: []segment{r3, r1}, want: []int{1, 2, 3}},
+		{name: "NearerIntersection", cross: east, start: []segment{r1, r3}, want: []int{3, 2, 1}},
+		{name: "Override", cross: ring, start: []segment{r1, r3}, override: "3\n", want: []int{3, 2, 1}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.Chdir(wd) })
+
+			if tc.override != "" {
+				if err := os.Mkdir(overrideDir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(overridePath(req.stableID(), "loopstart"), []byte(tc.override), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, ns := range routeTestStores(t, []segment{r1, r2, r3, tc.cross}) {
+				t.Run(ns.name, func(t *testing.T) {
+					preq := processingRequest{
+						startSegments: tc.start,
+						endSegments:   tc.start,
+						req:           req,
+					}
+
+					route, err := routeDiscovery(ns.st, true)(context.Background(), preq)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					var got []int
+					for _, seg := range route {
+						got = append(got, seg.id)
+					}
+					if d := cmp.Diff(tc.want, got); d != "" {
+						t.Errorf("route mismatch (-want +got):\n%s", d)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestRouteDirection(t *testing.T) {
+	var (
+		// FOTD travels first to last point, FDTO last to first.
+		f1 = segment{id: 1, name: "TEST LN", routeID: 1, direction: "FOTD", firstPoint: orb.Point{0, 0}, lastPoint: orb.Point{0, 1}}
+		f2 = segment{id: 2, name: "TEST LN", routeID: 1, direction: "FOTD", firstPoint: orb.Point{0, 1}, lastPoint: orb.Point{0, 2}}
+		r3 = segment{id: 3, name: "TEST LN", routeID: 1, direction: "FDTO", firstPoint: orb.Point{0, 3}, lastPoint: orb.Point{0, 2}}
+		b4 = segment{id: 4, name: "TEST LN", routeID: 1, direction: "BOTH", firstPoint: orb.Point{0, 3}, lastPoint: orb.Point{0, 4}}
+	)
+
+	cases := []struct {
+		name     string
+		from, to segment
+		want     []int
+	}{
+		{name: "Forward", from: f1, to: b4, want: []int{1, 2, 3, 4}},
+		{name: "AgainstFOTD", from: f2, to: f1},
+		{name: "AgainstFDTO", from: b4, to: f2},
 	}
 
 	for _, tc := range cases {
@@ -306,26 +757,1268 @@ func TestRouteDiscovery(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			if err := st.loadSegments(tc.in); err != nil {
+			if err := st.loadSegments([]segment{f1, f2, r3, b4}); err != nil {
 				t.Fatal(err)
 			}
 
-			preq := processingRequest{
-				startSegments: tc.start,
-				endSegments:   tc.end,
-				req:           tc.req,
+			route, err := st.route(context.Background(), []segment{tc.from}, []segment{tc.to})
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("wanted error, got route %v", route)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int
+			for _, seg := range route {
+				got = append(got, seg.id)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("route mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestLinkSegmentsDirections(t *testing.T) {
+	// a's last point meets b's first.
+	var (
+		ab = segmentLink{exit: segmentEnd{1, endLast}, entry: segmentEnd{2, endFirst}}
+		ba = segmentLink{exit: segmentEnd{2, endFirst}, entry: segmentEnd{1, endLast}}
+	)
+
+	cases := []struct {
+		a, b string
+		want []segmentLink
+	}{
+		{"BOTH", "BOTH", []segmentLink{ab, ba}},
+		{"BOTH", "FOTD", []segmentLink{ab}},
+		{"BOTH", "FDTO", []segmentLink{ba}},
+		{"FOTD", "BOTH", []segmentLink{ab}},
+		{"FOTD", "FOTD", []segmentLink{ab}},
+		{"FOTD", "FDTO", nil},
+		{"FDTO", "BOTH", []segmentLink{ba}},
+		{"FDTO", "FOTD", nil},
+		{"FDTO", "FDTO", []segmentLink{ba}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.a+"-"+tc.b, func(t *testing.T) {
+			db, err := sql.Open("sqlite", "file::memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			st := &sqliteStore{db: db}
+			if err := st.init(); err != nil {
+				t.Fatal(err)
+			}
+
+			segs := []segment{
+				{id: 1, name: "TEST LN", routeID: 1, direction: tc.a, firstPoint: orb.Point{0, 0}, lastPoint: orb.Point{0, 1}},
+				{id: 2, name: "TEST LN", routeID: 1, direction: tc.b, firstPoint: orb.Point{0, 1}, lastPoint: orb.Point{0, 2}},
+			}
+			if err := st.loadSegments(segs); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := st.segmentLinks(context.Background(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, got, cmp.AllowUnexported(segmentLink{}, segmentEnd{})); d != "" {
+				t.Errorf("links mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestRouteMaxExplored(t *testing.T) {
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db, maxExplored: 3}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var segs []segment
+	for i := 1; i <= 5; i++ {
+		segs = append(segs, segment{id: i, name: "TEST LN", routeID: 1, direction: "FOTD", firstPoint: orb.Point{0, float64(i - 1)}, lastPoint: orb.Point{0, float64(i)}})
+	}
+	if err := st.loadSegments(segs); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = st.route(context.Background(), segs[:1], segs[4:])
+	if err == nil || !strings.Contains(err.Error(), "exceeded 3 explored paths") {
+		t.Fatalf("got error %v, want exceeded explored paths", err)
+	}
+}
+
+func TestRouteAvoidClasses(t *testing.T) {
+	// 1 leads to 3 directly through the arterial 2, or around it through
+	// the local 4, 5 and 6.
+	segs := []segment{
+		{id: 1, streetClass: "LOCAL", firstPoint: orb.Point{0, 0}, lastPoint: orb.Point{0, 1}},
+		{id: 2, streetClass: "ARTERIAL", firstPoint: orb.Point{0, 1}, lastPoint: orb.Point{0, 2}},
+		{id: 3, streetClass: "LOCAL", firstPoint: orb.Point{0, 2}, lastPoint: orb.Point{0, 3}},
+		{id: 4, streetClass: "LOCAL", firstPoint: orb.Point{0, 1}, lastPoint: orb.Point{1, 1}},
+		{id: 5, streetClass: "LOCAL", firstPoint: orb.Point{1, 1}, lastPoint: orb.Point{1, 2}},
+		{id: 6, streetClass: "LOCAL", firstPoint: orb.Point{1, 2}, lastPoint: orb.Point{0, 2}},
+	}
+	for i := range segs {
+		segs[i].name = "TEST LN"
+		segs[i].routeID = 1
+		segs[i].direction = "FOTD"
+	}
+
+	cases := []struct {
+		name         string
+		avoidClasses []string
+		to           segment
+		want         []int
+	}{
+		{name: "Shortest", to: segs[2], want: []int{1, 2, 3}},
+		{name: "AvoidArterial", avoidClasses: []string{"arterial"}, to: segs[2], want: []int{1, 4, 5, 6, 3}},
+		{name: "AvoidedEnd", avoidClasses: []string{"ARTERIAL"}, to: segs[1], want: []int{1, 2}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite", "file::memory:")
+			if err != nil {
+				t.Fatal(err)
 			}
+			defer db.Close()
 
-			rd := routeDiscovery(st)
+			st := &sqliteStore{db: db, avoidClasses: tc.avoidClasses}
+			if err := st.init(); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.loadSegments(segs); err != nil {
+				t.Fatal(err)
+			}
 
-			route, err := rd(preq)
+			route, err := st.route(context.Background(), segs[:1], []segment{tc.to})
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			if d := cmp.Diff(tc.want, route, cmp.AllowUnexported(segment{})); d != "" {
-				t.Errorf("discovered route mismatch (-want +got):\n%s", d)
+			var got []int
+			for _, seg := range route {
+				got = append(got, seg.id)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("route mismatch (-want +got):\n%s", d)
 			}
 		})
 	}
 }
+
+func BenchmarkRoute(b *testing.B) {
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		b.Fatal(err)
+	}
+
+	// A long two-way street, as on a major arterial.
+	const n = 500
+
+	var segs []segment
+	for i := 1; i <= n; i++ {
+		segs = append(segs, segment{id: i, name: "TEST LN", routeID: 1, direction: "BOTH", firstPoint: orb.Point{0, float64(i - 1)}, lastPoint: orb.Point{0, float64(i)}})
+	}
+	if err := st.loadSegments(segs); err != nil {
+		b.Fatal(err)
+	}
+
+	from, to := []segment{segs[0]}, []segment{segs[n-1]}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		route, err := st.route(context.Background(), from, to)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(route) != n {
+			b.Fatalf("got route of %d segments, want %d", len(route), n)
+		}
+	}
+}
+
+func TestFilterSegmentsManyIDs(t *testing.T) {
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough to exceed SQLite's default expression depth limit of 1000
+	// if each ID were its own OR term.
+	const n = 2000
+
+	var (
+		in  []segment
+		ids []int
+	)
+	for i := 1; i <= n; i++ {
+		in = append(in, segment{id: i, name: "TEST LN", routeID: i, direction: "BOTH", firstPoint: orb.Point{float64(i), 0}, lastPoint: orb.Point{float64(i), 1}})
+		ids = append(ids, i)
+	}
+
+	if err := st.loadSegments(in); err != nil {
+		t.Fatal(err)
+	}
+
+	segs, err := st.filterSegments(context.Background(), segmentFilter{ids: ids})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(segs) != n {
+		t.Errorf("got %d segments, want %d", len(segs), n)
+	}
+}
+
+func TestMigrateNormFullName(t *testing.T) {
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Schema and data as built before norm_full_name existed.
+	for _, q := range []string{
+		"create table segments (id integer primary key, str_name text, str_type text, st_class, full_name text, from_str text, to_str text, route_id integer, direction text, line_string json, first_point json, last_point json)",
+		`insert into segments values (1, 'TESTN', 'LN', 'LOCAL', 'TESTN LN', 'A ST', 'B ST', 1, 'BOTH', '{"type":"LineString","coordinates":[[0,0],[0,1]]}', '{"type":"Point","coordinates":[0,0]}', '{"type":"Point","coordinates":[0,1]}')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := &sqliteStore{db: db}
+	if err := st.migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Migrating again is a no-op.
+	if err := st.migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	segs, err := st.filterSegments(context.Background(), segmentFilter{fullNames: []string{"Test'n  Ln"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 1 || segs[0].id != 1 {
+		t.Errorf("got segments %v, want segment 1", segs)
+	}
+
+	segs, err = st.segmentsInBounds(context.Background(), orb.Bound{Min: orb.Point{-1, 0.5}, Max: orb.Point{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 1 || segs[0].id != 1 {
+		t.Errorf("got segments %v in bounds, want segment 1", segs)
+	}
+
+	if v, err := st.schemaVersion(); err != nil {
+		t.Fatal(err)
+	} else if want := len(st.migrations()); v != want {
+		t.Errorf("got schema version %d, want %d", v, want)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := len(st.migrations())
+	if v, err := st.schemaVersion(); err != nil {
+		t.Fatal(err)
+	} else if v != want {
+		t.Errorf("got schema version %d after init, want %d", v, want)
+	}
+
+	// A freshly built database needs no migrations.
+	if err := st.migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.setSchemaVersion(want + 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.migrate(context.Background()); err == nil {
+		t.Error("migrating a newer database succeeded, want error")
+	}
+}
+
+func TestSegmentsInBounds(t *testing.T) {
+	mk := func(id int, ls orb.LineString) segment {
+		return segment{id: id, name: "TEST LN", routeID: id, direction: "BOTH", lineString: ls, firstPoint: ls[0], lastPoint: ls[len(ls)-1]}
+	}
+
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.loadSegments([]segment{
+		mk(1, orb.LineString{{0, 0}, {1, 1}}),
+		mk(2, orb.LineString{{5, 5}, {6, 6}}),
+		mk(3, orb.LineString{{0, 3}, {10, 3}}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		bound orb.Bound
+		want  []int
+	}{
+		{"none", orb.Bound{Min: orb.Point{20, 20}, Max: orb.Point{21, 21}}, nil},
+		{"one inside", orb.Bound{Min: orb.Point{-1, -1}, Max: orb.Point{2, 2}}, []int{1}},
+		{"overlapping", orb.Bound{Min: orb.Point{0.5, 0.5}, Max: orb.Point{5.5, 5.5}}, []int{1, 2, 3}},
+		{"crossing only", orb.Bound{Min: orb.Point{7, 2}, Max: orb.Point{8, 4}}, []int{3}},
+		{"touching edge", orb.Bound{Min: orb.Point{6, 6}, Max: orb.Point{7, 7}}, []int{2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			segs, err := st.segmentsInBounds(context.Background(), tc.bound)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int
+			for _, seg := range segs {
+				got = append(got, seg.id)
+			}
+			slices.Sort(got)
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("segment ids mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestFilterSegmentsBBox(t *testing.T) {
+	var (
+		in  = segment{id: 1, name: "TEST LN", routeID: 1, direction: "BOTH", lineString: orb.LineString{{0, 0}, {1, 1}}, lastPoint: orb.Point{1, 1}}
+		out = segment{id: 2, name: "TEST LN", routeID: 2, direction: "BOTH", lineString: orb.LineString{{5, 5}, {6, 6}}, firstPoint: orb.Point{5, 5}, lastPoint: orb.Point{6, 6}}
+	)
+
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &sqliteStore{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.loadSegments([]segment{in, out}); err != nil {
+		t.Fatal(err)
+	}
+
+	segs, err := st.filterSegments(context.Background(), segmentFilter{bbox: &orb.Bound{Min: orb.Point{0.5, 0.5}, Max: orb.Point{2, 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := in
+	want.length, want.midpoint = geo.Length(in.lineString), lineMidpoint(in.lineString)
+	if d := cmp.Diff([]segment{want}, segs, cmp.AllowUnexported(segment{})); d != "" {
+		t.Errorf("filtered segment mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestLineMidpoint(t *testing.T) {
+	ls := orb.LineString{{0, 0}, {0, 1}, {0, 3}}
+	if got, want := lineMidpoint(ls), (orb.Point{0, 1.5}); !isClose(got, want) {
+		t.Errorf("got midpoint %v, want %v", got, want)
+	}
+}
+
+func TestDetourCheck(t *testing.T) {
+	var (
+		// 0.001 degrees is about 111m.
+		a = segment{id: 1, lineString: orb.LineString{{0, 0}, {0, 0.001}}, length: 111}
+		b = segment{id: 2, lineString: orb.LineString{{0, 0.001}, {0.001, 0.001}}, length: 111}
+		c = segment{id: 3, lineString: orb.LineString{{0.001, 0.001}, {0.001, 0.0001}}, length: 100}
+	)
+
+	cases := []struct {
+		name    string
+		route   []segment
+		wantErr bool
+	}{
+		{name: "Straight", route: []segment{a}},
+		{name: "Corner", route: []segment{a, b}},
+		{name: "Detour", route: []segment{a, b, c}, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rh := detourCheck(2, func(context.Context, processingRequest) ([]segment, error) {
+				return tc.route, nil
+			})
+
+			_, err := rh(context.Background(), processingRequest{})
+			if tc.wantErr && err == nil {
+				t.Fatal("wanted error")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBacktracks(t *testing.T) {
+	var (
+		s1 = segment{id: 1, direction: "BOTH", firstPoint: orb.Point{0, 0}, lastPoint: orb.Point{0, 0.01}}
+		s2 = segment{id: 2, direction: "BOTH", firstPoint: orb.Point{0, 0.01}, lastPoint: orb.Point{0, 0.02}}
+		// u turns across to r2, s2's other carriageway.
+		u  = segment{id: 3, direction: "BOTH", firstPoint: orb.Point{0, 0.02}, lastPoint: orb.Point{0.0001, 0.02}}
+		r2 = segment{id: 4, direction: "FDTO", firstPoint: orb.Point{0.0001, 0.01}, lastPoint: orb.Point{0.0001, 0.02}}
+		s3 = segment{id: 5, direction: "BOTH", firstPoint: orb.Point{0, 0.02}, lastPoint: orb.Point{0, 0.03}}
+	)
+
+	cases := []struct {
+		name  string
+		route []segment
+		want  []int
+	}{
+		{name: "Straight", route: []segment{s1, s2, s3}},
+		{name: "DoublesBack", route: []segment{s1, s2, u, r2}, want: []int{4}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if d := cmp.Diff(tc.want, backtracks(tc.route)); d != "" {
+				t.Errorf("backtracking segment mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestOrderResults(t *testing.T) {
+	route := func(length float64, class string) requestResult {
+		return requestResult{routeSegments: []segment{{length: length, streetClass: class}}}
+	}
+	results := []rankedResult{
+		{req: request{rank: 1}, res: route(100, "LOCAL")},
+		{req: request{rank: 2}, res: route(300, "LOCAL")},
+		{req: request{rank: 3}, res: route(200, "COLLECTOR")},
+	}
+
+	cases := []struct {
+		orderBy string
+		want    []int // source ranks, in display order
+	}{
+		{orderBy: "rank", want: []int{1, 2, 3}},
+		{orderBy: "length", want: []int{2, 3, 1}},
+		{orderBy: "class,length=0.1", want: []int{2, 1, 3}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.orderBy, func(t *testing.T) {
+			terms, err := parseOrderBy(tc.orderBy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rs := append([]rankedResult(nil), results...)
+			orderResults(rs, terms)
+
+			var got []int
+			for i, r := range rs {
+				got = append(got, r.req.rank)
+				if !isRankOrder(terms) && r.displayRank != i+1 {
+					t.Errorf("got display rank %d at position %d", r.displayRank, i)
+				}
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("order mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+
+	if _, err := parseOrderBy("rank,popularity"); err == nil {
+		t.Error("wanted error for unknown term")
+	}
+}
+
+func TestOffStreet(t *testing.T) {
+	segs := []segment{
+		{id: 1, name: "TEST'N LN", streetName: "TEST'N"},
+		{id: 2, name: "TEST LN", streetName: "TEST"},
+		{id: 3, name: "OTHER RD", streetName: "OTHER"},
+	}
+
+	cases := []struct {
+		street string
+		want   []int
+	}{
+		{"Testn Ln", []int{2, 3}},
+		{"Test", []int{1, 3}},
+		{"Nowhere St", []int{1, 2, 3}},
+	}
+
+	for _, tc := range cases {
+		if d := cmp.Diff(tc.want, offStreet(tc.street, segs)); d != "" {
+			t.Errorf("%s: mismatch (-want +got):\n%s", tc.street, d)
+		}
+	}
+}
+
+func TestFindGaps(t *testing.T) {
+	mk := func(id, routeID int, ls orb.LineString) segment {
+		return segment{id: id, routeID: routeID, direction: "BOTH", lineString: ls, firstPoint: ls[0], lastPoint: ls[len(ls)-1]}
+	}
+	segs := []segment{
+		mk(1, 1, orb.LineString{{0, 0}, {0, 0.001}}),
+		// About 3 m past the end of 1.
+		mk(2, 1, orb.LineString{{0, 0.00103}, {0, 0.002}}),
+		// Touching 2, so linked rather than a gap.
+		mk(3, 1, orb.LineString{{0, 0.002}, {0, 0.003}}),
+		// Near 1 but on another route.
+		mk(4, 2, orb.LineString{{0, 0.00102}, {0.001, 0.00102}}),
+	}
+
+	gaps := findGaps(segs, 10)
+	if len(gaps) != 1 {
+		t.Fatalf("got %d gaps, want 1: %+v", len(gaps), gaps)
+	}
+	g := gaps[0]
+	want := segmentGap{routeID: 1, a: segmentEnd{id: 1, end: endLast}, b: segmentEnd{id: 2, end: endFirst}, distance: g.distance}
+	if d := cmp.Diff(want, g, cmp.AllowUnexported(segmentGap{}, segmentEnd{})); d != "" {
+		t.Errorf("gap mismatch (-want +got):\n%s", d)
+	}
+	if g.distance < 3 || g.distance > 4 {
+		t.Errorf("got distance %.2f, want about 3.3", g.distance)
+	}
+}
+
+func TestLinkNeighbourhood(t *testing.T) {
+	// 1 -> 2 -> 3 -> 4, and 5 -> 3.
+	links := map[int][]int{1: {2}, 2: {3}, 3: {4}, 5: {3}}
+
+	cases := []struct {
+		from, depth int
+		want        map[int]bool
+	}{
+		{2, 0, map[int]bool{2: true}},
+		{2, 1, map[int]bool{1: true, 2: true, 3: true}},
+		{4, 2, map[int]bool{2: true, 3: true, 4: true, 5: true}},
+	}
+
+	for _, tc := range cases {
+		if d := cmp.Diff(tc.want, linkNeighbourhood(links, tc.from, tc.depth)); d != "" {
+			t.Errorf("from %d depth %d mismatch (-want +got):\n%s", tc.from, tc.depth, d)
+		}
+	}
+}
+
+func TestDedupeSegments(t *testing.T) {
+	segs := []segment{
+		{id: 1, routeID: 1, lineString: orb.LineString{{0, 0}, {0, 1}}},
+		{id: 2, routeID: 1, lineString: orb.LineString{{0, 1}, {0, 2}}},
+		{id: 3, routeID: 2, lineString: orb.LineString{{0, 1}, {0, 0}}},
+		{id: 2, routeID: 3, lineString: orb.LineString{{1, 1}, {1, 2}}},
+	}
+
+	kept, dups := dedupeSegments(segs)
+
+	ids := func(segs []segment) []int {
+		var out []int
+		for _, seg := range segs {
+			out = append(out, seg.id)
+		}
+		return out
+	}
+	if d := cmp.Diff([]int{1, 2}, ids(kept)); d != "" {
+		t.Errorf("kept mismatch (-want +got):\n%s", d)
+	}
+	if d := cmp.Diff([]int{3, 2}, ids(dups)); d != "" {
+		t.Errorf("duplicates mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestLoadSegmentsDropDuplicates(t *testing.T) {
+	segs := []segment{
+		{id: 1, routeID: 1, direction: "BOTH", lineString: orb.LineString{{0, 0}, {0, 1}}},
+		{id: 2, routeID: 1, direction: "BOTH", lineString: orb.LineString{{0, 1}, {0, 2}}},
+		{id: 3, routeID: 2, direction: "BOTH", lineString: orb.LineString{{0, 1}, {0, 0}}},
+	}
+
+	for _, tc := range []struct {
+		drop bool
+		want []int
+	}{
+		{drop: false, want: []int{1, 2, 3}},
+		{drop: true, want: []int{1, 2}},
+	} {
+		db, err := sql.Open("sqlite", "file::memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		st := &sqliteStore{db: db, dropDuplicates: tc.drop}
+		if err := st.init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.loadSegments(segs); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := st.filterSegments(context.Background(), segmentFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, seg := range got {
+			ids = append(ids, seg.id)
+		}
+		slices.Sort(ids)
+		if d := cmp.Diff(tc.want, ids); d != "" {
+			t.Errorf("with drop %v, loaded IDs mismatch (-want +got):\n%s", tc.drop, d)
+		}
+	}
+}
+
+func TestLoadSegmentsSnapTolerance(t *testing.T) {
+	// The segments' ends are about 3 metres apart.
+	segs := []segment{
+		{id: 1, routeID: 1, direction: "BOTH", lineString: orb.LineString{{0, 0}, {0, 0.001}}, firstPoint: orb.Point{0, 0}, lastPoint: orb.Point{0, 0.001}},
+		{id: 2, routeID: 1, direction: "BOTH", lineString: orb.LineString{{0, 0.00103}, {0, 0.002}}, firstPoint: orb.Point{0, 0.00103}, lastPoint: orb.Point{0, 0.002}},
+	}
+
+	for _, tc := range []struct {
+		tolerance float64
+		want      bool
+	}{
+		{tolerance: 0, want: false},
+		{tolerance: 5, want: true},
+	} {
+		db, err := sql.Open("sqlite", "file::memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		st := &sqliteStore{db: db, snapTolerance: tc.tolerance}
+		if err := st.init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.loadSegments(segs); err != nil {
+			t.Fatal(err)
+		}
+
+		links, err := st.segmentLinks(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var linked bool
+		for _, l := range links {
+			if l.exit.id == 1 && l.entry.id == 2 {
+				linked = true
+			}
+		}
+		if linked != tc.want {
+			t.Errorf("with tolerance %g, linked = %v, want %v", tc.tolerance, linked, tc.want)
+		}
+	}
+}
+
+func TestRouteLineStyle(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	opacity := func(o float64) *float64 { return &o }
+
+	cases := []struct {
+		name string
+		opts exportOptions
+		want string
+	}{
+		{name: "Default", want: "<LineStyle><width>4</width><color>ff0000ff</color></LineStyle>"},
+		{name: "Thin", opts: exportOptions{lineWidth: 1.5}, want: "<LineStyle><width>1.5</width><color>ff0000ff</color></LineStyle>"},
+		{name: "Translucent", opts: exportOptions{lineOpacity: opacity(0.5)}, want: "<LineStyle><width>4</width><color>800000ff</color></LineStyle>"},
+		{name: "Transparent", opts: exportOptions{lineOpacity: opacity(0)}, want: "<LineStyle><width>4</width><color>000000ff</color></LineStyle>"},
+		{name: "Opaque", opts: exportOptions{lineOpacity: opacity(1)}, want: "<LineStyle><width>4</width><color>ff0000ff</color></LineStyle>"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf strings.Builder
+			if err := routeLineStyle(red, tc.opts).Write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, strings.TrimPrefix(buf.String(), xml.Header)); d != "" {
+				t.Errorf("style mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestRankColorGroup(t *testing.T) {
+	cases := []struct {
+		rank, lo, hi, groups int
+		want                 int
+	}{
+		{1, 1, 1, 20, 0},
+		{3, 1, 3, 20, 13},
+		{1, 1, 100, 20, 0},
+		{100, 1, 100, 20, 19},
+		{50, 1, 100, 20, 9},
+	}
+
+	for _, tc := range cases {
+		if got := rankColorGroup(tc.rank, tc.lo, tc.hi, tc.groups); got != tc.want {
+			t.Errorf("rankColorGroup(%d, %d, %d, %d) = %d, want %d", tc.rank, tc.lo, tc.hi, tc.groups, got, tc.want)
+		}
+	}
+}
+
+func TestPlotSegments(t *testing.T) {
+	route := []segment{{lineString: orb.LineString{{0, 0}, {2, 2}}}}
+	start := []segment{{lineString: orb.LineString{{0, 0}}}}
+
+	want := [][]int{
+		{mapEmpty, mapEmpty, mapRoute},
+		{mapEmpty, mapRoute, mapEmpty},
+		{mapStart, mapEmpty, mapEmpty},
+	}
+	if d := cmp.Diff(want, plotSegments(3, 3, route, start)); d != "" {
+		t.Errorf("plot mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestMinimapPlain(t *testing.T) {
+	route := []segment{{lineString: orb.LineString{{0, 0}, {2, 2}}}}
+	start := []segment{{lineString: orb.LineString{{0, 0}}}}
+
+	want := "  #\n # \nS  \n"
+	if got := minimap(plainMapCells, 3, 3, route, start, nil); got != want {
+		t.Errorf("got minimap %q, want %q", got, want)
+	}
+}
+
+func TestUseColor(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if useColor(false, f) {
+		t.Error("got color for a regular file, want none")
+	}
+
+	t.Setenv("NO_COLOR", "1")
+	if useColor(false, os.Stdout) {
+		t.Error("got color with NO_COLOR set, want none")
+	}
+}
+
+func TestMergeLineStrings(t *testing.T) {
+	var (
+		a = segment{id: 1, lineString: orb.LineString{{0, 0}, {0, 1}}}
+		b = segment{id: 2, lineString: orb.LineString{{0, 1}, {0, 2}}}
+		r = segment{id: 3, lineString: orb.LineString{{0, 3}, {0, 2}}}
+		f = segment{id: 4, lineString: orb.LineString{{5, 5}, {5, 6}}}
+	)
+
+	cases := []struct {
+		name string
+		in   []segment
+		want []orb.LineString
+	}{
+		{
+			name: "Touching",
+			in:   []segment{a, b},
+			want: []orb.LineString{{{0, 0}, {0, 1}, {0, 2}}},
+		},
+		{
+			name: "Reversed",
+			in:   []segment{a, b, r},
+			want: []orb.LineString{{{0, 0}, {0, 1}, {0, 2}, {0, 3}}},
+		},
+		{
+			name: "ReversedFirst",
+			in:   []segment{b, a},
+			want: []orb.LineString{{{0, 2}, {0, 1}, {0, 0}}},
+		},
+		{
+			name: "Gap",
+			in:   []segment{a, f, b},
+			want: []orb.LineString{{{0, 0}, {0, 1}}, {{5, 5}, {5, 6}}, {{0, 1}, {0, 2}}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mergeLineStrings(tc.in)
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("merged line string mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHandleTimeout(t *testing.T) {
+	rh := requestHandler{
+		timeout: time.Millisecond,
+		startHandler: func(ctx context.Context, _ processingRequest) ([]segment, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	_, err := rh.handle(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRequestAttemptOnRoute(t *testing.T) {
+	cases := []struct {
+		name string
+		att  requestAttempt
+		want bool
+	}{
+		{name: "NoSegments", att: requestAttempt{startErr: errors.New("no start")}},
+		{name: "Start", att: requestAttempt{startSegments: []segment{{id: 1, routeID: 1}}}, want: true},
+		{name: "EndOnly", att: requestAttempt{startSegments: []segment{{id: 2, routeID: 2}}, endSegments: []segment{{id: 1, routeID: 1}}}, want: true},
+		{name: "OtherRoute", att: requestAttempt{startSegments: []segment{{id: 2, routeID: 2}}, routeSegments: []segment{{id: 2, routeID: 2}}}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.att.onRoute(1); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestChangedOverrideIDs(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	prev := map[string]time.Time{
+		"abc.start": t0,
+		"abc.route": t0,
+		"def.end":   t0,
+		"ghi.route": t0,
+	}
+	cur := map[string]time.Time{
+		"abc.start": t0,
+		"abc.route": t0.Add(time.Second), // rewritten
+		"def.end":   t0,
+		"jkl.start": t0, // added
+		// ghi.route removed
+	}
+
+	want := []string{"abc", "ghi", "jkl"}
+	if d := cmp.Diff(want, changedOverrideIDs(prev, cur)); d != "" {
+		t.Errorf("changed IDs mismatch (-want +got):\n%s", d)
+	}
+	if got := changedOverrideIDs(cur, cur); len(got) != 0 {
+		t.Errorf("got changed IDs %v for unchanged files, want none", got)
+	}
+}
+
+func TestWatchOverrides(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan []string, 1)
+	go watchOverrides(ctx, 10*time.Millisecond, func(ids []string) {
+		select {
+		case changed <- ids:
+		default:
+		}
+	})
+
+	// Give the watcher time to take its first look, without overrideDir.
+	time.Sleep(50 * time.Millisecond)
+	if err := os.Mkdir(overrideDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(overridePath("abc", "route"), []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ids := <-changed:
+		if d := cmp.Diff([]string{"abc"}, ids); d != "" {
+			t.Errorf("changed IDs mismatch (-want +got):\n%s", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher didn't notice the new override file")
+	}
+}
+
+func TestOverrideHistoryUndo(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if err := os.Mkdir(overrideDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	start := overridePath("abc", "start")
+	if err := os.WriteFile(start, []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newOverrideHistory()
+	write := func(path, content string) func() error {
+		return func() error { return os.WriteFile(path, []byte(content), 0o644) }
+	}
+	if err := h.change("abc", []string{"start"}, write(start, "2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.change("abc", []string{"route"}, write(overridePath("abc", "route"), "2\n3\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Undoing the route override removes the file it created.
+	if err := h.undo("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(overridePath("abc", "route")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("route override still exists after undo, stat error %v", err)
+	}
+
+	// Undoing the start override restores what it replaced.
+	if err := h.undo("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(start); err != nil || string(b) != "1\n" {
+		t.Errorf("got start override %q, %v, want %q", b, err, "1\n")
+	}
+
+	if err := h.undo("abc"); err == nil {
+		t.Error("wanted error with nothing to undo")
+	}
+}
+
+func TestParseCRS(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "4326", want: 4326},
+		{in: "epsg:3857", want: 3857},
+		{in: "EPSG:32610", want: 32610},
+		{in: "32760", want: 32760},
+		{in: "32661", wantErr: true},
+		{in: "2227", wantErr: true},
+		{in: "utm", wantErr: true},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := parseCRS(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if got.epsg != tc.want {
+				t.Errorf("got EPSG %d, want %d", got.epsg, tc.want)
+			}
+		})
+	}
+}
+
+func TestUTMProjection(t *testing.T) {
+	c, err := parseCRS("32610")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// San Francisco City Hall area, in zone 10N.
+	g, err := c.projectGeometry(orb.Point{-122.4194, 37.7749})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := g.(orb.Point)
+	want := orb.Point{551130.8, 4180998.9}
+	if math.Abs(got[0]-want[0]) > 1 || math.Abs(got[1]-want[1]) > 1 {
+		t.Errorf("got %v, want within 1m of %v", got, want)
+	}
+
+	// Projected lengths match geodesic ones closely, allowing for
+	// geo.Length measuring on a sphere rather than the ellipsoid.
+	ls := orb.LineString{{-122.4194, 37.7749}, {-122.4094, 37.7849}}
+	g, err = c.projectGeometry(ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pls := g.(orb.LineString)
+	planar := math.Hypot(pls[1][0]-pls[0][0], pls[1][1]-pls[0][1])
+	if d := geo.Length(ls); math.Abs(planar-d)/d > 0.005 {
+		t.Errorf("got projected length %.1f, want within 0.5%% of %.1f", planar, d)
+	}
+	if ls[0] != (orb.Point{-122.4194, 37.7749}) {
+		t.Errorf("projecting modified the input line string: %v", ls)
+	}
+
+	if _, err := c.projectGeometry(orb.Polygon{{{-122.4194, 37.7749}}}); err == nil {
+		t.Error("projecting a polygon succeeded, want error")
+	}
+}
+
+func TestKMLCoordinate(t *testing.T) {
+	p := orb.Point{-63.57712345678, 44.64898765432}
+	for _, tc := range []struct {
+		precision int
+		want      kml.Coordinate
+	}{
+		{0, kml.Coordinate{Lon: -63.57712345678, Lat: 44.64898765432}},
+		{6, kml.Coordinate{Lon: -63.577123, Lat: 44.648988}},
+		{3, kml.Coordinate{Lon: -63.577, Lat: 44.649}},
+	} {
+		if got := kmlCoordinate(p, tc.precision); got != tc.want {
+			t.Errorf("precision %d: got %v, want %v", tc.precision, got, tc.want)
+		}
+	}
+}
+
+func TestExportMode(t *testing.T) {
+	cases := []struct {
+		name    string
+		modes   map[string]bool
+		want    string
+		wantErr bool
+	}{
+		{name: "Default", modes: map[string]bool{"--split": false, "--ndjson": false}},
+		{name: "One", modes: map[string]bool{"--split": false, "--ndjson": true}, want: "--ndjson"},
+		{name: "Conflict", modes: map[string]bool{"--heatmap": true, "--by-street": true}, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := exportMode(tc.modes)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("got mode %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandlerFlags(t *testing.T) {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	threshold := 0.7
+	opts := handlerFlags(set, &threshold)
+
+	if err := set.Parse([]string{"-relaxed-end", "-fuzzy", "-max-detour", "2.5", "-timeout", "3s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := handlerOptions{relaxedEnd: true, fuzzy: true, fuzzyThreshold: 0.7, maxDetour: 2.5, timeout: 3 * time.Second}
+	if d := cmp.Diff(want, opts(), cmp.AllowUnexported(handlerOptions{})); d != "" {
+		t.Errorf("options mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestValidateStreetProblems(t *testing.T) {
+	var (
+		s1 = segment{id: 1, name: "TEST LN", streetName: "TEST", from: "A ST", to: "B ST", routeID: 1, direction: "BOTH", lineString: orb.LineString{{0, 0}, {0, 1}}, firstPoint: orb.Point{0, 0}, lastPoint: orb.Point{0, 1}}
+		s2 = segment{id: 2, name: "TEST LN", streetName: "TEST", from: "B ST", to: "C ST", routeID: 1, direction: "BOTH", lineString: orb.LineString{{0, 1}, {0, 2}}, firstPoint: orb.Point{0, 1}, lastPoint: orb.Point{0, 2}}
+	)
+	reqs := []request{
+		{rank: 1, streetName: "Test Ln", from: "A St", to: "C St"},
+		// Only resolves by fuzzy matching Test Ln, a different street.
+		{rank: 2, streetName: "Test Lnn", from: "A St", to: "C St"},
+	}
+
+	st, err := newInMemoryStore([]segment{s1, s2}, reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := validateRequests(context.Background(), st, validateOptions{handlerOptions: handlerOptions{fuzzy: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type problem struct {
+		rank int
+		when string
+		ids  []int
+	}
+	var got []problem
+	for _, p := range v.streetProblems {
+		got = append(got, problem{p.req.rank, p.when, p.ids})
+	}
+	want := []problem{{2, "start", []int{1}}, {2, "end", []int{2}}}
+	if d := cmp.Diff(want, got, cmp.AllowUnexported(problem{})); d != "" {
+		t.Errorf("problems mismatch (-want +got):\n%s", d)
+	}
+
+	// Both requests are bounded by cross streets, so a whole-street
+	// filter leaves nothing to check.
+	filter, err := newRequestFilter(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = validateRequests(context.Background(), st, validateOptions{requestFilter: filter, handlerOptions: handlerOptions{fuzzy: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.streetProblems) != 0 {
+		t.Errorf("got %d problems with whole-street filter, want 0", len(v.streetProblems))
+	}
+
+	// Rank 2 is the only request with problems.
+	v, err = validateRequests(context.Background(), st, validateOptions{requestFilter: requestFilter{rankMin: 1, rankMax: 1}, handlerOptions: handlerOptions{fuzzy: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.streetProblems) != 0 {
+		t.Errorf("got %d problems with rank 1 only, want 0", len(v.streetProblems))
+	}
+}
+
+func TestValidateDetours(t *testing.T) {
+	// The route turns a corner, so is about 1.4 times the distance between
+	// its ends.
+	var (
+		s1 = segment{id: 1, name: "TEST LN", streetName: "TEST", from: "A ST", to: "B ST", routeID: 1, direction: "BOTH", lineString: orb.LineString{{0, 0}, {0, 0.01}}, firstPoint: orb.Point{0, 0}, lastPoint: orb.Point{0, 0.01}}
+		s2 = segment{id: 2, name: "TEST LN", streetName: "TEST", from: "B ST", to: "C ST", routeID: 1, direction: "BOTH", lineString: orb.LineString{{0, 0.01}, {0.01, 0.01}}, firstPoint: orb.Point{0, 0.01}, lastPoint: orb.Point{0.01, 0.01}}
+	)
+	st, err := newInMemoryStore([]segment{s1, s2}, []request{{rank: 1, streetName: "Test Ln", from: "A St", to: "C St"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		warning float64
+		want    []int
+	}{
+		{name: "Over", warning: 1.2, want: []int{1}},
+		{name: "Under", warning: 2},
+		{name: "Disabled"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := validateRequests(context.Background(), st, validateOptions{detourWarning: tc.warning})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int
+			for _, d := range v.detours {
+				got = append(got, d.req.rank)
+				if d.ratio < 1.4 || d.ratio > 1.42 {
+					t.Errorf("rank %d detour ratio %.2f, want about 1.41", d.req.rank, d.ratio)
+				}
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("detour ranks mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+	read := func() string {
+		t.Helper()
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if err := writeOutput(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, "first")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got != "first" {
+		t.Errorf("got %q after writing, want first", got)
+	}
+
+	failed := errors.New("failed")
+	if err := writeOutput(path, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return failed
+	}); !errors.Is(err, failed) {
+		t.Errorf("got error %v, want %v", err, failed)
+	}
+	if got := read(); got != "first" {
+		t.Errorf("got %q after failing, want first left in place", got)
+	}
+
+	if err := writeOutput(path, func(w io.Writer) error {
+		io.WriteString(w, "complete")
+		return outputWrittenError{failed}
+	}); !errors.Is(err, failed) {
+		t.Errorf("got error %v, want %v", err, failed)
+	}
+	if got := read(); got != "complete" {
+		t.Errorf("got %q after failing once written, want complete", got)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want only the output and no temporary files", len(entries))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mazznoer/colorgrad"
+	"github.com/twpayne/go-kml"
+)
+
+// exportHeatmap writes one placemark per segment that any resolved
+// request's route passes through, coloured by how many do, the most along
+// the start of the gradient.
+func exportHeatmap(ctx context.Context, st store, w io.Writer, opts exportOptions) error {
+	if opts.gradientSteps < 1 {
+		return fmt.Errorf("gradient steps must be at least 1, got %d", opts.gradientSteps)
+	}
+	if opts.coordPrecision < 0 {
+		return fmt.Errorf("coordinate precision must not be negative, got %d", opts.coordPrecision)
+	}
+
+	reqs, err := st.requests(ctx, opts.requestFilter)
+	if err != nil {
+		return err
+	}
+
+	gradient := opts.gradient
+	if len(gradient) == 0 {
+		gradient = defaultGradient
+	}
+	grad, err := colorgrad.NewGradient().HtmlColors(gradient...).Build()
+	if err != nil {
+		return err
+	}
+	colors := grad.Colors(uint(opts.gradientSteps))
+
+	type segmentDemand struct {
+		seg   segment
+		ranks []string
+	}
+	var (
+		demand = make(map[int]*segmentDemand)
+		failed int
+	)
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		res, err := newDefaultRequestHandler(st, req, opts.handlerOptions).handle(ctx)
+		if err != nil {
+			failed++
+			logRequestError(req, err)
+			continue
+		}
+
+		seen := make(map[int]bool)
+		for _, seg := range res.routeSegments {
+			if seen[seg.id] {
+				continue
+			}
+			seen[seg.id] = true
+			d := demand[seg.id]
+			if d == nil {
+				d = &segmentDemand{seg: seg}
+				demand[seg.id] = d
+			}
+			d.ranks = append(d.ranks, strconv.Itoa(req.rank))
+		}
+	}
+
+	segs := make([]*segmentDemand, 0, len(demand))
+	for _, d := range demand {
+		segs = append(segs, d)
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		if len(segs[i].ranks) != len(segs[j].ranks) {
+			return len(segs[i].ranks) > len(segs[j].ranks)
+		}
+		return segs[i].seg.id < segs[j].seg.id
+	})
+
+	var most int
+	if len(segs) > 0 {
+		most = len(segs[0].ranks)
+	}
+
+	folder := kml.Folder(kml.Name("Requests per segment"))
+	for _, d := range segs {
+		count := len(d.ranks)
+		colorGroup := rankColorGroup(most-count, 0, most-1, len(colors))
+		folder.Add(kml.Placemark(
+			kml.Name(d.seg.String()),
+			kml.Description("Ranks "+strings.Join(d.ranks, ", ")),
+			kml.StyleURL(fmt.Sprintf("#heat-group-%d", colorGroup)),
+			kml.ExtendedData(kmlData("request_count", strconv.Itoa(count))),
+			kml.MultiGeometry(routeLineStrings([]segment{d.seg}, false, opts.coordPrecision)...),
+		))
+	}
+
+	doc := kml.Document()
+	for i, col := range colors {
+		doc.Add(kml.SharedStyle(fmt.Sprintf("heat-group-%d", i), routeLineStyle(col, opts)))
+	}
+	doc.Add(folder)
+	if err := writeKML(w, kml.KML(doc), opts.kmz, opts.pretty); err != nil {
+		return err
+	}
+
+	slog.Info("heatmap export summary", "segments", len(segs), "max_requests", most, "errors", failed)
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/paulmach/orb/geo"
+)
+
+// listLinks prints the segment with the ID in args, followed by the
+// segments travel can leave it for and those it can be entered from, with
+// the distance between the linked ends.
+func listLinks(ctx context.Context, st store, w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("need segment id")
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+
+	segs, err := st.filterSegments(ctx, segmentFilter{ids: []int{id}})
+	if err != nil {
+		return err
+	}
+	if len(segs) == 0 {
+		return fmt.Errorf("no segment found with id %d", id)
+	}
+	seg := segs[0]
+
+	links, err := st.segmentLinks(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	neighbourIDs := []int{}
+	for _, l := range links {
+		for _, nid := range []int{l.exit.id, l.entry.id} {
+			if nid != id && !contains(neighbourIDs, nid) {
+				neighbourIDs = append(neighbourIDs, nid)
+			}
+		}
+	}
+	neighbours := map[int]segment{id: seg}
+	if len(neighbourIDs) > 0 {
+		nsegs, err := st.filterSegments(ctx, segmentFilter{ids: neighbourIDs})
+		if err != nil {
+			return err
+		}
+		for _, ns := range nsegs {
+			neighbours[ns.id] = ns
+		}
+	}
+
+	fmt.Fprintf(w, "%s\ndirection %s, route %d\n", seg, seg.direction, seg.routeID)
+
+	for _, out := range []bool{true, false} {
+		if out {
+			fmt.Fprintln(w, "\nOutgoing:")
+		} else {
+			fmt.Fprintln(w, "\nIncoming:")
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tDIRECTION\tEXIT\tENTRY\tDISTANCE M")
+		for _, l := range links {
+			var other int
+			switch {
+			case out && l.exit.id == id:
+				other = l.entry.id
+			case !out && l.entry.id == id:
+				other = l.exit.id
+			default:
+				continue
+			}
+
+			ns := neighbours[other]
+			dist := geo.Distance(neighbours[l.exit.id].endPoint(l.exit.end), neighbours[l.entry.id].endPoint(l.entry.end))
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%.2f\n", other, ns.name, ns.direction, l.exit.end, l.entry.end, dist)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeSnapReport writes a CSV of every segment link with the distance
+// between the ends it joins, farthest first, and that distance as a
+// fraction of tolerance, the snap tolerance the links were made with.
+// Links near the tolerance may join segments that don't really meet.
+func writeSnapReport(ctx context.Context, st *sqliteStore, w io.Writer, tolerance float64) error {
+	links, err := st.allSegmentLinks(ctx)
+	if err != nil {
+		return err
+	}
+
+	segs, err := st.filterSegments(ctx, segmentFilter{})
+	if err != nil {
+		return err
+	}
+	byID := make(map[int]segment, len(segs))
+	for _, seg := range segs {
+		byID[seg.id] = seg
+	}
+
+	dists := make([]float64, len(links))
+	for i, l := range links {
+		dists[i] = geo.Distance(byID[l.exit.id].endPoint(l.exit.end), byID[l.entry.id].endPoint(l.entry.end))
+	}
+
+	idx := make([]int, len(links))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return dists[idx[a]] > dists[idx[b]] })
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"segment_id", "exit_end", "next_id", "entry_end", "distance_m", "tolerance_fraction"}); err != nil {
+		return err
+	}
+	for _, i := range idx {
+		l := links[i]
+		if err := cw.Write([]string{
+			strconv.Itoa(l.exit.id),
+			l.exit.end,
+			strconv.Itoa(l.entry.id),
+			l.entry.end,
+			strconv.FormatFloat(dists[i], 'f', 3, 64),
+			strconv.FormatFloat(dists[i]/tolerance, 'f', 2, 64),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// segmentGap is a pair of segment ends on the same route that are near
+// each other but too far apart to have been linked.
+type segmentGap struct {
+	routeID  int
+	a, b     segmentEnd
+	distance float64
+}
+
+// findGaps returns the pairs of ends of segs on the same route that are
+// at least snapTolerance but no more than radius metres apart, nearest
+// first. These are likely links missing from the data.
+func findGaps(segs []segment, radius float64) []segmentGap {
+	routeSegments := make(map[int][]segment)
+	for _, seg := range segs {
+		routeSegments[seg.routeID] = append(routeSegments[seg.routeID], seg)
+	}
+
+	var gaps []segmentGap
+	for routeID, rsegs := range routeSegments {
+		for i, a := range rsegs {
+			for _, b := range rsegs[i+1:] {
+				for _, aEnd := range []string{endFirst, endLast} {
+					for _, bEnd := range []string{endFirst, endLast} {
+						d := geo.Distance(a.endPoint(aEnd), b.endPoint(bEnd))
+						if d < snapTolerance || d > radius {
+							continue
+						}
+						gaps = append(gaps, segmentGap{
+							routeID:  routeID,
+							a:        segmentEnd{id: a.id, end: aEnd},
+							b:        segmentEnd{id: b.id, end: bEnd},
+							distance: d,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	sort.Slice(gaps, func(i, j int) bool {
+		if gaps[i].distance != gaps[j].distance {
+			return gaps[i].distance < gaps[j].distance
+		}
+		if gaps[i].a.id != gaps[j].a.id {
+			return gaps[i].a.id < gaps[j].a.id
+		}
+		return gaps[i].b.id < gaps[j].b.id
+	})
+	return gaps
+}
+
+// listGaps prints the likely missing links found by findGaps.
+func listGaps(ctx context.Context, st store, w io.Writer, radius float64) error {
+	if radius < snapTolerance {
+		return fmt.Errorf("radius must be at least the snap tolerance of %g m, got %g", snapTolerance, radius)
+	}
+
+	segs, err := st.filterSegments(ctx, segmentFilter{})
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTE ID\tSEGMENT\tEND\tOTHER\tOTHER END\tDISTANCE M")
+	for _, g := range findGaps(segs, radius) {
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%d\t%s\t%.2f\n", g.routeID, g.a.id, g.a.end, g.b.id, g.b.end, g.distance)
+	}
+	return tw.Flush()
+}
@@ -1,18 +1,34 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"image/color"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/mazznoer/colorgrad"
 	"github.com/paulmach/orb"
@@ -25,920 +41,4638 @@ import (
 
 func main() {
 	var (
-		rootFlagSet  = flag.NewFlagSet("calmmap", flag.ExitOnError)
-		databaseFile = rootFlagSet.String("database-file", "data.db", "database filename")
+		rootFlagSet    = flag.NewFlagSet("calmmap", flag.ExitOnError)
+		databaseFile   = rootFlagSet.String("database-file", "data.db", "database filename, :memory: for an in-memory database")
+		dbMemory       = rootFlagSet.Bool("db-memory", false, "use an in-memory database instead of the database file")
+		logLevel       = rootFlagSet.String("log-level", "info", "log level: debug, info, warn or error")
+		logFormat      = rootFlagSet.String("log-format", "text", "log format: text or json")
+		maxExplored    = rootFlagSet.Int("max-explored", defaultMaxExplored, "maximum segment ends a route search may explore before failing")
+		avoidClasses   = rootFlagSet.String("avoid-classes", "", "comma-separated street classes, such as ARTERIAL, that routes may start or end on but not pass through")
+		fuzzyThreshold = rootFlagSet.Float64("fuzzy-threshold", defaultFuzzyThreshold, "minimum similarity, from 0 to 1, a street name must have for --fuzzy to use it in place of one matching no segments")
+		noColor        = rootFlagSet.Bool("no-color", false, "draw without color; also the default when NO_COLOR is set or stdout isn't a terminal")
 
 		buildDBFlagSet     = flag.NewFlagSet("calmmap builddb", flag.ExitOnError)
-		centerlinesKMLFile = buildDBFlagSet.String("centerlines-kml-file", "street_centrelines.kml", "street centerlines KML file")
-		calmingRequestFile = buildDBFlagSet.String("calming-requests-file", "street-calming-ranked-2020-11.tsv", "calming requests TSV file")
+		centerlinesKMLFile = buildDBFlagSet.String("centerlines-kml-file", "street_centrelines.kml", "street centerlines KML or KMZ file, - for stdin")
+		calmingRequestFile = buildDBFlagSet.String("calming-requests-file", "street-calming-ranked-2020-11.tsv", "calming requests TSV file, - for stdin, or an http(s) URL such as a published Google Sheets CSV")
+		fetchTimeout       = buildDBFlagSet.Duration("timeout", 30*time.Second, "maximum time to fetch inputs given as http(s) URLs")
+		fromSentinels      = buildDBFlagSet.String("from-sentinels", strings.Join(defaultFromSentinels, ","), "comma-separated words in the from column meaning the start of the street")
+		toSentinels        = buildDBFlagSet.String("to-sentinels", strings.Join(defaultToSentinels, ","), "comma-separated words in the to column meaning the end of the street")
+		dedupeSegments     = buildDBFlagSet.Bool("dedupe-segments", false, "drop segments with the same ID or geometry as an earlier one, rather than only reporting them")
+		snapReportFile     = buildDBFlagSet.String("snap-report", "", "if set, write a CSV of each segment link and the distance between its ends to this file")
+		buildSnapTolerance = buildDBFlagSet.Float64("snap-tolerance", snapTolerance, "how close, in metres, segment ends must be to link")
+		skipErrors         = buildDBFlagSet.Bool("skip-errors", false, "skip placemarks and rows that can't be read, reporting them at the end, rather than failing")
+		kmlFieldNames      = buildDBFlagSet.String("kml-fields", "", "comma-separated field=NAME pairs naming the centreline KML's SimpleData for fields differing from Halifax's, such as id=OBJECTID; fields are "+strings.Join(kmlFieldKeys, ", "))
+
+		runFlagSet            = flag.NewFlagSet("calmmap run", flag.ExitOnError)
+		runDBMemory           = runFlagSet.Bool("db-memory", false, "build into an in-memory database instead of the database file, as the root --db-memory does")
+		runCenterlinesKMLFile = runFlagSet.String("centerlines-kml-file", "street_centrelines.kml", "street centerlines KML or KMZ file, - for stdin")
+		runCalmingRequestFile = runFlagSet.String("calming-requests-file", "street-calming-ranked-2020-11.tsv", "calming requests TSV file, - for stdin, or an http(s) URL such as a published Google Sheets CSV")
+		runFetchTimeout       = runFlagSet.Duration("timeout", 30*time.Second, "maximum time to fetch inputs given as http(s) URLs")
+		runFromSentinels      = runFlagSet.String("from-sentinels", strings.Join(defaultFromSentinels, ","), "comma-separated words in the from column meaning the start of the street")
+		runToSentinels        = runFlagSet.String("to-sentinels", strings.Join(defaultToSentinels, ","), "comma-separated words in the to column meaning the end of the street")
+		runSnapTolerance      = runFlagSet.Float64("snap-tolerance", snapTolerance, "how close, in metres, segment ends must be to link")
+		runDedupeSegments     = runFlagSet.Bool("dedupe-segments", false, "drop segments with the same ID or geometry as an earlier one, rather than only reporting them")
+		runSkipErrors         = runFlagSet.Bool("skip-errors", false, "skip placemarks and rows that can't be read, reporting them at the end, rather than failing")
+		runKMLFieldNames      = runFlagSet.String("kml-fields", "", "comma-separated field=NAME pairs naming the centreline KML's SimpleData for fields differing from Halifax's, such as id=OBJECTID; fields are "+strings.Join(kmlFieldKeys, ", "))
+
+		relinkFlagSet       = flag.NewFlagSet("calmmap relink", flag.ExitOnError)
+		relinkSnapTolerance = relinkFlagSet.Float64("snap-tolerance", snapTolerance, "how close, in metres, segment ends must be to link")
+
+		migrateFlagSet   = flag.NewFlagSet("calmmap migrate", flag.ExitOnError)
+		migrateOverrides = migrateFlagSet.Bool("overrides", false, "also rename override files named by rank to use stable request IDs, using the ranks in this database")
+
+		fixupFlagSet       = flag.NewFlagSet("calmmap fixup", flag.ExitOnError)
+		fixupWholeStreet   = fixupFlagSet.Bool("whole-street", false, "only include whole-street requests")
+		fixupNoWholeStreet = fixupFlagSet.Bool("no-whole-street", false, "only include requests bounded by cross streets")
+		fixupRankMin       = fixupFlagSet.Int("rank-min", 0, "only include requests ranked at least this, 0 for no minimum")
+		fixupRankMax       = fixupFlagSet.Int("rank-max", 0, "only include requests ranked at most this, 0 for no maximum")
+		fixupDistrict      = fixupFlagSet.String("district", "", "only include requests in this district")
+		fixupHandler       = handlerFlags(fixupFlagSet, fuzzyThreshold)
+		fixupWatch         = fixupFlagSet.Bool("watch", false, "refresh requests when their override files change, such as from an external editor")
+		fixupWatchInterval = fixupFlagSet.Duration("watch-interval", 500*time.Millisecond, "how often --watch checks override files for changes")
+
+		applyOverridesFlagSet = flag.NewFlagSet("calmmap applyoverrides", flag.ExitOnError)
+
+		explainFlagSet    = flag.NewFlagSet("calmmap explain", flag.ExitOnError)
+		explainOutputFile = explainFlagSet.String("output", "-", "output filename, - for stdout")
+		explainHandler    = handlerFlags(explainFlagSet, fuzzyThreshold)
+
+		diffFlagSet    = flag.NewFlagSet("calmmap diff", flag.ExitOnError)
+		diffOutputFile = diffFlagSet.String("output", "-", "output filename, - for stdout")
+		diffHandler    = handlerFlags(diffFlagSet, fuzzyThreshold)
+
+		topFlagSet    = flag.NewFlagSet("calmmap top", flag.ExitOnError)
+		topOutputFile = topFlagSet.String("output", "-", "output filename, - for stdout")
+		topBy         = topFlagSet.String("by", "length", "what to rank requests by: length")
+		topN          = topFlagSet.Int("n", 20, "number of requests to print")
+		topShortest   = topFlagSet.Bool("shortest", false, "print the shortest requests rather than the longest")
+		topHandler    = handlerFlags(topFlagSet, fuzzyThreshold)
+
+		fuzzyMatchesFlagSet    = flag.NewFlagSet("calmmap fuzzymatches", flag.ExitOnError)
+		fuzzyMatchesOutputFile = fuzzyMatchesFlagSet.String("output", "-", "output filename, - for stdout")
+		fuzzyMatchesHandler    = handlerFlags(fuzzyMatchesFlagSet, fuzzyThreshold)
+
+		geocheckFlagSet     = flag.NewFlagSet("calmmap geocheck", flag.ExitOnError)
+		geocheckOutputFile  = geocheckFlagSet.String("output", "-", "output filename, - for stdout")
+		geocheckNominatim   = geocheckFlagSet.String("nominatim-url", "https://nominatim.openstreetmap.org", "base URL of the Nominatim service to geocode with")
+		geocheckArea        = geocheckFlagSet.String("area", "Halifax, Nova Scotia", "place appended to each geocoding query to narrow it")
+		geocheckMaxDistance = geocheckFlagSet.Float64("max-distance", 200, "flag route ends more than this many metres from their geocoded cross street")
+		geocheckInterval    = geocheckFlagSet.Duration("interval", time.Second, "minimum time between geocoding requests")
+		geocheckDistrict    = geocheckFlagSet.String("district", "", "only check requests in this district")
+		geocheckHandler     = handlerFlags(geocheckFlagSet, fuzzyThreshold)
+
+		segmentsFlagSet    = flag.NewFlagSet("calmmap segments", flag.ExitOnError)
+		segmentsOutputFile = segmentsFlagSet.String("output", "-", "output filename, - for stdout")
+		segmentsFormat     = segmentsFlagSet.String("format", "table", "output format: table, or wkt for one line of ID and geometry per segment")
+
+		completeFlagSet    = flag.NewFlagSet("calmmap complete", flag.ExitOnError)
+		completeOutputFile = completeFlagSet.String("output", "-", "output filename, - for stdout")
+
+		linksFlagSet    = flag.NewFlagSet("calmmap links", flag.ExitOnError)
+		linksOutputFile = linksFlagSet.String("output", "-", "output filename, - for stdout")
+
+		touchingFlagSet    = flag.NewFlagSet("calmmap touching", flag.ExitOnError)
+		touchingOutputFile = touchingFlagSet.String("output", "-", "output filename, - for stdout")
+		touchingHandler    = handlerFlags(touchingFlagSet, fuzzyThreshold)
+
+		validateFlagSet       = flag.NewFlagSet("calmmap validate", flag.ExitOnError)
+		validateOutputFile    = validateFlagSet.String("output", "-", "output filename, - for stdout")
+		validateWholeStreet   = validateFlagSet.Bool("whole-street", false, "only include whole-street requests")
+		validateNoWholeStreet = validateFlagSet.Bool("no-whole-street", false, "only include requests bounded by cross streets")
+		validateRankMin       = validateFlagSet.Int("rank-min", 0, "only include requests ranked at least this, 0 for no minimum")
+		validateRankMax       = validateFlagSet.Int("rank-max", 0, "only include requests ranked at most this, 0 for no maximum")
+		validateRequireRanks  = intListFlag(validateFlagSet, "require-rank", "exit with an error, after printing the report, if the request with this rank fails to resolve or isn't selected; repeatable or comma-separated")
+		validateDetourWarning = validateFlagSet.Float64("detour-warning", 2, "report routes longer than this multiple of the straight-line distance between their ends, 0 to disable")
+		validateHandler       = handlerFlags(validateFlagSet, fuzzyThreshold)
+
+		gapsFlagSet    = flag.NewFlagSet("calmmap gaps", flag.ExitOnError)
+		gapsOutputFile = gapsFlagSet.String("output", "-", "output filename, - for stdout")
+		gapsRadius     = gapsFlagSet.Float64("radius", 10, "report unlinked segment ends on the same route up to this many metres apart")
+
+		routeVizFlagSet    = flag.NewFlagSet("calmmap routeviz", flag.ExitOnError)
+		routeVizOutputFile = routeVizFlagSet.String("output", "-", "output filename, - for stdout")
+		routeVizFrom       = routeVizFlagSet.Int("from", 0, "segment id to center the graph on, with --max-depth")
+		routeVizMaxDepth   = routeVizFlagSet.Int("max-depth", 0, "only include segments within this many links of --from, 0 for no limit")
+		routeVizRequest    = routeVizFlagSet.Int("request", 0, "if set, graph the route of the request with this rank, highlighting its resolved path")
+		routeVizHandler    = handlerFlags(routeVizFlagSet, fuzzyThreshold)
+
+		exportFlagSet       = flag.NewFlagSet("calmmap export", flag.ExitOnError)
+		exportOutputFile    = exportFlagSet.String("output", "-", "output filename, - for stdout")
+		exportMergeSegments = exportFlagSet.Bool("merge-segments", false, "merge touching route segments into continuous lines")
+		exportWholeStreet   = exportFlagSet.Bool("whole-street", false, "only include whole-street requests")
+		exportNoWholeStreet = exportFlagSet.Bool("no-whole-street", false, "only include requests bounded by cross streets")
+		exportRankMin       = exportFlagSet.Int("rank-min", 0, "only include requests ranked at least this, 0 for no minimum")
+		exportRankMax       = exportFlagSet.Int("rank-max", 0, "only include requests ranked at most this, 0 for no maximum")
+		exportDistrict      = exportFlagSet.String("district", "", "only include requests in this district")
+		exportKMZ           = exportFlagSet.Bool("kmz", false, "write compressed KMZ instead of KML")
+		exportPretty        = exportFlagSet.Bool("pretty", true, "indent output for reading, false for compact output")
+		exportHandler       = handlerFlags(exportFlagSet, fuzzyThreshold)
+		exportGradient      = exportFlagSet.String("gradient", strings.Join(defaultGradient, ","), "comma-separated HTML colors for the rank gradient")
+		exportGradientSteps = exportFlagSet.Int("gradient-steps", 20, "number of colors to take from the rank gradient")
+		exportLineWidth     = exportFlagSet.Float64("line-width", defaultLineWidth, "width of route lines in pixels")
+		exportLineOpacity   = exportFlagSet.Float64("line-opacity", 1, "opacity of route lines, from 0 for transparent to 1 for opaque")
+		exportIncludeErrors = exportFlagSet.Bool("include-errors", false, "include unresolved requests in a separate folder")
+		exportRouteID       = exportFlagSet.Int("route-id", 0, "only include requests on this route, along with all of its segments")
+		exportOrderBy       = exportFlagSet.String("order-by", "rank", "order requests for colouring and rank limits by weighted terms, such as rank=0.7,length=0.3; terms are rank, length and class")
+		exportMaxFailures   = exportFlagSet.Float64("max-failures", 1, "exit with an error if more than this fraction of requests fail to resolve")
+		exportRequireRanks  = intListFlag(exportFlagSet, "require-rank", "exit with an error if the request with this rank isn't exported, because it failed to resolve or wasn't selected, whatever --max-failures allows; repeatable or comma-separated; KML and --split output only")
+		exportPrecision     = exportFlagSet.Int("coord-precision", 6, "decimal places to round KML coordinates to, 0 for full precision")
+		exportArrows        = exportFlagSet.Bool("arrows", false, "add arrows showing the direction of travel along each route")
+		exportEndpoints     = exportFlagSet.Bool("endpoints", false, "add markers at the start and end of each route, named by cross street")
+		exportSegmentLabels = exportFlagSet.Bool("segment-labels", false, "add a label at the middle of each route segment naming the cross streets it runs between")
+		exportDedupeRoutes  = exportFlagSet.Bool("dedupe-routes", false, "merge requests resolving to the same segments into one placemark, listing them in its description")
+		exportYearField     = exportFlagSet.String("year-field", "", "if set, requests file column giving the year a request is planned for, which starts a time span on its placemarks for Google Earth's time slider")
+		exportExtraData     = exportFlagSet.Bool("extra-data", false, "include the requests file's other columns, such as notes, in each placemark's extended data")
+		exportHeatmapOutput = exportFlagSet.Bool("heatmap", false, "write one placemark per segment on any route, coloured by how many requests' routes pass through it")
+		exportPerStreet     = exportFlagSet.Bool("by-street", false, "write one placemark per street, merging the routes of all its requests")
+		exportNDJSONOutput  = exportFlagSet.Bool("ndjson", false, "write newline-delimited GeoJSON features, one per request route, for tippecanoe, instead of KML")
+		exportFormat        = exportFlagSet.String("format", "kml", "output format: kml, or mvt for the single Mapbox Vector Tile given by --tile, for debugging tile rendering")
+		exportTile          = exportFlagSet.String("tile", "", "tile to write with --format=mvt, as z/x/y")
+		exportSplit         = exportFlagSet.String("split", "", "if set, write each request to its own file in this directory, named by rank, instead of to output")
+		exportResume        = exportFlagSet.Bool("resume", false, "with --split, don't rewrite requests whose file already exists")
+		exportDelta         = exportFlagSet.Bool("override-delta", false, "only write requests whose overrides change their route, with the routes before and after overrides in separate folders")
+		exportGroupBy       = exportFlagSet.String("group-by", "district", "group placemarks into a folder per district, or none for one flat folder")
+		exportCRS           = exportFlagSet.String("crs", "4326", "with --ndjson, EPSG code of the coordinate system to write: 4326 for lon/lat, 3857, or a WGS 84 UTM zone such as 32620")
+
+		exportGPKGFlagSet       = flag.NewFlagSet("calmmap exportgpkg", flag.ExitOnError)
+		exportGPKGOutputFile    = exportGPKGFlagSet.String("output", "calmmap.gpkg", "output GeoPackage filename, replaced if it exists")
+		exportGPKGNetwork       = exportGPKGFlagSet.Bool("network", false, "include a layer with the full street network")
+		exportGPKGWholeStreet   = exportGPKGFlagSet.Bool("whole-street", false, "only include whole-street requests")
+		exportGPKGNoWholeStreet = exportGPKGFlagSet.Bool("no-whole-street", false, "only include requests bounded by cross streets")
+		exportGPKGDistrict      = exportGPKGFlagSet.String("district", "", "only include requests in this district")
+		exportGPKGHandler       = handlerFlags(exportGPKGFlagSet, fuzzyThreshold)
+		exportGPKGCRS           = exportGPKGFlagSet.String("crs", "4326", "EPSG code of the coordinate system to write: 4326 for lon/lat, 3857, or a WGS 84 UTM zone such as 32620")
+
+		exportTopoJSONFlagSet       = flag.NewFlagSet("calmmap exporttopojson", flag.ExitOnError)
+		exportTopoJSONOutputFile    = exportTopoJSONFlagSet.String("output", "-", "output filename, - for stdout")
+		exportTopoJSONQuantization  = exportTopoJSONFlagSet.Int("quantization", 100000, "number of positions along each axis to round coordinates to, 0 for unrounded")
+		exportTopoJSONPretty        = exportTopoJSONFlagSet.Bool("pretty", false, "indent output for reading")
+		exportTopoJSONWholeStreet   = exportTopoJSONFlagSet.Bool("whole-street", false, "only include whole-street requests")
+		exportTopoJSONNoWholeStreet = exportTopoJSONFlagSet.Bool("no-whole-street", false, "only include requests bounded by cross streets")
+		exportTopoJSONDistrict      = exportTopoJSONFlagSet.String("district", "", "only include requests in this district")
+		exportTopoJSONHandler       = handlerFlags(exportTopoJSONFlagSet, fuzzyThreshold)
+
+		networkFlagSet    = flag.NewFlagSet("calmmap network", flag.ExitOnError)
+		networkOutputFile = networkFlagSet.String("output", "-", "output filename, - for stdout")
+		networkPretty     = networkFlagSet.Bool("pretty", true, "indent output for reading, false for compact output")
+		networkCRS        = networkFlagSet.String("crs", "4326", "EPSG code of the coordinate system to write: 4326 for lon/lat, 3857, or a WGS 84 UTM zone such as 32620")
+
+		exportCSVFlagSet       = flag.NewFlagSet("calmmap exportcsv", flag.ExitOnError)
+		exportCSVOutputFile    = exportCSVFlagSet.String("output", "-", "output filename, - for stdout")
+		exportCSVTSV           = exportCSVFlagSet.Bool("tsv", false, "write tab-separated instead of comma-separated values")
+		exportCSVWholeStreet   = exportCSVFlagSet.Bool("whole-street", false, "only include whole-street requests")
+		exportCSVNoWholeStreet = exportCSVFlagSet.Bool("no-whole-street", false, "only include requests bounded by cross streets")
+		exportCSVDistrict      = exportCSVFlagSet.String("district", "", "only include requests in this district")
+		exportCSVHandler       = handlerFlags(exportCSVFlagSet, fuzzyThreshold)
 	)
 
+	// runDB is the database built by run, shared with the command it runs.
+	var runDB *sql.DB
+
 	withSqliteStore := func(inner func(context.Context, *sqliteStore, []string) error) func(context.Context, []string) error {
 		return (func(ctx context.Context, args []string) error {
-			db, err := sql.Open("sqlite", *databaseFile)
-			if err != nil {
-				return err
+			db := runDB
+			if db == nil {
+				var err error
+				db, err = openDB(*databaseFile, *dbMemory)
+				if err != nil {
+					return err
+				}
+				defer db.Close()
 			}
-			defer db.Close()
 
-			st := &sqliteStore{db: db}
+			st := &sqliteStore{db: db, maxExplored: *maxExplored, avoidClasses: splitList(*avoidClasses)}
 			return inner(ctx, st, args)
 		})
 	}
 
 	withStore := func(inner func(context.Context, store, []string) error) func(context.Context, []string) error {
 		return withSqliteStore(func(ctx context.Context, st *sqliteStore, args []string) error {
+			if err := st.checkSchema(); err != nil {
+				return fmt.Errorf("%s: %w", *databaseFile, err)
+			}
+			if err := st.migrate(ctx); err != nil {
+				return fmt.Errorf("%s: %w", *databaseFile, err)
+			}
 			return inner(ctx, st, args)
 		})
 	}
 
+	withOutput := func(outputFile *string, inner func(context.Context, store, io.Writer, []string) error) func(context.Context, []string) error {
+		return withStore(func(ctx context.Context, st store, args []string) error {
+			return writeOutput(*outputFile, func(w io.Writer) error {
+				return inner(ctx, st, w, args)
+			})
+		})
+	}
+
 	cmdBuildDB := &ffcli.Command{
 		Name:      "builddb",
 		ShortHelp: "build database from centreline and request data",
-		Exec: withSqliteStore(func(_ context.Context, st *sqliteStore, _ []string) error {
-			if err := st.init(); err != nil {
+		FlagSet:   buildDBFlagSet,
+		Exec: withSqliteStore(func(ctx context.Context, st *sqliteStore, _ []string) error {
+			fields, err := parseKMLFields(*kmlFieldNames)
+			if err != nil {
 				return err
 			}
 
-			kf, err := os.Open(*centerlinesKMLFile)
-			if err != nil {
+			if *buildSnapTolerance <= 0 {
+				return fmt.Errorf("--snap-tolerance must be positive, got %g", *buildSnapTolerance)
+			}
+			st.dropDuplicates, st.snapTolerance = *dedupeSegments, *buildSnapTolerance
+			if err := st.init(); err != nil {
 				return err
 			}
-			defer kf.Close()
 
-			rf, err := os.Open(*calmingRequestFile)
-			if err != nil {
+			if err := buildDB(ctx, st, *centerlinesKMLFile, *calmingRequestFile, buildOptions{
+				kml: kmlOptions{skipErrors: *skipErrors, fields: fields},
+				tsv: tsvOptions{
+					fromSentinels: strings.Split(*fromSentinels, ","),
+					toSentinels:   strings.Split(*toSentinels, ","),
+					skipErrors:    *skipErrors,
+				},
+				fetchTimeout: *fetchTimeout,
+			}); err != nil {
 				return err
 			}
-			defer rf.Close()
 
-			if err := loadKMLSegments(st, kf); err != nil {
+			if *snapReportFile == "" {
+				return nil
+			}
+			return writeOutput(*snapReportFile, func(w io.Writer) error {
+				return writeSnapReport(ctx, st, w, st.linkTolerance())
+			})
+		}),
+	}
+
+	cmdVersion := &ffcli.Command{
+		Name:      "version",
+		ShortHelp: "print the version and the input file hashes the database was built from",
+		Exec: withSqliteStore(func(_ context.Context, st *sqliteStore, _ []string) error {
+			return printVersion(st, os.Stdout)
+		}),
+	}
+
+	cmdRelink := &ffcli.Command{
+		Name:      "relink",
+		ShortHelp: "rebuild the links between segments from the segments already in the database",
+		FlagSet:   relinkFlagSet,
+		Exec: withSqliteStore(func(ctx context.Context, st *sqliteStore, _ []string) error {
+			if err := st.relink(ctx, *relinkSnapTolerance); err != nil {
 				return err
 			}
+			return verifySegmentLinks(ctx, st)
+		}),
+	}
 
-			return loadTSVRequests(st, rf)
+	cmdMigrate := &ffcli.Command{
+		Name:      "migrate",
+		ShortHelp: "upgrade a database built by an older version",
+		FlagSet:   migrateFlagSet,
+		Exec: withSqliteStore(func(ctx context.Context, st *sqliteStore, _ []string) error {
+			if err := st.migrate(ctx); err != nil {
+				return err
+			}
+			if *migrateOverrides {
+				return migrateOverrideFiles(ctx, st)
+			}
+			return nil
 		}),
 	}
 
 	cmdFixup := &ffcli.Command{
 		Name:      "fixup",
 		ShortHelp: "run interactive validation tool",
-		Exec:      withStore(fixup),
+		LongHelp:  fixupKeyHelp,
+		FlagSet:   fixupFlagSet,
+		Exec: withStore(func(ctx context.Context, st store, args []string) error {
+			filter, err := newRequestFilter(*fixupWholeStreet, *fixupNoWholeStreet)
+			if err != nil {
+				return err
+			}
+			filter.rankMin, filter.rankMax = *fixupRankMin, *fixupRankMax
+			filter.district = *fixupDistrict
+			if *fixupWatch && *fixupWatchInterval <= 0 {
+				return fmt.Errorf("--watch-interval must be positive")
+			}
+			opts := fixupOptions{
+				requestFilter:  filter,
+				handlerOptions: fixupHandler(),
+				noColor:        !useColor(*noColor, os.Stdout),
+				watch:          *fixupWatch,
+				watchInterval:  *fixupWatchInterval,
+			}
+			return fixup(ctx, st, opts, args)
+		}),
+	}
+
+	cmdGeocheck := &ffcli.Command{
+		Name:      "geocheck",
+		ShortHelp: "geocode requests' cross streets and flag routes that end far from them",
+		LongHelp:  "Queries an external Nominatim service, by default the public one, once per cross street.",
+		FlagSet:   geocheckFlagSet,
+		Exec: withOutput(geocheckOutputFile, func(ctx context.Context, st store, w io.Writer, _ []string) error {
+			gc := &nominatimGeocoder{
+				client:    &http.Client{Timeout: 30 * time.Second},
+				baseURL:   strings.TrimSuffix(*geocheckNominatim, "/"),
+				userAgent: "calmmap (https://github.com/danp/calmmap)",
+				interval:  *geocheckInterval,
+			}
+			opts := geocheckOptions{
+				requestFilter:  requestFilter{district: *geocheckDistrict},
+				handlerOptions: geocheckHandler(),
+				area:           *geocheckArea,
+				maxDistance:    *geocheckMaxDistance,
+			}
+			return geocheck(ctx, st, gc, w, opts)
+		}),
+	}
+
+	cmdFuzzyMatches := &ffcli.Command{
+		Name:      "fuzzymatches",
+		ShortHelp: "list requests whose street matches no segments, with the most similar street name and whether --fuzzy resolves them with it",
+		FlagSet:   fuzzyMatchesFlagSet,
+		Exec: withOutput(fuzzyMatchesOutputFile, func(ctx context.Context, st store, w io.Writer, _ []string) error {
+			opts := fuzzyMatchesHandler()
+			opts.fuzzy = true
+			return printFuzzyMatches(ctx, st, w, opts)
+		}),
+	}
+
+	cmdTop := &ffcli.Command{
+		Name:      "top",
+		ShortHelp: "print the requests with the longest or shortest resolved routes",
+		FlagSet:   topFlagSet,
+		Exec: withOutput(topOutputFile, func(ctx context.Context, st store, w io.Writer, _ []string) error {
+			opts := topOptions{
+				handlerOptions: topHandler(),
+				by:             *topBy,
+				n:              *topN,
+				shortest:       *topShortest,
+			}
+			return printTop(ctx, st, w, opts)
+		}),
+	}
+
+	cmdDiff := &ffcli.Command{
+		Name:       "diff",
+		ShortUsage: "calmmap diff [flags] <old.db> <new.db>",
+		ShortHelp:  "report requests whose resolved route differs between two databases",
+		FlagSet:    diffFlagSet,
+		Exec: func(ctx context.Context, args []string) error {
+			opts := diffHandler()
+			return writeOutput(*diffOutputFile, func(w io.Writer) error {
+				return diffDatabases(ctx, w, opts, sqliteStore{maxExplored: *maxExplored, avoidClasses: splitList(*avoidClasses)}, args)
+			})
+		},
+	}
+
+	cmdSegments := &ffcli.Command{
+		Name:       "segments",
+		ShortUsage: "calmmap segments [flags] <street name>",
+		ShortHelp:  "list segments for a street name",
+		FlagSet:    segmentsFlagSet,
+		Exec: withOutput(segmentsOutputFile, func(ctx context.Context, st store, w io.Writer, args []string) error {
+			return listSegments(ctx, st, w, *segmentsFormat, args)
+		}),
+	}
+
+	cmdComplete := &ffcli.Command{
+		Name:       "complete",
+		ShortUsage: "calmmap complete [flags] <street prefix>",
+		ShortHelp:  "list street names starting with a prefix, for shell completion",
+		FlagSet:    completeFlagSet,
+		Exec:       withOutput(completeOutputFile, completeStreetNames),
+	}
+
+	cmdApplyOverrides := &ffcli.Command{
+		Name:       "applyoverrides",
+		ShortUsage: "calmmap applyoverrides [flags] <corrections.csv>",
+		ShortHelp:  "write override files from CSV rows of rank, stage and segment ids",
+		FlagSet:    applyOverridesFlagSet,
+		Exec: withStore(func(ctx context.Context, st store, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("need corrections CSV file")
+			}
+			f, err := openInput(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return applyOverrides(ctx, st, f)
+		}),
+	}
+
+	cmdExplain := &ffcli.Command{
+		Name:       "explain",
+		ShortUsage: "calmmap explain [flags] <rank>",
+		ShortHelp:  "trace each step of resolving a request",
+		FlagSet:    explainFlagSet,
+		Exec: withOutput(explainOutputFile, func(ctx context.Context, st store, w io.Writer, args []string) error {
+			opts := explainHandler()
+			return explainRequest(ctx, st, w, opts, args)
+		}),
+	}
+
+	cmdLinks := &ffcli.Command{
+		Name:       "links",
+		ShortUsage: "calmmap links [flags] <segment id>",
+		ShortHelp:  "list the segments a segment links to and from",
+		FlagSet:    linksFlagSet,
+		Exec:       withOutput(linksOutputFile, listLinks),
+	}
+
+	cmdTouching := &ffcli.Command{
+		Name:       "touching",
+		ShortUsage: "calmmap touching [flags] <segment id>",
+		ShortHelp:  "list the requests whose resolved routes include a segment",
+		FlagSet:    touchingFlagSet,
+		Exec: withOutput(touchingOutputFile, func(ctx context.Context, st store, w io.Writer, args []string) error {
+			opts := touchingHandler()
+			return printTouching(ctx, st, w, args, opts)
+		}),
+	}
+
+	cmdValidate := &ffcli.Command{
+		Name:      "validate",
+		ShortHelp: "list requests whose start or end segments aren't on the request's street, which usually means a bad source row, and routes that detour or backtrack",
+		FlagSet:   validateFlagSet,
+		Exec: withOutput(validateOutputFile, func(ctx context.Context, st store, w io.Writer, _ []string) error {
+			filter, err := newRequestFilter(*validateWholeStreet, *validateNoWholeStreet)
+			if err != nil {
+				return err
+			}
+			filter.rankMin, filter.rankMax = *validateRankMin, *validateRankMax
+			opts := validateOptions{
+				requestFilter:  filter,
+				handlerOptions: validateHandler(),
+				detourWarning:  *validateDetourWarning,
+				requireRanks:   *validateRequireRanks,
+			}
+			return printValidate(ctx, st, w, opts)
+		}),
+	}
+
+	cmdGaps := &ffcli.Command{
+		Name:      "gaps",
+		ShortHelp: "list nearby but unlinked segment ends, nearest first, which may be missing links",
+		FlagSet:   gapsFlagSet,
+		Exec: withOutput(gapsOutputFile, func(ctx context.Context, st store, w io.Writer, _ []string) error {
+			return listGaps(ctx, st, w, *gapsRadius)
+		}),
 	}
 
 	cmdRouteViz := &ffcli.Command{
 		Name:      "routeviz",
 		ShortHelp: "generate dot graph for a route id",
-		Exec:      withStore(routeViz),
+		FlagSet:   routeVizFlagSet,
+		Exec: withOutput(routeVizOutputFile, func(ctx context.Context, st store, w io.Writer, args []string) error {
+			opts := routeVizOptions{
+				from:           *routeVizFrom,
+				maxDepth:       *routeVizMaxDepth,
+				request:        *routeVizRequest,
+				handlerOptions: routeVizHandler(),
+			}
+			return routeViz(ctx, st, w, opts, args)
+		}),
 	}
 
 	cmdExport := &ffcli.Command{
 		Name:      "export",
 		ShortHelp: "export map KML for requests",
-		Exec:      withStore(export),
+		FlagSet:   exportFlagSet,
+		Exec: withOutput(exportOutputFile, func(ctx context.Context, st store, w io.Writer, args []string) error {
+			filter, err := newRequestFilter(*exportWholeStreet, *exportNoWholeStreet)
+			if err != nil {
+				return err
+			}
+			filter.rankMin, filter.rankMax = *exportRankMin, *exportRankMax
+			filter.district = *exportDistrict
+			opts := exportOptions{
+				requestFilter:  filter,
+				handlerOptions: exportHandler(),
+				mergeSegments:  *exportMergeSegments,
+				kmz:            *exportKMZ,
+				pretty:         *exportPretty,
+				gradient:       strings.Split(*exportGradient, ","),
+				gradientSteps:  *exportGradientSteps,
+				lineWidth:      *exportLineWidth,
+				lineOpacity:    exportLineOpacity,
+				includeErrors:  *exportIncludeErrors,
+				arrows:         *exportArrows,
+				endpoints:      *exportEndpoints,
+				segmentLabels:  *exportSegmentLabels,
+				extraData:      *exportExtraData,
+				yearField:      *exportYearField,
+				dedupeRoutes:   *exportDedupeRoutes,
+				routeID:        *exportRouteID,
+				orderBy:        *exportOrderBy,
+				maxFailures:    *exportMaxFailures,
+				requireRanks:   *exportRequireRanks,
+				coordPrecision: *exportPrecision,
+				groupBy:        *exportGroupBy,
+			}
+			if opts.crs, err = parseCRS(*exportCRS); err != nil {
+				return err
+			}
+			if opts.crs.epsg != wgs84.epsg && !*exportNDJSONOutput {
+				return fmt.Errorf("--crs only applies to --ndjson output, KML is always lon/lat")
+			}
+			switch *exportFormat {
+			case "kml", "mvt":
+			default:
+				return fmt.Errorf("unknown format %q, want kml or mvt", *exportFormat)
+			}
+			mode, err := exportMode(map[string]bool{
+				"--format=mvt":     *exportFormat == "mvt",
+				"--split":          *exportSplit != "",
+				"--ndjson":         *exportNDJSONOutput,
+				"--override-delta": *exportDelta,
+				"--heatmap":        *exportHeatmapOutput,
+				"--by-street":      *exportPerStreet,
+			})
+			if err != nil {
+				return err
+			}
+			if why, ok := requireRankUnsupported[mode]; ok && len(opts.requireRanks) > 0 {
+				return fmt.Errorf("--require-rank doesn't apply to %s output: %s", mode, why)
+			}
+			switch mode {
+			case "--format=mvt":
+				tile, err := parseTile(*exportTile)
+				if err != nil {
+					return err
+				}
+				return exportMVT(ctx, st, w, opts, tile)
+			case "--split":
+				return exportSplitFiles(ctx, st, *exportSplit, opts, *exportResume)
+			case "--ndjson":
+				return exportNDJSON(ctx, st, w, opts)
+			case "--override-delta":
+				return exportOverrideDelta(ctx, st, w, opts)
+			case "--heatmap":
+				return exportHeatmap(ctx, st, w, opts)
+			case "--by-street":
+				return exportByStreet(ctx, st, w, opts)
+			}
+			return export(ctx, st, w, opts, args)
+		}),
+	}
+
+	cmdExportCSV := &ffcli.Command{
+		Name:      "exportcsv",
+		ShortHelp: "export resolved route segments for requests as CSV",
+		FlagSet:   exportCSVFlagSet,
+		Exec: withOutput(exportCSVOutputFile, func(ctx context.Context, st store, w io.Writer, args []string) error {
+			filter, err := newRequestFilter(*exportCSVWholeStreet, *exportCSVNoWholeStreet)
+			if err != nil {
+				return err
+			}
+			filter.district = *exportCSVDistrict
+			opts := exportCSVOptions{
+				requestFilter:  filter,
+				handlerOptions: exportCSVHandler(),
+				tsv:            *exportCSVTSV,
+			}
+			return exportCSV(ctx, st, w, opts, args)
+		}),
+	}
+
+	cmdExportGPKG := &ffcli.Command{
+		Name:      "exportgpkg",
+		ShortHelp: "export resolved request routes as a GeoPackage",
+		FlagSet:   exportGPKGFlagSet,
+		Exec: withStore(func(ctx context.Context, st store, args []string) error {
+			filter, err := newRequestFilter(*exportGPKGWholeStreet, *exportGPKGNoWholeStreet)
+			if err != nil {
+				return err
+			}
+			filter.district = *exportGPKGDistrict
+			opts := exportGPKGOptions{
+				requestFilter:  filter,
+				handlerOptions: exportGPKGHandler(),
+				network:        *exportGPKGNetwork,
+			}
+			if opts.crs, err = parseCRS(*exportGPKGCRS); err != nil {
+				return err
+			}
+			return exportGPKG(ctx, st, *exportGPKGOutputFile, opts, args)
+		}),
+	}
+
+	cmdExportTopoJSON := &ffcli.Command{
+		Name:      "exporttopojson",
+		ShortHelp: "export the street network and resolved request routes as TopoJSON sharing segment arcs",
+		FlagSet:   exportTopoJSONFlagSet,
+		Exec: withOutput(exportTopoJSONOutputFile, func(ctx context.Context, st store, w io.Writer, _ []string) error {
+			filter, err := newRequestFilter(*exportTopoJSONWholeStreet, *exportTopoJSONNoWholeStreet)
+			if err != nil {
+				return err
+			}
+			filter.district = *exportTopoJSONDistrict
+			return exportTopoJSON(ctx, st, w, topoJSONOptions{
+				requestFilter:  filter,
+				handlerOptions: exportTopoJSONHandler(),
+				quantization:   *exportTopoJSONQuantization,
+				pretty:         *exportTopoJSONPretty,
+			})
+		}),
+	}
+
+	cmdNetwork := &ffcli.Command{
+		Name:      "network",
+		ShortHelp: "export the full street network as GeoJSON",
+		FlagSet:   networkFlagSet,
+		Exec: withOutput(networkOutputFile, func(ctx context.Context, st store, w io.Writer, args []string) error {
+			c, err := parseCRS(*networkCRS)
+			if err != nil {
+				return err
+			}
+			return exportNetwork(ctx, st, w, networkOptions{pretty: *networkPretty, crs: c}, args)
+		}),
+	}
+
+	cmdRun := &ffcli.Command{
+		Name:       "run",
+		ShortUsage: "calmmap run [flags] <subcommand> [subcommand flags]",
+		ShortHelp:  "build the database then run another subcommand against it in one process",
+		LongHelp:   "With --db-memory, run builds and exports without touching disk.",
+		FlagSet:    runFlagSet,
 	}
 
 	root := &ffcli.Command{
 		ShortUsage:  "calmmap [flags] <subcommand>",
 		FlagSet:     rootFlagSet,
-		Subcommands: []*ffcli.Command{cmdBuildDB, cmdFixup, cmdRouteViz, cmdExport},
+		Subcommands: []*ffcli.Command{cmdBuildDB, cmdRelink, cmdMigrate, cmdFixup, cmdApplyOverrides, cmdExplain, cmdSegments, cmdComplete, cmdLinks, cmdTouching, cmdValidate, cmdGaps, cmdRouteViz, cmdExport, cmdExportCSV, cmdExportGPKG, cmdExportTopoJSON, cmdNetwork, cmdDiff, cmdTop, cmdGeocheck, cmdFuzzyMatches, cmdVersion, cmdRun},
 		Exec: func(context.Context, []string) error {
 			return flag.ErrHelp
 		},
 	}
 
-	if err := root.ParseAndRun(context.Background(), os.Args[1:]); err != nil {
+	cmdRun.Exec = func(ctx context.Context, args []string) error {
+		if len(args) == 0 {
+			return flag.ErrHelp
+		}
+
+		var sub *ffcli.Command
+		for _, c := range root.Subcommands {
+			if c.Name == args[0] && c != cmdRun && c != cmdBuildDB {
+				sub = c
+			}
+		}
+		if sub == nil {
+			return fmt.Errorf("unknown subcommand %q", args[0])
+		}
+
+		fields, err := parseKMLFields(*runKMLFieldNames)
+		if err != nil {
+			return err
+		}
+		if *runSnapTolerance <= 0 {
+			return fmt.Errorf("--snap-tolerance must be positive, got %g", *runSnapTolerance)
+		}
+
+		db, err := openDB(*databaseFile, *dbMemory || *runDBMemory)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		st := &sqliteStore{db: db, maxExplored: *maxExplored, avoidClasses: splitList(*avoidClasses), dropDuplicates: *runDedupeSegments, snapTolerance: *runSnapTolerance}
+		if err := st.init(); err != nil {
+			return err
+		}
+		if err := buildDB(ctx, st, *runCenterlinesKMLFile, *runCalmingRequestFile, buildOptions{
+			kml: kmlOptions{skipErrors: *runSkipErrors, fields: fields},
+			tsv: tsvOptions{
+				fromSentinels: strings.Split(*runFromSentinels, ","),
+				toSentinels:   strings.Split(*runToSentinels, ","),
+				skipErrors:    *runSkipErrors,
+			},
+			fetchTimeout: *runFetchTimeout,
+		}); err != nil {
+			return err
+		}
+
+		runDB = st.db
+		defer func() { runDB = nil }()
+		return sub.ParseAndRun(ctx, args[1:])
+	}
+
+	if err := root.Parse(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := root.Run(ctx); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-type store interface {
-	requests() ([]request, error)
-	filterSegments(segmentFilter) ([]segment, error)
-	routeLinks(routeID int) (map[int][]int, error)
-	route([]segment, []segment) ([]segment, error)
+// openDB opens the named sqlite database, or a fresh in-memory one if
+// memory is set or name is :memory:.
+func openDB(name string, memory bool) (*sql.DB, error) {
+	if !memory && name != ":memory:" {
+		return sql.Open("sqlite", name)
+	}
+
+	// Each connection to file::memory: gets its own database, so name
+	// one shared by all of db's connections. It lasts while any is open.
+	n := memoryDBs.Add(1)
+	return sql.Open("sqlite", fmt.Sprintf("file:calmmap-%d?mode=memory&cache=shared", n))
 }
 
-func routeViz(_ context.Context, st store, args []string) error {
-	if len(args) == 0 {
-		return fmt.Errorf("need route id")
+// memoryDBs counts the in-memory databases openDB has opened, to name
+// each uniquely.
+var memoryDBs atomic.Int64
+
+// buildOptions configures buildDB.
+type buildOptions struct {
+	kml kmlOptions
+	tsv tsvOptions
+
+	// fetchTimeout, if positive, limits how long fetching each input
+	// given as a URL may take.
+	fetchTimeout time.Duration
+}
+
+// buildDB loads the centreline KML and request TSV files into st.
+func buildDB(ctx context.Context, st *sqliteStore, kmlFile, tsvFile string, opts buildOptions) error {
+	if kmlFile == "-" && tsvFile == "-" {
+		return fmt.Errorf("only one of the centerlines and calming requests files can be stdin")
 	}
 
-	routeID, err := strconv.Atoi(args[0])
+	kf, err := openSource(ctx, kmlFile, opts.fetchTimeout)
 	if err != nil {
 		return err
 	}
+	defer kf.Close()
 
-	segs, err := st.filterSegments(segmentFilter{routeIDs: []int{routeID}})
+	rf, err := openSource(ctx, tsvFile, opts.fetchTimeout)
 	if err != nil {
 		return err
 	}
+	defer rf.Close()
 
-	if len(segs) == 0 {
-		return fmt.Errorf("no segments found for route %d", routeID)
-	}
+	topts := opts.tsv
+	topts.csv = topts.csv || isCSVSource(tsvFile)
 
-	links, err := st.routeLinks(routeID)
-	if err != nil {
+	var kmlSkipped, tsvSkipped []recordError
+	kmlHash, err := hashInput(kf, func(r io.Reader) error {
+		var err error
+		kmlSkipped, err = loadKMLSegments(st, r, opts.kml)
 		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", kmlFile, err)
 	}
 
-	fmt.Println("digraph {")
-	fmt.Printf("  label=%q\n", segs[0].name)
-	for _, seg := range segs {
-		fmt.Printf("  n%d [label=%q];\n", seg.id, fmt.Sprintf("%s to %s", seg.from, seg.to))
+	tsvHash, err := hashInput(rf, func(r io.Reader) error {
+		var err error
+		tsvSkipped, err = loadTSVRequests(st, r, topts)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", tsvFile, err)
 	}
-	for id, nexts := range links {
-		for _, next := range nexts {
-			fmt.Printf("  n%d -> n%d;\n", id, next)
+
+	for _, skipped := range []struct {
+		file    string
+		records []recordError
+	}{
+		{kmlFile, kmlSkipped},
+		{tsvFile, tsvSkipped},
+	} {
+		for _, r := range skipped.records {
+			slog.Warn("skipped record", "file", skipped.file, "record", r.record, "error", r.err)
+		}
+		if len(skipped.records) > 0 {
+			slog.Warn("skipped records", "file", skipped.file, "count", len(skipped.records))
 		}
 	}
-	fmt.Println("}")
-
-	return nil
-}
 
-func export(_ context.Context, st store, args []string) error {
-	reqs, err := st.requests()
-	if err != nil {
+	if err := verifySegmentLinks(ctx, st); err != nil {
 		return err
 	}
 
-	// https://play.golang.org/p/hFSq1nYn-eX
-	grad, err := colorgrad.NewGradient().HtmlColors("#aa0026", "darkorange", "#8d8d8d").Build()
+	unknown, err := unknownStreetRequests(ctx, st)
 	if err != nil {
 		return err
 	}
-	colors := grad.Colors(20)
-
-	var placemarks []kml.Element
+	for _, req := range unknown {
+		slog.Warn("request street has no segments", "rank", req.rank, "street", req.streetName)
+	}
+	if len(unknown) > 0 {
+		slog.Warn("requests on streets with no segments will fail to resolve", "count", len(unknown))
+	}
 
-	for _, req := range reqs {
-		hand := newDefaultRequestHandler(st, req)
+	return st.setMeta(map[string]string{
+		metaCenterlinesSHA256: kmlHash,
+		metaRequestsSHA256:    tsvHash,
+		metaBuiltAt:           time.Now().UTC().Format(time.RFC3339),
+	})
+}
 
-		res, err := hand.handle()
-		if err != nil {
-			log.Println(req, "error:", err)
-			continue
-		}
+// useColor reports whether output to f should be colored: not if noColor
+// is set, the NO_COLOR convention is followed, or f isn't a terminal.
+func useColor(noColor bool, f *os.File) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
 
-		var lineStrings []kml.Element
-		for _, seg := range res.routeSegments {
-			coords := make([]kml.Coordinate, 0, len(seg.lineString))
-			for _, lsp := range seg.lineString {
-				coords = append(coords, kml.Coordinate{Lon: lsp.Lon(), Lat: lsp.Lat()})
-			}
-			lineStrings = append(lineStrings, kml.LineString(kml.Coordinates(coords...)))
-		}
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
 
-		colorGroup := req.rank / (len(reqs) / len(colors))
-		if colorGroup >= len(colors) {
-			colorGroup = len(colors) - 1
-		}
+type store interface {
+	requests(context.Context, requestFilter) ([]request, error)
+	filterSegments(context.Context, segmentFilter) ([]segment, error)
+	routeLinks(ctx context.Context, routeID int) (map[int][]int, error)
+	segmentLinks(ctx context.Context, id int) ([]segmentLink, error)
+	streetNames(context.Context) ([]string, error)
+	streetNamesWithPrefix(ctx context.Context, prefix string) ([]string, error)
+	segmentsInBounds(ctx context.Context, b orb.Bound) ([]segment, error)
+	route(context.Context, []segment, []segment) ([]segment, error)
+}
 
-		placemarks = append(placemarks, kml.Placemark(
-			kml.Name(req.String()),
-			kml.StyleURL(fmt.Sprintf("#line-group-%d", colorGroup)),
-			kml.MultiGeometry(lineStrings...),
-		))
+// openInput opens name for reading, with - meaning stdin.
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
 	}
+	return os.Open(name)
+}
 
-	folder := kml.Folder(kml.Name("Calming Requests, ranked and coloured by rank"))
-	folder.Add(placemarks...)
+// openSource opens name as openInput does, or fetches it if it's an
+// http(s) URL, taking at most timeout if it's positive.
+func openSource(ctx context.Context, name string, timeout time.Duration) (io.ReadCloser, error) {
+	if !strings.HasPrefix(name, "http://") && !strings.HasPrefix(name, "https://") {
+		return openInput(name)
+	}
 
-	doc := kml.Document()
-	for i, col := range colors {
-		doc.Add(kml.SharedStyle(fmt.Sprintf("line-group-%d", i), kml.LineStyle(kml.Width(4), kml.Color(col))))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
 	}
-	doc.Add(folder)
-	k := kml.KML(doc)
-	return k.WriteIndent(os.Stdout, "", "  ")
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: unexpected status %s", name, resp.Status)
+	}
+	return resp.Body, nil
 }
 
-type requestResult struct {
-	startSegments []segment
-	endSegments   []segment
-	routeSegments []segment
+// isCSVSource reports whether name looks like comma-separated values, by
+// its extension or, for a spreadsheet export URL, its format parameter.
+func isCSVSource(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".csv") || strings.Contains(name, "output=csv") || strings.Contains(name, "format=csv")
 }
 
-type requestHandler struct {
-	req request
-
-	startHandler func(processingRequest) ([]segment, error)
-	endHandler   func(processingRequest) ([]segment, error)
-	routeHandler func(processingRequest) ([]segment, error)
-}
+// writeOutput calls write with name opened for writing, with - meaning
+// stdout. A file is written with writeFileAtomic, so an error leaves
+// whatever was there before, unless it's an outputWrittenError.
+func writeOutput(name string, write func(io.Writer) error) error {
+	if name == "-" {
+		return write(os.Stdout)
+	}
 
-func newDefaultRequestHandler(st store, req request) requestHandler {
-	return requestHandler{
-		req:          req,
-		startHandler: overrideDiscovery("start", st, startDiscovery(st)),
-		endHandler:   overrideDiscovery("end", st, endDiscovery(st)),
-		routeHandler: overrideDiscovery("route", st, routeDiscovery(st)),
+	var werr error
+	if err := writeFileAtomic(name, func(f *os.File) error {
+		werr = write(f)
+		if errors.As(werr, new(outputWrittenError)) {
+			return nil
+		}
+		return werr
+	}); err != nil {
+		return err
 	}
+	return werr
 }
 
-type processingRequest struct {
-	req           request
-	startSegments []segment
-	endSegments   []segment
+// outputWrittenError is an error found after output was completely
+// written, such as too many requests failing to resolve, so writeOutput
+// keeps the output.
+type outputWrittenError struct {
+	error
 }
 
-type requestAttempt struct {
-	startSegments []segment
-	startErr      error
+func (e outputWrittenError) Unwrap() error {
+	return e.error
+}
 
-	endSegments []segment
-	endErr      error
+type routeVizOptions struct {
+	// from and maxDepth, if maxDepth is positive, limit the graph to
+	// segments within maxDepth links, in either direction, of from.
+	from, maxDepth int
 
-	routeSegments []segment
-	routeErr      error
+	// request, if non-zero, is the rank of a request to resolve, using
+	// handlerOptions, and graph the route of. Its path is drawn in bold
+	// with its start and end segments filled, and other links in grey.
+	request        int
+	handlerOptions handlerOptions
 }
 
-func (s requestHandler) handleAttempt() requestAttempt {
-	att := requestAttempt{}
-
-	preq := processingRequest{
-		req: s.req,
+func routeViz(ctx context.Context, st store, w io.Writer, opts routeVizOptions, args []string) error {
+	if len(args) == 0 && opts.request == 0 {
+		return fmt.Errorf("need route id")
+	}
+	if opts.maxDepth > 0 && opts.from == 0 {
+		return fmt.Errorf("max depth needs a from segment")
 	}
 
-	att.startSegments, att.startErr = s.startHandler(preq)
-	if len(att.startSegments) == 0 {
-		att.startErr = fmt.Errorf("no start segments found")
-		att.endErr = fmt.Errorf("no start segments found")
-		att.routeErr = fmt.Errorf("no start segments found")
-		return att
-	}
-	preq.startSegments = att.startSegments
-
-	att.endSegments, att.endErr = s.endHandler(preq)
-	if len(att.endSegments) == 0 {
-		att.endErr = fmt.Errorf("no end segments found")
-		att.routeErr = fmt.Errorf("no end segments found")
-		return att
-	}
-	preq.endSegments = att.endSegments
-
-	att.routeSegments, att.routeErr = s.routeHandler(preq)
-	return att
-}
-
-func (s requestHandler) handle() (requestResult, error) {
-	att := s.handleAttempt()
-
-	for _, err := range []error{att.startErr, att.endErr, att.routeErr} {
+	var (
+		routeID        int
+		onPath         map[[2]int]bool
+		isStart, isEnd map[int]bool
+	)
+	if opts.request != 0 {
+		reqs, err := st.requests(ctx, requestFilter{rankMin: opts.request, rankMax: opts.request})
 		if err != nil {
-			return requestResult{}, err
+			return err
 		}
-	}
-
-	return requestResult{
-		startSegments: att.startSegments,
-		endSegments:   att.endSegments,
-		routeSegments: att.routeSegments,
-	}, nil
-}
-
-func overrideDiscovery(when string, st store, next func(preq processingRequest) ([]segment, error)) func(preq processingRequest) ([]segment, error) {
-	return func(preq processingRequest) ([]segment, error) {
-		f, err := os.Open(fmt.Sprintf("overrides/%d.%s", preq.req.rank, when))
-		if os.IsNotExist(err) {
-			return next(preq)
+		if len(reqs) == 0 {
+			return fmt.Errorf("no request with rank %d", opts.request)
 		}
+		res, err := newDefaultRequestHandler(st, reqs[0], opts.handlerOptions).handle(ctx)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("%s: %w", reqs[0], err)
 		}
-		defer f.Close()
+		routeID = res.routeSegments[0].routeID
 
-		var ids []int
-		sc := bufio.NewScanner(f)
-		for sc.Scan() {
-			id, err := strconv.Atoi(sc.Text())
-			if err != nil {
-				return nil, err
-			}
-			ids = append(ids, id)
+		onPath = make(map[[2]int]bool)
+		for i := 1; i < len(res.routeSegments); i++ {
+			onPath[[2]int{res.routeSegments[i-1].id, res.routeSegments[i].id}] = true
 		}
-		if sc.Err() != nil {
-			return nil, sc.Err()
+		isStart, isEnd = make(map[int]bool), make(map[int]bool)
+		for _, seg := range res.startSegments {
+			isStart[seg.id] = true
 		}
-		return st.filterSegments(segmentFilter{ids: ids})
-	}
-}
-
-func startDiscovery(st store) func(preq processingRequest) ([]segment, error) {
-	return func(preq processingRequest) ([]segment, error) {
-		filter := segmentFilter{fullNames: []string{strings.ReplaceAll(preq.req.streetName, "'", "")}}
-		if preq.req.from != "" {
-			dqf := strings.ReplaceAll(preq.req.from, "'", "")
-			filter.endStreets = []string{dqf}
+		for _, seg := range res.endSegments {
+			isEnd[seg.id] = true
 		}
-
-		segs, err := st.filterSegments(filter)
+	} else {
+		var err error
+		routeID, err = strconv.Atoi(args[0])
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
 
-		routeIDs := make(map[int]bool)
-		for _, seg := range segs {
-			routeIDs[seg.routeID] = true
-		}
-		if len(routeIDs) > 1 {
-			return nil, fmt.Errorf("discovered segments with %d different route IDs", len(routeIDs))
-		}
+	segs, err := st.filterSegments(ctx, segmentFilter{routeIDs: []int{routeID}})
+	if err != nil {
+		return err
+	}
 
-		return segs, nil
+	if len(segs) == 0 {
+		return fmt.Errorf("no segments found for route %d", routeID)
 	}
-}
 
-func endDiscovery(st store) func(preq processingRequest) ([]segment, error) {
-	return func(preq processingRequest) ([]segment, error) {
-		filter := segmentFilter{routeIDs: []int{preq.startSegments[0].routeID}}
-		if preq.req.to != "" {
-			dqt := strings.ReplaceAll(preq.req.to, "'", "")
-			filter.endStreets = []string{dqt}
-		}
+	links, err := st.routeLinks(ctx, routeID)
+	if err != nil {
+		return err
+	}
 
-		segs, err := st.filterSegments(filter)
-		if err != nil {
-			return nil, err
+	var near map[int]bool
+	if opts.maxDepth > 0 {
+		if !slices.ContainsFunc(segs, func(s segment) bool { return s.id == opts.from }) {
+			return fmt.Errorf("segment %d is not on route %d", opts.from, routeID)
 		}
-
-		return segs, nil
+		near = linkNeighbourhood(links, opts.from, opts.maxDepth)
 	}
-}
+	include := func(id int) bool { return near == nil || near[id] }
 
-func routeDiscovery(st store) func(preq processingRequest) ([]segment, error) {
-	return func(preq processingRequest) ([]segment, error) {
-		// For entire streets, return all segments on the route.
-		if preq.req.from == "" && preq.req.to == "" {
-			return st.filterSegments(segmentFilter{routeIDs: []int{preq.startSegments[0].routeID}})
+	fmt.Fprintln(w, "digraph {")
+	fmt.Fprintf(w, "  label=%q\n", segs[0].name)
+	for _, seg := range segs {
+		if !include(seg.id) {
+			continue
 		}
-
-		route, err := st.route(preq.startSegments, preq.endSegments)
-		if err != nil {
-			return nil, err
+		var attrs string
+		switch {
+		case isStart[seg.id]:
+			attrs = ", style=filled, fillcolor=palegreen"
+		case isEnd[seg.id]:
+			attrs = ", style=filled, fillcolor=lightpink"
 		}
-
-		// If there's a start, trim the start of the path so it only
-		// begins with one start segment.
-		if preq.req.from != "" {
-			startIDs := make([]int, len(preq.startSegments))
-			for _, seg := range preq.startSegments {
-				startIDs = append(startIDs, seg.id)
+		fmt.Fprintf(w, "  n%d [label=%q%s];\n", seg.id, fmt.Sprintf("%s to %s", seg.from, seg.to), attrs)
+	}
+	for id, nexts := range links {
+		for _, next := range nexts {
+			if !include(id) || !include(next) {
+				continue
 			}
-			for len(route) > 2 && contains(startIDs, route[1].id) {
-				route = route[1:]
+			var attrs string
+			switch {
+			case onPath[[2]int{id, next}]:
+				attrs = " [color=blue, penwidth=3]"
+			case onPath != nil:
+				attrs = " [color=grey]"
 			}
+			fmt.Fprintf(w, "  n%d -> n%d%s;\n", id, next, attrs)
 		}
+	}
+	fmt.Fprintln(w, "}")
 
-		// For "from X to end" requests or when "from X to X", find the longest route (by segment count).
-		//
-		// An example of the latter is "Summit Cres from High Timber Dr to High Timber Dr"
-		if preq.req.to == "" || preq.req.to == preq.req.from {
-			path := route
-			for _, end := range preq.endSegments {
-				c, err := st.route([]segment{route[0]}, []segment{end})
-				if err != nil {
-					return nil, err
-				}
-				if len(c) > len(path) {
-					path = c
+	return nil
+}
+
+// linkNeighbourhood returns the segments within depth links of from,
+// following links in either direction.
+func linkNeighbourhood(links map[int][]int, from, depth int) map[int]bool {
+	adj := make(map[int][]int)
+	for id, nexts := range links {
+		for _, next := range nexts {
+			adj[id] = append(adj[id], next)
+			adj[next] = append(adj[next], id)
+		}
+	}
+
+	near := map[int]bool{from: true}
+	frontier := []int{from}
+	for d := 0; d < depth && len(frontier) > 0; d++ {
+		var next []int
+		for _, id := range frontier {
+			for _, n := range adj[id] {
+				if !near[n] {
+					near[n] = true
+					next = append(next, n)
 				}
 			}
-			route = path
 		}
-
-		return route, nil
+		frontier = next
 	}
+	return near
 }
 
-type request struct {
-	streetName string
-	from, to   string
-	district   string
-	rank       int
-}
+type exportOptions struct {
+	requestFilter  requestFilter
+	handlerOptions handlerOptions
 
-func (r request) String() string {
-	out := strconv.Itoa(r.rank) + " " + r.streetName + " "
-	if r.from == "" && r.to == "" {
-		out += "(all)"
-	} else {
-		out += "from " + r.from
-		if r.to != "" {
-			out += " to " + r.to
-		}
-	}
-	return out
-}
+	// mergeSegments joins touching route segments into continuous line
+	// strings rather than emitting one line string per segment.
+	mergeSegments bool
 
-func (s sqliteStore) requests() ([]request, error) {
-	rows, err := s.db.Query("select street_name, start, end, district, rank from requests order by rank")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	// kmz writes the KML zipped up as a KMZ.
+	kmz bool
 
-	var reqs []request
-	for rows.Next() {
-		var req request
-		var start, end sql.NullString
-		if err := rows.Scan(&req.streetName, &start, &end, &req.district, &req.rank); err != nil {
-			return nil, err
-		}
-		req.from = start.String
-		req.to = end.String
-		reqs = append(reqs, req)
-	}
+	// pretty indents the KML for reading rather than writing it compactly.
+	pretty bool
 
-	return reqs, rows.Err()
-}
+	// gradient is the HTML colors requests are coloured along by rank,
+	// split into gradientSteps groups.
+	gradient      []string
+	gradientSteps int
 
-type segment struct {
-	id        int
-	name      string
-	from, to  string
-	direction string
-	routeID   int
+	// lineWidth styles route lines, with zero meaning defaultLineWidth.
+	lineWidth float64
 
-	lineString orb.LineString
-	firstPoint orb.Point
-	lastPoint  orb.Point
+	// lineOpacity, when set, is the opacity of route lines from 0 for
+	// transparent to 1 for opaque. Lines are opaque if it's nil.
+	lineOpacity *float64
 
-	streetName  string
-	streetType  string
-	streetClass string
-}
+	// crs is the coordinate system of NDJSON output, lon/lat if unset.
+	crs crs
 
-func (s segment) String() string {
-	return fmt.Sprintf("%d %s from %s to %s", s.id, s.name, s.from, s.to)
-}
+	// includeErrors adds requests that failed to resolve to an
+	// "Unresolved" folder, with the error as their description.
+	includeErrors bool
 
-type sqliteStore struct {
-	db *sql.DB
+	// arrows adds a "Directions" folder with an arrow at the middle of
+	// each route segment pointing in its direction of travel.
+	arrows bool
+
+	// endpoints adds an "Endpoints" folder with a marker at the start and
+	// end of each route, named by its cross streets.
+	endpoints bool
+
+	// segmentLabels adds a "Segment labels" folder with a label at the
+	// middle of each route segment naming its cross streets, "from → to"
+	// in the direction of travel.
+	segmentLabels bool
+
+	// extraData adds each request's extra columns from the requests file
+	// to its placemark's extended data.
+	extraData bool
+
+	// yearField names the requests file column, ignoring case, giving
+	// the year a request is planned for. Placemarks of requests with one
+	// get a time span starting that year. Empty disables time spans.
+	yearField string
+
+	// dedupeRoutes merges requests resolving to the same segments into
+	// the placemark of the first of them, which describes them all.
+	dedupeRoutes bool
+
+	// routeID, if non-zero, limits output to requests resolved on the
+	// route, and adds a folder with all of the route's segments.
+	routeID int
+
+	// orderBy is the ordering requests are coloured and limited by, as
+	// parsed by parseOrderBy.
+	orderBy string
+
+	// maxFailures is the fraction of requests that may fail to resolve
+	// before export returns an error, after writing its output.
+	maxFailures float64
+
+	// requireRanks are the ranks of requests export returns an error for,
+	// after writing its output, if they aren't exported.
+	requireRanks []int
+
+	// coordPrecision is the decimal places KML coordinates are rounded
+	// to, or 0 for full precision.
+	coordPrecision int
+
+	// groupBy is "district" to put placemarks in a folder per district
+	// within the top folder, or "none" or empty for one flat folder.
+	groupBy string
 }
 
-// route finds a route between any of the fromSegments to any of the toSegments.
-func (s sqliteStore) route(fromSegments []segment, toSegments []segment) ([]segment, error) {
-	if len(fromSegments) == 0 || len(toSegments) == 0 {
-		return nil, fmt.Errorf("empty fromSegments or empty toSegments")
+// defaultLineWidth is the width of route lines, in pixels.
+const defaultLineWidth = 4
+
+// routeLineStyle returns the KML line style for routes colored col.
+func routeLineStyle(col color.Color, opts exportOptions) kml.Element {
+	width := opts.lineWidth
+	if width <= 0 {
+		width = defaultLineWidth
 	}
 
-	rows, err := s.db.Query("select id, next_id from segment_links where route_id=(select route_id from segments where id=?)", fromSegments[0].id)
-	if err != nil {
-		return nil, err
+	if opts.lineOpacity != nil && *opts.lineOpacity < 1 {
+		// KML wants the color components as they are, not premultiplied
+		// by alpha as color.NRGBA would give.
+		r, g, b, _ := col.RGBA()
+		col = color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(math.Round(*opts.lineOpacity * 255))}
 	}
-	defer rows.Close()
 
-	// First fromSegments is always in the graph, even if it has no edges.
-	graph := map[int][]int{
-		fromSegments[0].id: nil,
+	return kml.LineStyle(kml.Width(width), kml.Color(col))
+}
+
+// arrowIcon points north, and is rotated by each arrow's heading.
+const arrowIcon = "http://earth.google.com/images/kml-icons/track-directional/track-0.png"
+
+// https://play.golang.org/p/hFSq1nYn-eX
+var defaultGradient = []string{"#aa0026", "darkorange", "#8d8d8d"}
+
+func export(ctx context.Context, st store, w io.Writer, opts exportOptions, args []string) error {
+	if opts.gradientSteps < 1 {
+		return fmt.Errorf("gradient steps must be at least 1, got %d", opts.gradientSteps)
 	}
-	for rows.Next() {
-		var id, nextID int
-		if err := rows.Scan(&id, &nextID); err != nil {
-			return nil, err
-		}
-		graph[id] = append(graph[id], nextID)
-		if _, ok := graph[nextID]; !ok {
-			graph[nextID] = nil
-		}
+	if o := opts.lineOpacity; o != nil && (*o < 0 || *o > 1) {
+		return fmt.Errorf("line opacity must be from 0 to 1, got %v", *o)
 	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
+	if opts.coordPrecision < 0 {
+		return fmt.Errorf("coordinate precision must not be negative, got %d", opts.coordPrecision)
 	}
-
-	for _, seg := range toSegments {
-		if _, ok := graph[seg.id]; !ok {
-			return nil, fmt.Errorf("to segment %d not found in route graph", seg.id)
-		}
+	switch opts.groupBy {
+	case "", "none", "district":
+	default:
+		return fmt.Errorf("unknown grouping %q, want district or none", opts.groupBy)
 	}
 
-	toIDs := make([]int, 0, len(toSegments))
-	for _, seg := range toSegments {
-		toIDs = append(toIDs, seg.id)
+	sel, err := selectExportResults(ctx, st, opts)
+	if err != nil {
+		return err
 	}
 
-	q := [][]int{{fromSegments[0].id}}
-	var path []int
-	for len(q) > 0 {
-		p := q[0]
-		q = q[1:]
-		lid := p[len(p)-1]
+	gradient := opts.gradient
+	if len(gradient) == 0 {
+		gradient = defaultGradient
+	}
+	grad, err := colorgrad.NewGradient().HtmlColors(gradient...).Build()
+	if err != nil {
+		return err
+	}
+	colors := grad.Colors(uint(opts.gradientSteps))
 
-		if contains(toIDs, lid) {
-			path = p
-			break
+	var (
+		placemarks                []districtPlacemark
+		arrows, endpoints, labels []kml.Element
+	)
+	for _, group := range sel.groups {
+		r := group[0]
+		req, res := r.req, r.res
+		lineStrings := routeLineStrings(res.routeSegments, opts.mergeSegments, opts.coordPrecision)
+
+		colorGroup := sel.colorGroup(r, len(colors))
+		resolvedFrom, resolvedTo := resolvedCrossStreets(req, res)
+		data := []kml.Element{
+			kmlData("raw_from", req.rawFrom),
+			kmlData("raw_to", req.rawTo),
+			kmlData("resolved_from", resolvedFrom),
+			kmlData("resolved_to", resolvedTo),
 		}
-
-		for _, nid := range graph[lid] {
-			if contains(p, nid) {
-				continue
+		if opts.extraData {
+			data = append(data, extraData(req)...)
+		}
+		elems := []kml.Element{kml.Name(req.String())}
+		if len(group) > 1 {
+			names := make([]string, 0, len(group))
+			for _, g := range group {
+				names = append(names, g.req.String())
+			}
+			elems = []kml.Element{
+				kml.Name(fmt.Sprintf("%s (%d requests)", req, len(group))),
+				kml.Description("Requests resolving to this route: " + strings.Join(names, "; ")),
 			}
-			newp := make([]int, len(p))
-			copy(newp, p)
-			newp = append(newp, nid)
-			q = append(q, newp)
+			data = append(data, kmlData("request_count", strconv.Itoa(len(group))))
+		}
+		// span places all of the group's placemarks on the time slider.
+		var span []kml.Element
+		if year, ok := plannedYear(group, opts.yearField); ok {
+			span = append(span, kml.TimeSpan(kml.Begin(time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC))))
+		}
+		elems = append(elems, span...)
+		elems = append(elems,
+			kml.StyleURL(fmt.Sprintf("#line-group-%d", colorGroup)),
+			kml.ExtendedData(data...),
+			kml.MultiGeometry(lineStrings...),
+		)
+		placemarks = append(placemarks, districtPlacemark{req.district, kml.Placemark(elems...)})
+
+		if opts.arrows {
+			arrows = append(arrows, arrowPlacemarks(res.routeSegments, opts.coordPrecision, span...)...)
+		}
+		if opts.endpoints {
+			endpoints = append(endpoints, endpointPlacemarks(req, res, opts.coordPrecision, span...)...)
+		}
+		if opts.segmentLabels {
+			labels = append(labels, segmentLabelPlacemarks(res.routeSegments, opts.coordPrecision, span...)...)
 		}
 	}
 
-	if path == nil {
-		return nil, fmt.Errorf("could not find path")
+	folder := kml.Folder(kml.Name("Calming Requests, ranked and coloured by rank"))
+	if opts.groupBy == "district" {
+		folder.Add(districtFolders(placemarks)...)
+	} else {
+		for _, p := range placemarks {
+			folder.Add(p.placemark)
+		}
 	}
 
-	segs, err := s.filterSegments(segmentFilter{ids: path})
-	if err != nil {
-		return nil, err
+	doc := kml.Document()
+	for i, col := range colors {
+		doc.Add(kml.SharedStyle(fmt.Sprintf("line-group-%d", i), routeLineStyle(col, opts)))
 	}
-	segsByID := make(map[int]segment)
-	for _, seg := range segs {
-		segsByID[seg.id] = seg
+	doc.Add(folder)
+	if len(sel.unresolved) > 0 {
+		doc.Add(kml.Folder(kml.Name("Unresolved")).Add(sel.unresolved...))
 	}
-	for i, id := range path {
-		segs[i] = segsByID[id]
+	if len(arrows) > 0 {
+		doc.Add(kml.Folder(kml.Name("Directions")).Add(arrows...))
+	}
+	if len(endpoints) > 0 {
+		doc.Add(kml.Folder(kml.Name("Endpoints")).Add(endpoints...))
+	}
+	if len(labels) > 0 {
+		doc.Add(kml.Folder(kml.Name("Segment labels")).Add(labels...))
+	}
+	if len(sel.routeSegments) > 0 {
+		rf := kml.Folder(kml.Name(fmt.Sprintf("Route %d segments", opts.routeID)))
+		for _, seg := range sel.routeSegments {
+			coords := make([]kml.Coordinate, 0, len(seg.lineString))
+			for _, p := range seg.lineString {
+				coords = append(coords, kmlCoordinate(p, opts.coordPrecision))
+			}
+			rf.Add(kml.Placemark(
+				kml.Name(seg.String()),
+				kml.LineString(kml.Coordinates(coords...)),
+			))
+		}
+		doc.Add(rf)
+	}
+	if err := writeKML(w, kml.KML(doc), opts.kmz, opts.pretty); err != nil {
+		return err
 	}
-	return segs, nil
-}
 
-func (s sqliteStore) routeLinks(routeID int) (map[int][]int, error) {
-	links := make(map[int][]int)
+	slog.Info("export summary", "resolved", len(sel.results), "total", len(sel.results)+len(sel.failed), "errors", len(sel.failed))
 
-	rows, err := s.db.Query("select id, next_id from segment_links where route_id=?", routeID)
-	if err != nil {
-		return nil, err
+	if err := sel.checkRequired(opts.requireRanks); err != nil {
+		return outputWrittenError{err}
 	}
-	defer rows.Close()
+	if err := sel.checkFailures(opts.maxFailures); err != nil {
+		return outputWrittenError{err}
+	}
+	return nil
+}
 
-	for rows.Next() {
-		var id, nextID int
-		if err := rows.Scan(&id, &nextID); err != nil {
-			return nil, err
+// exportMode returns the flag, of those in modes that are set, choosing
+// an export's output instead of the default KML, or "" if none is. Output
+// modes can't be combined.
+func exportMode(modes map[string]bool) (string, error) {
+	var set []string
+	for name, ok := range modes {
+		if ok {
+			set = append(set, name)
 		}
-		links[id] = append(links[id], nextID)
 	}
-
-	return links, rows.Err()
+	sort.Strings(set)
+	switch len(set) {
+	case 0:
+		return "", nil
+	case 1:
+		return set[0], nil
+	}
+	return "", fmt.Errorf("%s can't be combined, choose one output", strings.Join(set, " and "))
 }
 
-// Uses approach described in https://www.gobeyond.dev/real-world-sql-part-one/ but with
-// slices instead of pointers to ints/etc.
-type segmentFilter struct {
-	ids        []int
-	fullNames  []string
-	routeIDs   []int
-	endStreets []string
+// requireRankUnsupported says why each export mode that can't check
+// --require-rank can't, unlike the default KML and --split output.
+var requireRankUnsupported = map[string]string{
+	"--format=mvt":     "a tile only includes the requests crossing it",
+	"--ndjson":         "it writes routes as they resolve without tracking which failed",
+	"--override-delta": "it compares routes with and without overrides rather than exporting requests",
+	"--heatmap":        "it aggregates segments rather than exporting requests",
+	"--by-street":      "it aggregates requests by street rather than exporting each",
 }
 
-func (s sqliteStore) filterSegments(filter segmentFilter) ([]segment, error) {
-	where, args := []string{"1 = 1"}, []interface{}{}
+// exportSelection is the requests an export resolves and includes.
+type exportSelection struct {
+	// results are the resolved requests, in display order, before rank
+	// limits that apply to the display order.
+	results []rankedResult
 
-	if len(filter.ids) > 0 {
-		var idw []string
-		for _, id := range filter.ids {
-			idw = append(idw, "id = ?")
+	// groups are the results within rank limits, one per group, or
+	// grouped by route with dedupeRoutes.
+	groups [][]rankedResult
+
+	// loRank and hiRank are the range of results' display ranks, which
+	// colours are scaled across.
+	loRank, hiRank int
+
+	// failed are the ranks of requests that failed to resolve, and
+	// unresolved their placemarks with includeErrors.
+	failed     []int
+	unresolved []kml.Element
+
+	// routeSegments are the segments of the route with routeID, if set.
+	routeSegments []segment
+}
+
+// selectExportResults resolves the requests opts selects, orders them, and
+// applies opts' rank limits and route ID, as every KML export does.
+func selectExportResults(ctx context.Context, st store, opts exportOptions) (exportSelection, error) {
+	terms, err := parseOrderBy(opts.orderBy)
+	if err != nil {
+		return exportSelection{}, err
+	}
+
+	// With another ordering, rank limits apply to it rather than to
+	// source rank, so can only be applied once requests are resolved.
+	filter := opts.requestFilter
+	var rankMin, rankMax int
+	if !isRankOrder(terms) {
+		rankMin, rankMax = filter.rankMin, filter.rankMax
+		filter.rankMin, filter.rankMax = 0, 0
+	}
+
+	reqs, err := st.requests(ctx, filter)
+	if err != nil {
+		return exportSelection{}, err
+	}
+
+	var sel exportSelection
+	if opts.routeID != 0 {
+		sel.routeSegments, err = st.filterSegments(ctx, segmentFilter{routeIDs: []int{opts.routeID}})
+		if err != nil {
+			return exportSelection{}, err
+		}
+		if len(sel.routeSegments) == 0 {
+			return exportSelection{}, fmt.Errorf("no segments found for route %d", opts.routeID)
+		}
+	}
+
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return exportSelection{}, err
+		}
+
+		att := newDefaultRequestHandler(st, req, opts.handlerOptions).handleAttempt(ctx)
+		if opts.routeID != 0 && !att.onRoute(opts.routeID) {
+			continue
+		}
+
+		res, err := att.result()
+		if err != nil {
+			sel.failed = append(sel.failed, req.rank)
+			logRequestError(req, err)
+			if opts.includeErrors {
+				sel.unresolved = append(sel.unresolved, unresolvedPlacemark(req, att, err, opts.coordPrecision))
+			}
+			continue
+		}
+
+		sel.results = append(sel.results, rankedResult{req: req, res: res})
+	}
+
+	orderResults(sel.results, terms)
+
+	for i, r := range sel.results {
+		if i == 0 || r.displayRank < sel.loRank {
+			sel.loRank = r.displayRank
+		}
+		if r.displayRank > sel.hiRank {
+			sel.hiRank = r.displayRank
+		}
+	}
+
+	for _, r := range sel.results {
+		if (rankMin > 0 && r.displayRank < rankMin) || (rankMax > 0 && r.displayRank > rankMax) {
+			continue
+		}
+		sel.groups = append(sel.groups, []rankedResult{r})
+	}
+	if opts.dedupeRoutes {
+		sel.groups = sameRouteGroups(sel.groups)
+	}
+	return sel, nil
+}
+
+// colorGroup returns the index of r's colour among n, scaled across the
+// selection's display ranks.
+func (s exportSelection) colorGroup(r rankedResult, n int) int {
+	return rankColorGroup(r.displayRank, s.loRank, s.hiRank, n)
+}
+
+// checkFailures returns an error if more than the fraction maxFailures
+// of the selected requests failed to resolve.
+func (s exportSelection) checkFailures(maxFailures float64) error {
+	total := len(s.results) + len(s.failed)
+	if total > 0 && float64(len(s.failed))/float64(total) > maxFailures {
+		return fmt.Errorf("%d of %d requests failed to resolve, more than max failures of %v", len(s.failed), total, maxFailures)
+	}
+	return nil
+}
+
+// checkRequired returns an error if any of the requests with ranks isn't
+// among the selection's groups, saying whether it failed to resolve or
+// wasn't selected, as by filters, route ID or rank limits.
+func (s exportSelection) checkRequired(ranks []int) error {
+	var included []int
+	for _, g := range s.groups {
+		for _, r := range g {
+			included = append(included, r.req.rank)
+		}
+	}
+	return checkRequiredRanks(ranks, included, s.failed)
+}
+
+// checkRequiredRanks returns an error if any of ranks isn't in included,
+// saying whether it's in failed, having failed to resolve, or wasn't
+// selected at all.
+func checkRequiredRanks(ranks, included, failed []int) error {
+	var failedRanks, unselected []string
+	for _, rank := range ranks {
+		switch {
+		case slices.Contains(included, rank):
+		case slices.Contains(failed, rank):
+			failedRanks = append(failedRanks, strconv.Itoa(rank))
+		default:
+			unselected = append(unselected, strconv.Itoa(rank))
+		}
+	}
+
+	var problems []string
+	if len(failedRanks) > 0 {
+		problems = append(problems, "failed to resolve: ranks "+strings.Join(failedRanks, ", "))
+	}
+	if len(unselected) > 0 {
+		problems = append(problems, "not selected: ranks "+strings.Join(unselected, ", "))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("required requests %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// plannedYear returns the earliest year in field of the requests of
+// group, if any have one.
+func plannedYear(group []rankedResult, field string) (int, bool) {
+	if field == "" {
+		return 0, false
+	}
+
+	var (
+		earliest int
+		found    bool
+	)
+	for _, r := range group {
+		for name, v := range r.req.extra {
+			if !strings.EqualFold(name, field) {
+				continue
+			}
+			year, err := strconv.Atoi(v)
+			if err != nil || year < 1 || year > 9999 {
+				slog.Warn("ignoring invalid planned year", "rank", r.req.rank, "field", name, "value", v)
+				continue
+			}
+			if !found || year < earliest {
+				earliest, found = year, true
+			}
+		}
+	}
+	return earliest, found
+}
+
+// sameRouteGroups merges groups whose first results' routes have the same
+// segments, keeping the order of the first of each.
+func sameRouteGroups(groups [][]rankedResult) [][]rankedResult {
+	var out [][]rankedResult
+	byRoute := make(map[string]int)
+	for _, g := range groups {
+		key := fmt.Sprint(sortedSegmentIDs(g[0].res.routeSegments))
+		if i, ok := byRoute[key]; ok {
+			out[i] = append(out[i], g...)
+			continue
+		}
+		byRoute[key] = len(out)
+		out = append(out, g)
+	}
+	return out
+}
+
+// districtPlacemark is a request's placemark along with its district.
+type districtPlacemark struct {
+	district  string
+	placemark kml.Element
+}
+
+// districtFolders returns a folder for each district holding its
+// placemarks, in the order given. Folders are ordered by district,
+// numerically where districts are numbers, with requests lacking one last.
+func districtFolders(placemarks []districtPlacemark) []kml.Element {
+	byDistrict := make(map[string][]kml.Element)
+	var districts []string
+	for _, p := range placemarks {
+		if _, ok := byDistrict[p.district]; !ok {
+			districts = append(districts, p.district)
+		}
+		byDistrict[p.district] = append(byDistrict[p.district], p.placemark)
+	}
+
+	sort.Slice(districts, func(i, j int) bool {
+		a, b := districts[i], districts[j]
+		if (a == "") != (b == "") {
+			return b == ""
+		}
+		an, aErr := strconv.Atoi(a)
+		bn, bErr := strconv.Atoi(b)
+		if aErr == nil && bErr == nil {
+			return an < bn
+		}
+		return a < b
+	})
+
+	folders := make([]kml.Element, 0, len(districts))
+	for _, d := range districts {
+		name := "District " + d
+		if d == "" {
+			name = "No district"
+		}
+		folders = append(folders, kml.Folder(kml.Name(name)).Add(byDistrict[d]...))
+	}
+	return folders
+}
+
+// routeLineStrings returns a KML line string for each of segs, or for each
+// run of touching segments if merge is set, with coordinates rounded to
+// precision as by kmlCoordinate.
+func routeLineStrings(segs []segment, merge bool, precision int) []kml.Element {
+	var routeLines []orb.LineString
+	if merge {
+		routeLines = mergeLineStrings(segs)
+	} else {
+		for _, seg := range segs {
+			routeLines = append(routeLines, seg.lineString)
+		}
+	}
+
+	var lineStrings []kml.Element
+	for _, ls := range routeLines {
+		coords := make([]kml.Coordinate, 0, len(ls))
+		for _, lsp := range ls {
+			coords = append(coords, kmlCoordinate(lsp, precision))
+		}
+		lineStrings = append(lineStrings, kml.LineString(kml.Coordinates(coords...)))
+	}
+	return lineStrings
+}
+
+// kmlCoordinate returns p as a KML coordinate rounded to precision decimal
+// places, or unrounded if precision is 0. Six places is about 0.1 m.
+func kmlCoordinate(p orb.Point, precision int) kml.Coordinate {
+	if precision <= 0 {
+		return kml.Coordinate{Lon: p.Lon(), Lat: p.Lat()}
+	}
+	scale := math.Pow(10, float64(precision))
+	return kml.Coordinate{Lon: math.Round(p.Lon()*scale) / scale, Lat: math.Round(p.Lat()*scale) / scale}
+}
+
+// writeKML writes k to w, zipped up as a KMZ if kmz is true and indented
+// if pretty is true.
+func writeKML(w io.Writer, k *kml.CompoundElement, kmz, pretty bool) error {
+	write := k.Write
+	if pretty {
+		write = func(w io.Writer) error { return k.WriteIndent(w, "", "  ") }
+	}
+
+	if !kmz {
+		return write(w)
+	}
+
+	zw := zip.NewWriter(w)
+	dw, err := zw.Create("doc.kml")
+	if err != nil {
+		return err
+	}
+	if err := write(dw); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// mergeLineStrings joins the line strings of consecutive segments whose
+// endpoints touch, returning one line string per contiguous run.
+func mergeLineStrings(segs []segment) []orb.LineString {
+	var (
+		out []orb.LineString
+		cur orb.LineString
+		n   int // segments in cur
+	)
+	for _, seg := range segs {
+		ls := seg.lineString
+		if len(ls) == 0 {
+			continue
+		}
+
+		if n == 0 {
+			cur = append(orb.LineString(nil), ls...)
+			n = 1
+			continue
+		}
+
+		// Segments may be digitized in either direction, so the next
+		// segment, or a run of just one segment, may need flipping for
+		// their ends to meet.
+		switch {
+		case isClose(cur[len(cur)-1], ls[0]):
+		case isClose(cur[len(cur)-1], ls[len(ls)-1]):
+			ls = reverseLineString(ls)
+		case n == 1 && isClose(cur[0], ls[0]):
+			cur = reverseLineString(cur)
+		case n == 1 && isClose(cur[0], ls[len(ls)-1]):
+			cur = reverseLineString(cur)
+			ls = reverseLineString(ls)
+		default:
+			out = append(out, cur)
+			cur = append(orb.LineString(nil), ls...)
+			n = 1
+			continue
+		}
+
+		cur = append(cur, ls[1:]...)
+		n++
+	}
+	if n > 0 {
+		out = append(out, cur)
+	}
+	return out
+}
+
+func reverseLineString(ls orb.LineString) orb.LineString {
+	out := make(orb.LineString, 0, len(ls))
+	for i := len(ls) - 1; i >= 0; i-- {
+		out = append(out, ls[i])
+	}
+	return out
+}
+
+type requestResult struct {
+	startSegments []segment
+	endSegments   []segment
+	routeSegments []segment
+}
+
+type requestHandler struct {
+	req request
+
+	// timeout, if positive, limits how long handling may take.
+	timeout time.Duration
+
+	startHandler func(context.Context, processingRequest) ([]segment, error)
+	endHandler   func(context.Context, processingRequest) ([]segment, error)
+	routeHandler func(context.Context, processingRequest) ([]segment, error)
+}
+
+// handlerFlags defines the flags configuring request handling on fs. The
+// returned func gives the options they, and fuzzyThreshold, set once fs
+// is parsed.
+func handlerFlags(fs *flag.FlagSet, fuzzyThreshold *float64) func() handlerOptions {
+	var (
+		relaxedEnd = fs.Bool("relaxed-end", false, "use the farthest segment from the start when no end segment matches")
+		fuzzy      = fs.Bool("fuzzy", false, "fall back to the most similar street name when none match exactly")
+		maxDetour  = fs.Float64("max-detour", 0, "reject routes longer than this multiple of the straight-line distance between their ends, 0 to disable")
+		timeout    = fs.Duration("timeout", 0, "maximum time to spend resolving each request, 0 for no limit")
+	)
+	return func() handlerOptions {
+		return handlerOptions{relaxedEnd: *relaxedEnd, fuzzy: *fuzzy, fuzzyThreshold: *fuzzyThreshold, maxDetour: *maxDetour, timeout: *timeout}
+	}
+}
+
+type handlerOptions struct {
+	// relaxedEnd has endDiscovery fall back to the segment farthest
+	// from the start when no segment matches the request's to street.
+	relaxedEnd bool
+
+	// maxDetour, if positive, rejects routes whose length is more than
+	// this multiple of the straight-line distance between their ends.
+	maxDetour float64
+
+	// fuzzy has startDiscovery fall back to the most similar street name
+	// when no segments match the request's street name exactly.
+	fuzzy bool
+
+	// fuzzyThreshold is the minimum similarity, from 0 to 1, of a fuzzy
+	// match, or 0 for defaultFuzzyThreshold.
+	fuzzyThreshold float64
+
+	// timeout, if positive, limits how long handling each request may
+	// take.
+	timeout time.Duration
+
+	// noOverrides ignores override files, resolving requests purely by
+	// discovery.
+	noOverrides bool
+}
+
+func newDefaultRequestHandler(st store, req request, opts handlerOptions) requestHandler {
+	override := func(when string, next func(context.Context, processingRequest) ([]segment, error)) func(context.Context, processingRequest) ([]segment, error) {
+		if opts.noOverrides {
+			return next
+		}
+		return overrideDiscovery(when, st, next)
+	}
+
+	threshold := opts.fuzzyThreshold
+	if threshold == 0 {
+		threshold = defaultFuzzyThreshold
+	}
+
+	return requestHandler{
+		req:          req,
+		timeout:      opts.timeout,
+		startHandler: streetCheck("start", override("start", startDiscovery(st, opts.fuzzy, threshold))),
+		endHandler:   streetCheck("end", override("end", endDiscovery(st, opts.relaxedEnd))),
+		routeHandler: detourCheck(opts.maxDetour, override("route", routeDiscovery(st, !opts.noOverrides))),
+	}
+}
+
+type processingRequest struct {
+	req           request
+	startSegments []segment
+	endSegments   []segment
+}
+
+type requestAttempt struct {
+	startSegments []segment
+	startErr      error
+
+	endSegments []segment
+	endErr      error
+
+	routeSegments []segment
+	routeErr      error
+}
+
+// onRoute reports whether any segment a resolves to, as far as it got, is
+// on the route with routeID.
+func (a requestAttempt) onRoute(routeID int) bool {
+	for _, segs := range [][]segment{a.startSegments, a.endSegments, a.routeSegments} {
+		for _, seg := range segs {
+			if seg.routeID == routeID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s requestHandler) handleAttempt(ctx context.Context) requestAttempt {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	att := requestAttempt{}
+
+	preq := processingRequest{
+		req: s.req,
+	}
+
+	att.startSegments, att.startErr = s.startHandler(ctx, preq)
+	if len(att.startSegments) == 0 {
+		if att.startErr == nil {
+			att.startErr = fmt.Errorf("no start segments found")
+		}
+		att.endErr = fmt.Errorf("no start segments found")
+		att.routeErr = fmt.Errorf("no start segments found")
+		return att
+	}
+	preq.startSegments = att.startSegments
+
+	att.endSegments, att.endErr = s.endHandler(ctx, preq)
+	if len(att.endSegments) == 0 {
+		if att.endErr == nil {
+			att.endErr = fmt.Errorf("no end segments found")
+		}
+		att.routeErr = fmt.Errorf("no end segments found")
+		return att
+	}
+	preq.endSegments = att.endSegments
+
+	att.routeSegments, att.routeErr = s.routeHandler(ctx, preq)
+	return att
+}
+
+// logRequestError logs err from handling req, including the stage that
+// failed if known.
+func logRequestError(req request, err error) {
+	var stage string
+	var rerr *requestError
+	if errors.As(err, &rerr) {
+		stage = rerr.stage
+	}
+	slog.Error("request failed", "rank", req.rank, "street", req.streetName, "stage", stage, "err", err)
+}
+
+// requestError is returned by handle to note which stage of processing
+// failed.
+type requestError struct {
+	stage string
+	err   error
+}
+
+func (e *requestError) Error() string {
+	return e.stage + ": " + e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// arrowPlacemarks returns an arrow placemark for each segment in route,
+// placed at its middle and pointing in its direction of travel. Each
+// placemark starts with extra, such as a TimeSpan.
+func arrowPlacemarks(route []segment, precision int, extra ...kml.Element) []kml.Element {
+	var out []kml.Element
+	for i, seg := range route {
+		ls := seg.lineString
+		if len(ls) < 2 {
+			continue
+		}
+		if !travelsForward(route, i) {
+			ls = reverseLineString(ls)
+		}
+
+		// Find the piece of the line string containing its midpoint.
+		half := seg.length / 2
+		var j int
+		for j = 0; j < len(ls)-2; j++ {
+			d := geo.Distance(ls[j], ls[j+1])
+			if d >= half {
+				break
+			}
+			half -= d
+		}
+		a, b := ls[j], ls[j+1]
+		mid := geo.Midpoint(a, b)
+
+		elems := append([]kml.Element{}, extra...)
+		elems = append(elems,
+			kml.Style(kml.IconStyle(
+				kml.Heading(geo.Bearing(a, b)),
+				kml.Scale(0.5),
+				kml.Icon(kml.Href(arrowIcon)),
+			)),
+			kml.Point(kml.Coordinates(kmlCoordinate(mid, precision))),
+		)
+		out = append(out, kml.Placemark(elems...))
+	}
+	return out
+}
+
+// segmentLabelPlacemarks returns a point placemark at the middle of each
+// segment in route, named by the cross streets it runs between in its
+// direction of travel and shown as just the label. extra, such as a
+// TimeSpan, follows each placemark's name and description.
+func segmentLabelPlacemarks(route []segment, precision int, extra ...kml.Element) []kml.Element {
+	var out []kml.Element
+	for i, seg := range route {
+		if len(seg.lineString) == 0 {
+			continue
+		}
+		from, to := seg.from, seg.to
+		if !travelsForward(route, i) {
+			from, to = to, from
+		}
+
+		elems := []kml.Element{
+			kml.Name(from + " → " + to),
+			kml.Description(seg.String()),
+		}
+		elems = append(elems, extra...)
+		elems = append(elems,
+			kml.Style(
+				kml.IconStyle(kml.Scale(0)),
+				kml.LabelStyle(kml.Scale(0.7)),
+			),
+			kml.Point(kml.Coordinates(kmlCoordinate(seg.midpoint, precision))),
+		)
+		out = append(out, kml.Placemark(elems...))
+	}
+	return out
+}
+
+// endpointPlacemarks returns point placemarks at the start and end of the
+// request's route, named by the cross streets they were resolved at, or
+// as the start or end of the street when unbounded. extra, such as a
+// TimeSpan, follows each placemark's name and description.
+func endpointPlacemarks(req request, res requestResult, precision int, extra ...kml.Element) []kml.Element {
+	lines := mergeLineStrings(res.routeSegments)
+	if len(lines) == 0 {
+		return nil
+	}
+	last := lines[len(lines)-1]
+
+	from, to := resolvedCrossStreets(req, res)
+	if from == "" {
+		from = "Start of " + req.streetName
+	}
+	if to == "" {
+		to = "End of " + req.streetName
+	}
+
+	var out []kml.Element
+	for _, ep := range []struct {
+		name string
+		p    orb.Point
+	}{
+		{from, lines[0][0]},
+		{to, last[len(last)-1]},
+	} {
+		elems := []kml.Element{
+			kml.Name(ep.name),
+			kml.Description(req.String()),
+		}
+		elems = append(elems, extra...)
+		elems = append(elems, kml.Point(kml.Coordinates(kmlCoordinate(ep.p, precision))))
+		out = append(out, kml.Placemark(elems...))
+	}
+	return out
+}
+
+// lineMidpoint returns the point halfway along ls.
+func lineMidpoint(ls orb.LineString) orb.Point {
+	if len(ls) == 0 {
+		return orb.Point{}
+	}
+
+	half := geo.Length(ls) / 2
+	for i := 0; i < len(ls)-1; i++ {
+		a, b := ls[i], ls[i+1]
+		d := geo.Distance(a, b)
+		if d >= half {
+			if d == 0 {
+				return a
+			}
+			f := half / d
+			return orb.Point{a.Lon() + f*(b.Lon()-a.Lon()), a.Lat() + f*(b.Lat()-a.Lat())}
+		}
+		half -= d
+	}
+	return ls[len(ls)-1]
+}
+
+// travelsForward reports whether route[i] is travelled from its first
+// point to its last. One-way segments go their direction, and two-way
+// segments go the way that joins up with their neighbours in route.
+func travelsForward(route []segment, i int) bool {
+	seg := route[i]
+	switch seg.direction {
+	case "FOTD":
+		return true
+	case "FDTO":
+		return false
+	}
+
+	touches := func(p orb.Point, other segment) bool {
+		return isClose(p, other.firstPoint) || isClose(p, other.lastPoint)
+	}
+	if i+1 < len(route) {
+		return touches(seg.lastPoint, route[i+1])
+	}
+	if i > 0 {
+		return touches(seg.firstPoint, route[i-1])
+	}
+	return true
+}
+
+// rankColorGroup returns which of groups colors rank falls in, spreading
+// ranks from lo to hi evenly across them.
+func rankColorGroup(rank, lo, hi, groups int) int {
+	if hi <= lo {
+		return 0
+	}
+	g := int(float64(rank-lo) / float64(hi-lo+1) * float64(groups))
+	return max(0, min(g, groups-1))
+}
+
+// resolvedCrossStreets returns the names, as given in the centreline
+// data, of the cross streets that res's start and end segments matched
+// for req. Either is empty if the request has no such bound.
+func resolvedCrossStreets(req request, res requestResult) (from, to string) {
+	crossStreet := func(segs []segment, names []string) string {
+		if len(segs) == 0 {
+			return ""
+		}
+		for _, name := range names {
+			for _, cs := range []string{segs[0].from, segs[0].to} {
+				if strings.EqualFold(cs, name) {
+					return cs
+				}
+			}
+		}
+		return ""
+	}
+
+	if req.from != "" {
+		from = crossStreet(res.startSegments, []string{normalizeStreetName(req.from)})
+	}
+	if req.to != "" {
+		to = crossStreet(res.endSegments, toStreets(req.to))
+	}
+	return from, to
+}
+
+// kmlData returns a Data element named name holding value, for a
+// placemark's ExtendedData.
+func kmlData(name, value string) *kml.CompoundElement {
+	d := kml.Data(kml.Value(value))
+	d.Attr = append(d.Attr, xml.Attr{Name: xml.Name{Local: "name"}, Value: name})
+	return d
+}
+
+// unresolvedPlacemark describes a request that failed with err. If any
+// start segments were found, it's placed at the start of the first.
+func unresolvedPlacemark(req request, att requestAttempt, err error, precision int) kml.Element {
+	pm := kml.Placemark(
+		kml.Name(req.String()),
+		kml.Description(err.Error()),
+	)
+	if len(att.startSegments) > 0 && len(att.startSegments[0].lineString) > 0 {
+		pt := att.startSegments[0].lineString[0]
+		pm.Add(kml.Point(kml.Coordinates(kmlCoordinate(pt, precision))))
+	}
+	return pm
+}
+
+func (s requestHandler) handle(ctx context.Context) (requestResult, error) {
+	return s.handleAttempt(ctx).result()
+}
+
+// result returns the attempt's segments, or an error noting the first
+// stage that failed.
+func (att requestAttempt) result() (requestResult, error) {
+	for _, se := range []struct {
+		stage string
+		err   error
+	}{
+		{"start", att.startErr},
+		{"end", att.endErr},
+		{"route", att.routeErr},
+	} {
+		if se.err != nil {
+			return requestResult{}, &requestError{stage: se.stage, err: se.err}
+		}
+	}
+
+	return requestResult{
+		startSegments: att.startSegments,
+		endSegments:   att.endSegments,
+		routeSegments: att.routeSegments,
+	}, nil
+}
+
+// overrideDir holds override files, named by overridePath.
+const overrideDir = "overrides"
+
+// overridePath returns the path of the file overriding the segments found
+// for the request with stable ID id when ("start", "end" or "route"), or
+// pinning where a loop starts ("loopstart").
+func overridePath(id string, when string) string {
+	return filepath.Join(overrideDir, id+"."+when)
+}
+
+// migrateOverrideFiles renames override files named by the rank of a
+// request in st to use its stable ID instead. The ranks must be those the
+// overrides were written for.
+func migrateOverrideFiles(ctx context.Context, st store) error {
+	reqs, err := st.requests(ctx, requestFilter{})
+	if err != nil {
+		return err
+	}
+
+	for _, req := range reqs {
+		for _, when := range overrideWhens {
+			old := filepath.Join(overrideDir, fmt.Sprintf("%d.%s", req.rank, when))
+			if _, err := os.Stat(old); errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			path := overridePath(req.stableID(), when)
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("not renaming %s, %s already exists", old, path)
+			}
+			if err := os.Rename(old, path); err != nil {
+				return err
+			}
+			slog.Info("renamed override", "old", old, "new", path)
+		}
+	}
+	return nil
+}
+
+func overrideDiscovery(when string, st store, next func(ctx context.Context, preq processingRequest) ([]segment, error)) func(ctx context.Context, preq processingRequest) ([]segment, error) {
+	return func(ctx context.Context, preq processingRequest) ([]segment, error) {
+		f, err := os.Open(overridePath(preq.req.stableID(), when))
+		if os.IsNotExist(err) {
+			if _, err := os.Stat(filepath.Join(overrideDir, fmt.Sprintf("%d.%s", preq.req.rank, when))); err == nil {
+				slog.Warn("ignoring override named by rank, run migrate --overrides", "rank", preq.req.rank, "when", when)
+			}
+			return next(ctx, preq)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		ids, err := readOverrideIDs(f)
+		if err != nil {
+			return nil, err
+		}
+		tracef(ctx, "%s: using override %s with segments %v", when, f.Name(), ids)
+		return st.filterSegments(ctx, segmentFilter{ids: ids})
+	}
+}
+
+// readOverrideIDs reads the segment IDs of an override file, one per line.
+func readOverrideIDs(r io.Reader) ([]int, error) {
+	var ids []int
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		id, err := strconv.Atoi(sc.Text())
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, sc.Err()
+}
+
+// detourCheck rejects routes from next whose detour ratio exceeds max,
+// unless max is zero.
+func detourCheck(max float64, next func(ctx context.Context, preq processingRequest) ([]segment, error)) func(ctx context.Context, preq processingRequest) ([]segment, error) {
+	return func(ctx context.Context, preq processingRequest) ([]segment, error) {
+		route, err := next(ctx, preq)
+		if err != nil || max <= 0 {
+			return route, err
+		}
+
+		if ratio, ok := detourRatio(route); ok && ratio > max {
+			return nil, fmt.Errorf("route detour ratio %.1f exceeds %.1f", ratio, max)
+		}
+		return route, nil
+	}
+}
+
+// detourRatio returns the total length of route divided by the
+// straight-line distance between its ends. ok is false if the ends are too
+// close together for the ratio to be meaningful, such as for loops.
+func detourRatio(route []segment) (ratio float64, ok bool) {
+	lines := mergeLineStrings(route)
+	if len(lines) == 0 {
+		return 0, false
+	}
+
+	first := lines[0][0]
+	last := lines[len(lines)-1][len(lines[len(lines)-1])-1]
+	straight := geo.Distance(first, last)
+	if straight < 1.0 {
+		return 0, false
+	}
+
+	return routeLength(route) / straight, true
+}
+
+// streetCheck warns when segments from next aren't on the request's
+// street, which usually means its source row is wrong.
+func streetCheck(when string, next func(ctx context.Context, preq processingRequest) ([]segment, error)) func(ctx context.Context, preq processingRequest) ([]segment, error) {
+	return func(ctx context.Context, preq processingRequest) ([]segment, error) {
+		segs, err := next(ctx, preq)
+		if ids := offStreet(preq.req.streetName, segs); len(ids) > 0 {
+			slog.Warn("segments not on request street", "rank", preq.req.rank, "street", preq.req.streetName, "when", when, "segments", ids)
+		}
+		return segs, err
+	}
+}
+
+// offStreet returns the IDs of segs whose full or base name isn't street,
+// as when a request's cross streets belong to a different street.
+func offStreet(street string, segs []segment) []int {
+	name := normalizeStreetName(street)
+
+	var ids []int
+	for _, seg := range segs {
+		if normalizeStreetName(seg.name) != name && normalizeStreetName(seg.streetName) != name {
+			ids = append(ids, seg.id)
+		}
+	}
+	return ids
+}
+
+// backtrackDistance is how close, in meters, the ends of two route
+// segments must be for one to be considered to retrace the other.
+const backtrackDistance = 30.0
+
+// backtracks returns the IDs of segments in route that retrace an earlier
+// segment in the opposite direction of travel, as when a route doubles
+// back on itself along a divided road.
+func backtracks(route []segment) []int {
+	type travel struct{ from, to orb.Point }
+	travels := make([]travel, len(route))
+	for i, seg := range route {
+		if travelsForward(route, i) {
+			travels[i] = travel{seg.firstPoint, seg.lastPoint}
+		} else {
+			travels[i] = travel{seg.lastPoint, seg.firstPoint}
+		}
+	}
+
+	near := func(a, b orb.Point) bool {
+		return geo.Distance(a, b) < backtrackDistance
+	}
+
+	var ids []int
+	for i := range route {
+		for j := 0; j < i; j++ {
+			if near(travels[i].from, travels[j].to) && near(travels[i].to, travels[j].from) {
+				ids = append(ids, route[i].id)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// normalizeStreetName prepares a street name for matching: segment names
+// are upper case with no apostrophes, and whitespace is collapsed.
+func normalizeStreetName(name string) string {
+	return strings.Join(strings.Fields(strings.ToUpper(strings.ReplaceAll(name, "'", ""))), " ")
+}
+
+// streetTypeSpellings groups the ways a street type may be written, in
+// full or abbreviated.
+var streetTypeSpellings = [][]string{
+	{"AVENUE", "AVE", "AV"},
+	{"BOULEVARD", "BLVD"},
+	{"CIRCLE", "CIR"},
+	{"CLOSE", "CL"},
+	{"COURT", "CRT", "CT"},
+	{"CRESCENT", "CRES", "CRS"},
+	{"DRIVE", "DR"},
+	{"GROVE", "GRV"},
+	{"HEIGHTS", "HTS"},
+	{"HIGHWAY", "HWY"},
+	{"LANE", "LN"},
+	{"PARKWAY", "PKWY", "PKY"},
+	{"PLACE", "PL"},
+	{"ROAD", "RD"},
+	{"STREET", "ST"},
+	{"TERRACE", "TERR", "TER"},
+	{"TRAIL", "TRL"},
+}
+
+// splitStreetType splits the normalized street name into the name before
+// its type and the spellings of its type, if its last word is one.
+func splitStreetType(name string) (base string, types []string, ok bool) {
+	i := strings.LastIndexByte(name, ' ')
+	if i < 0 {
+		return "", nil, false
+	}
+	for _, spellings := range streetTypeSpellings {
+		if slices.Contains(spellings, name[i+1:]) {
+			return name[:i], spellings, true
+		}
+	}
+	return "", nil, false
+}
+
+// closestStreetName returns the name in names most similar to name, and
+// its similarity from 0 to 1.
+func closestStreetName(name string, names []string) (string, float64) {
+	var (
+		best    string
+		bestSim float64
+	)
+	for _, n := range names {
+		if sim := similarity(name, n); sim > bestSim {
+			best, bestSim = n, sim
+		}
+	}
+	return best, bestSim
+}
+
+// similarity is 1 minus the edit distance between a and b scaled by the
+// length of the longer.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	n := len(ra)
+	if len(rb) > n {
+		n = len(rb)
+	}
+	if n == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(n)
+}
+
+// levenshtein returns the number of single rune insertions, deletions
+// and substitutions needed to turn a into b.
+func levenshtein(a, b []rune) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		diag := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			next := min(row[j]+1, row[j-1]+1, diag+cost)
+			diag, row[j] = row[j], next
+		}
+	}
+	return row[len(b)]
+}
+
+// defaultFuzzyThreshold is the minimum similarity, from 0 to 1, a street
+// name must have to be used as a fuzzy match, unless set otherwise.
+const defaultFuzzyThreshold = 0.8
+
+// startDiscovery finds segments of the request's street that touch its
+// from street. A street name without a suffix, such as "Main", matches
+// streets with that base name, such as Main St and Main Ave, and the to
+// street is used to choose between them. If fuzzy is true and the street
+// name matches no segments, the most similar street name is tried instead,
+// if its similarity is at least threshold.
+func startDiscovery(st store, fuzzy bool, threshold float64) func(ctx context.Context, preq processingRequest) ([]segment, error) {
+	return func(ctx context.Context, preq processingRequest) ([]segment, error) {
+		name := normalizeStreetName(preq.req.streetName)
+		filter := segmentFilter{fullNames: []string{name}}
+		if preq.req.from != "" {
+			dqf := normalizeStreetName(preq.req.from)
+			filter.endStreets = []string{dqf}
+		}
+
+		segs, err := st.filterSegments(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		tracef(ctx, "start: %d segments named %s ending at %q", len(segs), name, filter.endStreets)
+
+		// The request may spell the street type differently to the
+		// data, such as CRESCENT for CRS, so match the rest of the name
+		// and any spelling of its type separately.
+		if base, types, ok := splitStreetType(name); ok && len(segs) == 0 {
+			typeFilter := filter
+			typeFilter.fullNames = nil
+			typeFilter.baseNames = []string{base}
+			typeFilter.streetTypes = types
+			segs, err = st.filterSegments(ctx, typeFilter)
+			if err != nil {
+				return nil, err
+			}
+			tracef(ctx, "start: %d segments with base name %s and type in %v", len(segs), base, types)
+		}
+
+		if len(segs) == 0 {
+			baseFilter := filter
+			baseFilter.fullNames = nil
+			baseFilter.baseNames = []string{name}
+			segs, err = st.filterSegments(ctx, baseFilter)
+			if err != nil {
+				return nil, err
+			}
+			tracef(ctx, "start: %d segments with base name %s", len(segs), name)
+		}
+
+		if len(segs) == 0 && fuzzy {
+			names, err := st.streetNames(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			match, sim := closestStreetName(name, names)
+			if sim >= threshold && match != name {
+				slog.Warn("using low-confidence fuzzy street name match", "rank", preq.req.rank, "street", preq.req.streetName, "match", match, "similarity", sim)
+
+				filter.fullNames = []string{match}
+				segs, err = st.filterSegments(ctx, filter)
+				if err != nil {
+					return nil, err
+				}
+				tracef(ctx, "start: %d segments named %s, a fuzzy match with similarity %.2f", len(segs), match, sim)
+			}
+		}
+
+		return disambiguateRoutes(ctx, st, segs, preq.req.to)
+	}
+}
+
+// disambiguateRoutes narrows segs, if they're on more than one route, to
+// those on the only route that also touches the to street. It's an error
+// if there isn't exactly one such route.
+func disambiguateRoutes(ctx context.Context, st store, segs []segment, to string) ([]segment, error) {
+	var routeIDs []int
+	for _, seg := range segs {
+		if !contains(routeIDs, seg.routeID) {
+			routeIDs = append(routeIDs, seg.routeID)
+		}
+	}
+	if len(routeIDs) <= 1 {
+		return segs, nil
+	}
+
+	if to != "" {
+		touching, err := st.filterSegments(ctx, segmentFilter{routeIDs: routeIDs, endStreets: toStreets(to)})
+		if err != nil {
+			return nil, err
+		}
+
+		var toRouteIDs []int
+		for _, seg := range touching {
+			if !contains(toRouteIDs, seg.routeID) {
+				toRouteIDs = append(toRouteIDs, seg.routeID)
+			}
+		}
+
+		tracef(ctx, "start: segments on routes %v, of which %v touch %q", routeIDs, toRouteIDs, to)
+		if len(toRouteIDs) == 1 {
+			var out []segment
+			for _, seg := range segs {
+				if seg.routeID == toRouteIDs[0] {
+					out = append(out, seg)
+				}
+			}
+			return out, nil
+		}
+	}
+
+	return nil, fmt.Errorf("discovered segments with %d different route IDs", len(routeIDs))
+}
+
+// endDiscovery finds segments on the start route that touch the request's
+// to street, or any of them if it lists several. If relaxed is true and
+// none do, the segment farthest from the start is used instead.
+func endDiscovery(st store, relaxed bool) func(ctx context.Context, preq processingRequest) ([]segment, error) {
+	return func(ctx context.Context, preq processingRequest) ([]segment, error) {
+		routeID := preq.startSegments[0].routeID
+		filter := segmentFilter{routeIDs: []int{routeID}}
+		if preq.req.to != "" {
+			filter.endStreets = toStreets(preq.req.to)
+		}
+
+		segs, err := st.filterSegments(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		tracef(ctx, "end: %d segments on route %d ending at %q", len(segs), routeID, filter.endStreets)
+
+		if len(segs) > 0 || !relaxed || preq.req.to == "" {
+			return segs, nil
+		}
+
+		links, err := st.routeLinks(ctx, routeID)
+		if err != nil {
+			return nil, err
+		}
+
+		id := farthestSegment(links, preq.startSegments)
+		slog.Warn("using heuristic end segment", "rank", preq.req.rank, "street", preq.req.streetName, "to", preq.req.to, "segment", id)
+		tracef(ctx, "end: using segment %d, farthest from the start", id)
+
+		return st.filterSegments(ctx, segmentFilter{ids: []int{id}})
+	}
+}
+
+// toStreetSep separates alternative cross streets in a request's to,
+// such as "Oak St|Elm St", of which the route ends at whichever is reached
+// first.
+const toStreetSep = "|"
+
+// toStreets returns the normalized cross streets listed in to.
+func toStreets(to string) []string {
+	var out []string
+	for _, s := range strings.Split(to, toStreetSep) {
+		if s := normalizeStreetName(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// farthestSegment returns the ID of the segment with the greatest link
+// distance from any of the start segments.
+func farthestSegment(links map[int][]int, start []segment) int {
+	dist := make(map[int]int)
+	var q []int
+	for _, seg := range start {
+		if _, ok := dist[seg.id]; ok {
+			continue
+		}
+		dist[seg.id] = 0
+		q = append(q, seg.id)
+	}
+
+	far := q[0]
+	for len(q) > 0 {
+		id := q[0]
+		q = q[1:]
+		if dist[id] > dist[far] {
+			far = id
+		}
+
+		for _, nid := range links[id] {
+			if _, ok := dist[nid]; ok {
+				continue
+			}
+			dist[nid] = dist[id] + 1
+			q = append(q, nid)
+		}
+	}
+	return far
+}
+
+// routeDiscovery finds the route between a request's start and end
+// segments, using any loopstart override if overrides is set.
+func routeDiscovery(st store, overrides bool) func(ctx context.Context, preq processingRequest) ([]segment, error) {
+	return func(ctx context.Context, preq processingRequest) ([]segment, error) {
+		// For entire streets, return all segments on the route.
+		if preq.req.from == "" && preq.req.to == "" {
+			return st.filterSegments(ctx, segmentFilter{routeIDs: []int{preq.startSegments[0].routeID}})
+		}
+
+		// For "start to X" requests, every segment on the street is a
+		// start segment, so find the longest route (by segment count) from
+		// any of them to get one starting at the natural start of the street.
+		if preq.req.from == "" {
+			var route []segment
+			for _, start := range preq.startSegments {
+				c, err := st.route(ctx, []segment{start}, preq.endSegments)
+				if errors.Is(err, errNoPath) {
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				if len(c) > len(route) {
+					route = c
+				}
+			}
+			if route == nil {
+				return nil, fmt.Errorf("could not find path from any start segment")
+			}
+			return route, nil
+		}
+
+		// For "from X to X" requests, such as a crescent or loop meeting
+		// X at both ends, find the longest route (by segment count) from a
+		// deterministic start so the whole loop is taken the same way
+		// each time.
+		//
+		// An example is "Summit Cres from High Timber Dr to High Timber Dr"
+		if preq.req.to == preq.req.from {
+			start, err := loopStart(ctx, st, preq, overrides)
+			if err != nil {
+				return nil, err
+			}
+			return longestRoute(ctx, st, []segment{start}, preq.endSegments)
+		}
+
+		route, err := st.route(ctx, preq.startSegments, preq.endSegments)
+		if errors.Is(err, errNoPath) {
+			// The request's from and to may be the reverse of the
+			// route's segment direction, so try routing from the end
+			// back to the start, taking the shortest from any end.
+			var rev []segment
+			for _, end := range preq.endSegments {
+				c, rerr := st.route(ctx, []segment{end}, preq.startSegments)
+				if errors.Is(rerr, errNoPath) {
+					continue
+				}
+				if rerr != nil {
+					return nil, rerr
+				}
+				if rev == nil || len(c) < len(rev) {
+					rev = c
+				}
+			}
+			tracef(ctx, "route: no path forward (%v), trying from the end back to the start", err)
+			if rev == nil {
+				return nil, err
+			}
+			route = reverseSegments(rev)
+		} else if err != nil {
+			return nil, err
+		}
+
+		// If there's a start, trim the start of the path so it only
+		// begins with one start segment.
+		if preq.req.from != "" {
+			startIDs := make([]int, len(preq.startSegments))
+			for _, seg := range preq.startSegments {
+				startIDs = append(startIDs, seg.id)
+			}
+			for len(route) > 2 && contains(startIDs, route[1].id) {
+				route = route[1:]
+			}
+		}
+
+		// For "from X to end" requests, find the longest route (by segment count).
+		if preq.req.to == "" {
+			return longestRoute(ctx, st, route, preq.endSegments)
+		}
+
+		return route, nil
+	}
+}
+
+// loopStartOverride returns the segment the request's loopstart override
+// pins its loop's start to. ok is false if it has none.
+func loopStartOverride(ctx context.Context, st store, req request) (seg segment, ok bool, err error) {
+	f, err := os.Open(overridePath(req.stableID(), "loopstart"))
+	if os.IsNotExist(err) {
+		return segment{}, false, nil
+	}
+	if err != nil {
+		return segment{}, false, err
+	}
+	defer f.Close()
+
+	ids, err := readOverrideIDs(f)
+	if err != nil {
+		return segment{}, false, err
+	}
+	if len(ids) != 1 {
+		return segment{}, false, fmt.Errorf("loop start override %s has %d segments, want 1", f.Name(), len(ids))
+	}
+	segs, err := st.filterSegments(ctx, segmentFilter{ids: ids})
+	if err != nil {
+		return segment{}, false, err
+	}
+	if len(segs) == 0 {
+		return segment{}, false, fmt.Errorf("loop start override %s: no segment %d", f.Name(), ids[0])
+	}
+	tracef(ctx, "route: using loop start override %s with segment %d", f.Name(), ids[0])
+	return segs[0], true, nil
+}
+
+// longestRoute returns the longest, by segment count, of route and the
+// routes from its first segment to each of ends.
+func longestRoute(ctx context.Context, st store, route []segment, ends []segment) ([]segment, error) {
+	path := route
+	for _, end := range ends {
+		c, err := st.route(ctx, []segment{route[0]}, []segment{end})
+		if err != nil {
+			return nil, err
+		}
+		if len(c) > len(path) {
+			path = c
+		}
+	}
+	return path, nil
+}
+
+// loopStart picks the segment a "from X to X" request starts from. A
+// loopstart override, if overrides is set, pins it; otherwise it's the start
+// segment whose end at X is nearest where X meets the street, preferring
+// one digitized leaving X and then the lowest ID when that's ambiguous, as
+// for a loop meeting X at one point or a crescent touching it at both ends.
+func loopStart(ctx context.Context, st store, preq processingRequest, overrides bool) (segment, error) {
+	if overrides {
+		seg, ok, err := loopStartOverride(ctx, st, preq.req)
+		if err != nil || ok {
+			return seg, err
+		}
+	}
+
+	if len(preq.startSegments) == 0 {
+		return segment{}, fmt.Errorf("no start segments")
+	}
+
+	street, cross := normalizeStreetName(preq.req.streetName), normalizeStreetName(preq.req.from)
+
+	// Where the cross street meets the street, from its own segments
+	// ending there.
+	crossSegs, err := st.filterSegments(ctx, segmentFilter{fullNames: []string{cross}, endStreets: []string{street}})
+	if err != nil {
+		return segment{}, err
+	}
+	var meets []orb.Point
+	for _, seg := range crossSegs {
+		if normalizeStreetName(seg.from) == street {
+			meets = append(meets, seg.firstPoint)
+		}
+		if normalizeStreetName(seg.to) == street {
+			meets = append(meets, seg.lastPoint)
+		}
+	}
+
+	// crossEnd returns the distance from seg's end at the cross street to
+	// the nearest place the streets meet, and whether seg leaves from it.
+	crossEnd := func(seg segment) (float64, bool) {
+		leaves := normalizeStreetName(seg.from) == cross
+		p := seg.lastPoint
+		if leaves {
+			p = seg.firstPoint
+		}
+		d := math.Inf(1)
+		for _, m := range meets {
+			// Ends within snapping distance count as meeting it.
+			d = min(d, max(geo.Distance(p, m)-snapTolerance, 0))
+		}
+		return d, leaves
+	}
+
+	start := preq.startSegments[0]
+	startDist, startLeaves := crossEnd(start)
+	for _, seg := range preq.startSegments[1:] {
+		d, leaves := crossEnd(seg)
+		switch {
+		case d < startDist,
+			d == startDist && leaves && !startLeaves,
+			d == startDist && leaves == startLeaves && seg.id < start.id:
+			start, startDist, startLeaves = seg, d, leaves
+		}
+	}
+	tracef(ctx, "route: starting loop at segment %d", start.id)
+	return start, nil
+}
+
+type request struct {
+	streetName string
+	from, to   string
+	district   string
+	rank       int
+
+	// rawFrom and rawTo are the cross streets exactly as given in the
+	// requests file, such as "All" or "End", before normalization.
+	rawFrom, rawTo string
+
+	// extra holds the requests file's other non-empty columns, such as
+	// petition counts or notes, by header.
+	extra map[string]string
+}
+
+func (r request) String() string {
+	out := strconv.Itoa(r.rank) + " " + r.streetName + " "
+	if r.from == "" && r.to == "" {
+		out += "(all)"
+	} else {
+		out += "from " + r.from
+		if r.to != "" {
+			out += " to " + r.to
+		}
+	}
+	return out
+}
+
+// stableID identifies the request by its street, cross streets and
+// district, so it stays the same when requests are re-ranked.
+func (r request) stableID() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		normalizeStreetName(r.streetName),
+		normalizeStreetName(r.from),
+		normalizeStreetName(r.to),
+		normalizeDistrict(r.district),
+	}, "\x00")))
+	return hex.EncodeToString(sum[:6])
+}
+
+type requestFilter struct {
+	// wholeStreetOnly, when set, limits requests to those covering the
+	// whole street (true) or those bounded by cross streets (false).
+	wholeStreetOnly *bool
+
+	// rankMin and rankMax, if non-zero, limit requests to those ranked
+	// within them, inclusive.
+	rankMin, rankMax int
+
+	// district, if set, limits requests to those in the district,
+	// ignoring case and surrounding whitespace.
+	district string
+}
+
+// intList is a flag of ints, given comma-separated or by repeating it.
+type intList []int
+
+func (l *intList) String() string {
+	s := make([]string, 0, len(*l))
+	for _, n := range *l {
+		s = append(s, strconv.Itoa(n))
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *intList) Set(v string) error {
+	for _, f := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return err
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+// intListFlag defines an intList flag in fs.
+func intListFlag(fs *flag.FlagSet, name, usage string) *intList {
+	l := new(intList)
+	fs.Var(l, name, usage)
+	return l
+}
+
+// newRequestFilter builds a requestFilter from the --whole-street and
+// --no-whole-street flags.
+func newRequestFilter(wholeStreet, noWholeStreet bool) (requestFilter, error) {
+	var filter requestFilter
+	switch {
+	case wholeStreet && noWholeStreet:
+		return requestFilter{}, fmt.Errorf("can't use both -whole-street and -no-whole-street")
+	case wholeStreet:
+		filter.wholeStreetOnly = &wholeStreet
+	case noWholeStreet:
+		f := false
+		filter.wholeStreetOnly = &f
+	}
+	return filter, nil
+}
+
+func (s sqliteStore) requests(ctx context.Context, filter requestFilter) ([]request, error) {
+	where, args := []string{"1 = 1"}, []interface{}{}
+
+	if filter.wholeStreetOnly != nil {
+		if *filter.wholeStreetOnly {
+			where = append(where, "(start is null and end is null)")
+		} else {
+			where = append(where, "(start is not null or end is not null)")
+		}
+	}
+
+	if filter.rankMin > 0 {
+		where = append(where, "rank >= ?")
+		args = append(args, filter.rankMin)
+	}
+
+	if filter.rankMax > 0 {
+		where = append(where, "rank <= ?")
+		args = append(args, filter.rankMax)
+	}
+
+	if filter.district != "" {
+		// Databases built before districts were normalized on load may
+		// still have them as given.
+		where = append(where, "upper(trim(district)) = ?")
+		args = append(args, normalizeDistrict(filter.district))
+	}
+
+	q := "select street_name, start, end, district, rank, raw_start, raw_end, extra from requests where "
+	q += strings.Join(where, " and ")
+	q += " order by rank"
+
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reqs []request
+	for rows.Next() {
+		var req request
+		var start, end, rawStart, rawEnd, extra sql.NullString
+		if err := rows.Scan(&req.streetName, &start, &end, &req.district, &req.rank, &rawStart, &rawEnd, &extra); err != nil {
+			return nil, err
+		}
+		if extra.Valid {
+			if err := json.Unmarshal([]byte(extra.String), &req.extra); err != nil {
+				return nil, fmt.Errorf("request with rank %d: extra: %w", req.rank, err)
+			}
+		}
+		req.from = start.String
+		req.to = end.String
+		req.rawFrom = rawStart.String
+		req.rawTo = rawEnd.String
+		reqs = append(reqs, req)
+	}
+
+	return reqs, rows.Err()
+}
+
+type segment struct {
+	id        int
+	name      string
+	from, to  string
+	direction string
+	routeID   int
+
+	lineString orb.LineString
+	firstPoint orb.Point
+	lastPoint  orb.Point
+
+	// length is the length of lineString in meters, and midpoint the
+	// point halfway along it.
+	length   float64
+	midpoint orb.Point
+
+	streetName  string
+	streetType  string
+	streetClass string
+}
+
+func (s segment) String() string {
+	return fmt.Sprintf("%d %s from %s to %s", s.id, s.name, s.from, s.to)
+}
+
+type sqliteStore struct {
+	db *sql.DB
+
+	// maxExplored limits how many segment ends route explores before
+	// giving up. Zero means defaultMaxExplored.
+	maxExplored int
+
+	// avoidClasses are the street classes route won't pass through,
+	// other than on the segments it starts or ends on.
+	avoidClasses []string
+
+	// dropDuplicates has loadSegments drop segments dedupeSegments finds
+	// to be duplicates. Otherwise they're only reported.
+	dropDuplicates bool
+
+	// snapTolerance is how close, in metres, segment ends must be for
+	// loadSegments to link them. Zero means the package snapTolerance.
+	snapTolerance float64
+}
+
+// linkTolerance returns how close segment ends must be to link.
+func (s sqliteStore) linkTolerance() float64 {
+	if s.snapTolerance > 0 {
+		return s.snapTolerance
+	}
+	return snapTolerance
+}
+
+// defaultMaxExplored is far more than any street should need.
+const defaultMaxExplored = 100000
+
+// route finds a route between any of the fromSegments to any of the toSegments.
+//
+// Travel respects segment direction: a path enters each segment through
+// one end and leaves through the other, and one-way segments may only be
+// entered at the end their direction starts from.
+func (s sqliteStore) route(ctx context.Context, fromSegments []segment, toSegments []segment) ([]segment, error) {
+	if len(fromSegments) == 0 || len(toSegments) == 0 {
+		return nil, fmt.Errorf("empty fromSegments or empty toSegments")
+	}
+
+	rows, err := s.db.QueryContext(ctx, "select l.id, l.next_id, l.exit_end, l.entry_end, s.st_class from segment_links l join segments s on s.id = l.next_id where l.route_id=(select route_id from segments where id=?) order by l.id, l.next_id", fromSegments[0].id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	g := newRouteGraph(fromSegments[0])
+	for rows.Next() {
+		var (
+			l     segmentLink
+			class sql.NullString
+		)
+		if err := rows.Scan(&l.exit.id, &l.entry.id, &l.exit.end, &l.entry.end, &class); err != nil {
+			return nil, err
+		}
+		g.add(l, slices.ContainsFunc(s.avoidClasses, func(c string) bool { return strings.EqualFold(c, class.String) }))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids, err := g.search(ctx, fromSegments[0], toSegments, s.maxExplored)
+	if err != nil {
+		return nil, err
+	}
+
+	segs, err := s.filterSegments(ctx, segmentFilter{ids: ids})
+	if err != nil {
+		return nil, err
+	}
+	segsByID := make(map[int]segment)
+	for _, seg := range segs {
+		segsByID[seg.id] = seg
+	}
+	route := make([]segment, 0, len(ids))
+	for _, id := range ids {
+		route = append(route, segsByID[id])
+	}
+	return route, nil
+}
+
+// routeGraph is the links between the segments of a route, which route
+// searches.
+type routeGraph struct {
+	// links maps a segment and the end it's left through to the segments,
+	// and their ends, it may be entered from there.
+	links map[segmentEnd][]segmentEnd
+	nodes map[int]bool
+
+	// avoid holds the segments that may only be reached as a destination.
+	avoid map[int]bool
+}
+
+// newRouteGraph returns an empty graph of from's route. from is always in
+// the graph, even if it has no links.
+func newRouteGraph(from segment) routeGraph {
+	return routeGraph{
+		links: make(map[segmentEnd][]segmentEnd),
+		nodes: map[int]bool{from.id: true},
+		avoid: make(map[int]bool),
+	}
+}
+
+// add adds l to the graph, with avoid set if the segment it enters may
+// only be reached as a destination. Links are searched in the order added.
+func (g routeGraph) add(l segmentLink, avoid bool) {
+	if avoid {
+		g.avoid[l.entry.id] = true
+	}
+	g.links[l.exit] = append(g.links[l.exit], l.entry)
+	g.nodes[l.exit.id] = true
+	g.nodes[l.entry.id] = true
+}
+
+// errNoPath is returned, possibly wrapped, by route searches when no path
+// exists.
+var errNoPath = errors.New("could not find path")
+
+// search returns the IDs of the segments on the shortest path from from to
+// any of toSegments, exploring at most maxExplored segment ends, or
+// defaultMaxExplored if it's not positive.
+func (g routeGraph) search(ctx context.Context, from segment, toSegments []segment, maxExplored int) ([]int, error) {
+	for _, seg := range toSegments {
+		if !g.nodes[seg.id] {
+			return nil, fmt.Errorf("to segment %d not found in route graph: %w", seg.id, errNoPath)
+		}
+	}
+
+	toIDs := make([]int, 0, len(toSegments))
+	for _, seg := range toSegments {
+		toIDs = append(toIDs, seg.id)
+	}
+
+	_, entries, err := segmentEnds(from.direction)
+	if err != nil {
+		return nil, err
+	}
+
+	// The search visits segments by the end they were entered through.
+	// prev records how each was reached; when several paths of the same
+	// length reach a segment end, the first found, in link order, wins. A
+	// path never passes through a segment twice, even by its other end.
+	var q []segmentEnd
+	visited := make(map[segmentEnd]bool)
+	prev := make(map[segmentEnd]segmentEnd)
+	for _, end := range entries {
+		se := segmentEnd{id: from.id, end: end}
+		q = append(q, se)
+		visited[se] = true
+	}
+
+	if maxExplored <= 0 {
+		maxExplored = defaultMaxExplored
+	}
+
+	var (
+		found       segmentEnd
+		ok          bool
+		explored    int
+		maxFrontier int
+	)
+	for len(q) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if explored++; explored > maxExplored {
+			return nil, fmt.Errorf("route search exceeded %d explored paths for route %d", maxExplored, from.routeID)
+		}
+
+		maxFrontier = max(maxFrontier, len(q))
+		cur := q[0]
+		q = q[1:]
+
+		if contains(toIDs, cur.id) {
+			found, ok = cur, true
+			break
+		}
+
+		for _, next := range g.links[segmentEnd{id: cur.id, end: oppositeEnd(cur.end)}] {
+			if visited[next] || (g.avoid[next.id] && !contains(toIDs, next.id)) || onPath(prev, cur, next.id) {
+				continue
+			}
+			visited[next] = true
+			prev[next] = cur
+			q = append(q, next)
+		}
+	}
+
+	tracef(ctx, "route: search from segment %d to %v explored %d segment ends, largest frontier %d, found %t", from.id, toIDs, explored, maxFrontier, ok)
+	if !ok {
+		return nil, errNoPath
+	}
+
+	var ids []int
+	for se := found; ; {
+		ids = append(ids, se.id)
+		p, ok := prev[se]
+		if !ok {
+			break
+		}
+		se = p
+	}
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return ids, nil
+}
+
+// onPath reports whether the path to se, as recorded in prev, passes
+// through the segment with id.
+func onPath(prev map[segmentEnd]segmentEnd, se segmentEnd, id int) bool {
+	for {
+		if se.id == id {
+			return true
+		}
+		p, ok := prev[se]
+		if !ok {
+			return false
+		}
+		se = p
+	}
+}
+
+// Segment ends, as stored in segment_links.
+const (
+	endFirst = "first"
+	endLast  = "last"
+)
+
+// segmentEnd is one end of a segment.
+type segmentEnd struct {
+	id  int
+	end string
+}
+
+// segmentLink is a link by which travel leaves one segment through exit
+// and enters another through entry.
+type segmentLink struct {
+	exit, entry segmentEnd
+}
+
+func oppositeEnd(end string) string {
+	if end == endFirst {
+		return endLast
+	}
+	return endFirst
+}
+
+// segmentEnds returns the ends of a segment with direction that travel
+// may leave it through (exits) and enter it through (entries).
+func segmentEnds(direction string) (exits, entries []string, err error) {
+	switch direction {
+	case "BOTH":
+		return []string{endFirst, endLast}, []string{endFirst, endLast}, nil
+	case "FOTD":
+		return []string{endLast}, []string{endFirst}, nil
+	case "FDTO":
+		return []string{endFirst}, []string{endLast}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown direction %q", direction)
+	}
+}
+
+func (s segment) endPoint(end string) orb.Point {
+	if end == endFirst {
+		return s.firstPoint
+	}
+	return s.lastPoint
+}
+
+// unknownStreetRequests returns the requests whose street matches no
+// segments by full name, base name or base name and type, which are certain
+// to fail.
+func unknownStreetRequests(ctx context.Context, st store) ([]request, error) {
+	reqs, err := st.requests(ctx, requestFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	var unknown []request
+	for _, req := range reqs {
+		name := normalizeStreetName(req.streetName)
+		ok, seen := known[name]
+		if !seen {
+			filters := []segmentFilter{{fullNames: []string{name}}, {baseNames: []string{name}}}
+			if base, types, ok := splitStreetType(name); ok {
+				filters = append(filters, segmentFilter{baseNames: []string{base}, streetTypes: types})
+			}
+			for _, filter := range filters {
+				segs, err := st.filterSegments(ctx, filter)
+				if err != nil {
+					return nil, err
+				}
+				if len(segs) > 0 {
+					ok = true
+					break
+				}
+			}
+			known[name] = ok
+		}
+		if !ok {
+			unknown = append(unknown, req)
+		}
+	}
+	return unknown, nil
+}
+
+// streetNames returns the distinct normalized full names of all segments.
+func (s sqliteStore) streetNames(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "select distinct norm_full_name from segments order by norm_full_name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// streetNamesWithPrefix returns the distinct full names of segments
+// starting with prefix, ignoring case.
+func (s sqliteStore) streetNamesWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToUpper(prefix)) + "%"
+
+	rows, err := s.db.QueryContext(ctx, `select distinct full_name from segments where upper(full_name) like ? escape '\' order by full_name`, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// segmentLinks returns the links leaving or entering the segment with id.
+func (s sqliteStore) segmentLinks(ctx context.Context, id int) ([]segmentLink, error) {
+	return s.queryLinks(ctx, "where id = ? or next_id = ?", id, id)
+}
+
+// allSegmentLinks returns every link between segments.
+func (s sqliteStore) allSegmentLinks(ctx context.Context) ([]segmentLink, error) {
+	return s.queryLinks(ctx, "")
+}
+
+func (s sqliteStore) queryLinks(ctx context.Context, where string, args ...interface{}) ([]segmentLink, error) {
+	rows, err := s.db.QueryContext(ctx, "select id, exit_end, next_id, entry_end from segment_links "+where+" order by id, next_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []segmentLink
+	for rows.Next() {
+		var l segmentLink
+		if err := rows.Scan(&l.exit.id, &l.exit.end, &l.entry.id, &l.entry.end); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+func (s sqliteStore) routeLinks(ctx context.Context, routeID int) (map[int][]int, error) {
+	links := make(map[int][]int)
+
+	rows, err := s.db.QueryContext(ctx, "select id, next_id from segment_links where route_id=?", routeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, nextID int
+		if err := rows.Scan(&id, &nextID); err != nil {
+			return nil, err
+		}
+		// Segments may be linked through more than one pair of ends.
+		if !contains(links[id], nextID) {
+			links[id] = append(links[id], nextID)
+		}
+	}
+
+	return links, rows.Err()
+}
+
+// Uses approach described in https://www.gobeyond.dev/real-world-sql-part-one/ but with
+// slices instead of pointers to ints/etc.
+type segmentFilter struct {
+	ids        []int
+	fullNames  []string
+	routeIDs   []int
+	endStreets []string
+
+	// baseNames matches street names without their suffix, such as MAIN
+	// for MAIN ST.
+	baseNames []string
+
+	// streetTypes matches street suffixes, such as ST for MAIN ST,
+	// ignoring case.
+	streetTypes []string
+
+	// bbox limits segments to those whose bounding box intersects it.
+	bbox *orb.Bound
+}
+
+// segmentsInBounds returns the segments whose bounding boxes intersect b,
+// using the bounding box columns and their index.
+func (s sqliteStore) segmentsInBounds(ctx context.Context, b orb.Bound) ([]segment, error) {
+	return s.filterSegments(ctx, segmentFilter{bbox: &b})
+}
+
+func (s sqliteStore) filterSegments(ctx context.Context, filter segmentFilter) ([]segment, error) {
+	where, args := []string{"1 = 1"}, []interface{}{}
+
+	if len(filter.ids) > 0 {
+		where = append(where, "id in ("+placeholders(len(filter.ids), "?")+")")
+		for _, id := range filter.ids {
+			args = append(args, id)
+		}
+	}
+
+	if len(filter.fullNames) > 0 {
+		where = append(where, "norm_full_name in ("+placeholders(len(filter.fullNames), "?")+")")
+		for _, fn := range filter.fullNames {
+			args = append(args, normalizeStreetName(fn))
+		}
+	}
+
+	if len(filter.baseNames) > 0 {
+		where = append(where, "replace(upper(str_name), '''', '') in ("+placeholders(len(filter.baseNames), "?")+")")
+		for _, bn := range filter.baseNames {
+			args = append(args, normalizeStreetName(bn))
+		}
+	}
+
+	if len(filter.streetTypes) > 0 {
+		where = append(where, "upper(str_type) in ("+placeholders(len(filter.streetTypes), "upper(?)")+")")
+		for _, st := range filter.streetTypes {
+			args = append(args, st)
+		}
+	}
+
+	if len(filter.routeIDs) > 0 {
+		where = append(where, "route_id in ("+placeholders(len(filter.routeIDs), "?")+")")
+		for _, id := range filter.routeIDs {
 			args = append(args, id)
 		}
-		where = append(where, "("+strings.Join(idw, " or ")+")")
 	}
 
-	if len(filter.fullNames) > 0 {
-		var fnw []string
-		for _, fn := range filter.fullNames {
-			fnw = append(fnw, "full_name = upper(?)")
-			args = append(args, fn)
+	if len(filter.endStreets) > 0 {
+		esp := placeholders(len(filter.endStreets), "upper(?)")
+		where = append(where, "(upper(from_str) in ("+esp+") or upper(to_str) in ("+esp+"))")
+		for i := 0; i < 2; i++ {
+			for _, es := range filter.endStreets {
+				args = append(args, es)
+			}
+		}
+	}
+
+	if filter.bbox != nil {
+		where = append(where, "(min_lon <= ? and max_lon >= ? and min_lat <= ? and max_lat >= ?)")
+		args = append(args, filter.bbox.Max.Lon(), filter.bbox.Min.Lon(), filter.bbox.Max.Lat(), filter.bbox.Min.Lat())
+	}
+
+	q := "select id, full_name, from_str, to_str, route_id, direction, line_string, first_point, last_point, str_name, str_type, st_class, length_m, mid_lon, mid_lat from segments where "
+	q += strings.Join(where, " and ")
+
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segs []segment
+	for rows.Next() {
+		var seg segment
+		var (
+			lsb []byte
+			fpb []byte
+			lpb []byte
+		)
+		if err := rows.Scan(&seg.id, &seg.name, &seg.from, &seg.to, &seg.routeID, &seg.direction, &lsb, &fpb, &lpb, &seg.streetName, &seg.streetType, &seg.streetClass, &seg.length, &seg.midpoint[0], &seg.midpoint[1]); err != nil {
+			return nil, err
+		}
+
+		var jls geojson.LineString
+		if err := json.Unmarshal(lsb, &jls); err != nil {
+			return nil, err
+		}
+		seg.lineString = orb.LineString(jls)
+
+		var fpt geojson.Point
+		if err := json.Unmarshal(fpb, &fpt); err != nil {
+			return nil, err
+		}
+		seg.firstPoint = orb.Point(fpt)
+
+		var lpt geojson.Point
+		if err := json.Unmarshal(lpb, &lpt); err != nil {
+			return nil, err
+		}
+		seg.lastPoint = orb.Point(lpt)
+
+		segs = append(segs, seg)
+	}
+
+	return segs, rows.Err()
+}
+
+// placeholders returns n copies of p joined by commas, for use in an IN
+// clause.
+func placeholders(n int, p string) string {
+	ps := make([]string, n)
+	for i := range ps {
+		ps[i] = p
+	}
+	return strings.Join(ps, ", ")
+}
+
+func (s sqliteStore) init() error {
+	for _, q := range []string{
+		"create table segments (id integer primary key, str_name text, str_type text, st_class, full_name text, norm_full_name text, from_str text, to_str text, route_id integer, direction text, line_string json, first_point json, last_point json, min_lon real, min_lat real, max_lon real, max_lat real, length_m real, mid_lon real, mid_lat real)",
+		"create table segment_links (id integer, route_id integer, next_id integer, exit_end text, entry_end text)",
+		"create table requests (id integer primary key, street_name text not null, start text, end text, district text, rank integer, raw_start text, raw_end text, extra json)",
+		"create table meta (key text primary key, value text)",
+	} {
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+
+	return s.setSchemaVersion(len(s.migrations()))
+}
+
+// checkSchema returns an error suggesting builddb be run if the database
+// is missing any of its tables.
+func (s sqliteStore) checkSchema() error {
+	for _, table := range []string{"segments", "segment_links", "requests"} {
+		ok, err := s.hasTable(table)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("database has no %s table, run builddb first", table)
+		}
+	}
+	return nil
+}
+
+// migrations returns the steps that upgrade the schema, in order. A
+// database's schema version is the number of them it has had applied, so
+// new steps must only ever be appended.
+func (s sqliteStore) migrations() []func(context.Context) error {
+	return []func(context.Context) error{
+		func(context.Context) error { return s.migrateNormFullName() },
+		func(context.Context) error { return s.migrateSegmentLengths() },
+		func(context.Context) error { return s.migrateSegmentBounds() },
+		s.migrateSegmentLinkEnds,
+		func(context.Context) error { return s.migrateRequestRaw() },
+		func(context.Context) error {
+			_, err := s.db.Exec("create table if not exists meta (key text primary key, value text)")
+			return err
+		},
+		func(context.Context) error { return s.migrateRequestExtra() },
+	}
+}
+
+// migrate upgrades a database built by an older version by applying the
+// migrations past its schema version. Databases from before versioning
+// have version 0 and get every migration, each of which checks whether
+// it's needed.
+func (s sqliteStore) migrate(ctx context.Context) error {
+	version, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	migrations := s.migrations()
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		slog.Debug("migrating database", "version", i+1)
+		if err := migrations[i](ctx); err != nil {
+			return fmt.Errorf("migrating to schema version %d: %w", i+1, err)
+		}
+		if err := s.setSchemaVersion(i + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s sqliteStore) schemaVersion() (int, error) {
+	var v int
+	err := s.db.QueryRow("pragma user_version").Scan(&v)
+	return v, err
+}
+
+func (s sqliteStore) setSchemaVersion(v int) error {
+	// Pragmas don't take parameters.
+	_, err := s.db.Exec(fmt.Sprintf("pragma user_version = %d", v))
+	return err
+}
+
+func (s sqliteStore) hasTable(table string) (bool, error) {
+	var n int
+	if err := s.db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = ?", table).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// migrateRequestExtra adds the extra column if it's missing. Columns the
+// requests were loaded without are lost, so it's left empty.
+func (s sqliteStore) migrateRequestExtra() error {
+	ok, err := s.hasTable("requests")
+	if err != nil || !ok {
+		return err
+	}
+	ok, err = s.hasColumn("requests", "extra")
+	if err != nil || ok {
+		return err
+	}
+	_, err = s.db.Exec("alter table requests add column extra json")
+	return err
+}
+
+// migrateRequestRaw adds the raw_start and raw_end columns if they're
+// missing. The original strings are lost, so they're filled from the
+// normalized start and end.
+func (s sqliteStore) migrateRequestRaw() error {
+	ok, err := s.hasTable("requests")
+	if err != nil || !ok {
+		return err
+	}
+	ok, err = s.hasColumn("requests", "raw_start")
+	if err != nil || ok {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		"alter table requests add column raw_start text",
+		"alter table requests add column raw_end text",
+		"update requests set raw_start = start, raw_end = end",
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s sqliteStore) hasColumn(table, column string) (bool, error) {
+	var n int
+	if err := s.db.QueryRow("select count(*) from pragma_table_info(?) where name = ?", table, column).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// migrateSegmentLinkEnds rebuilds segment_links with the ends each link
+// joins, if they're missing.
+func (s sqliteStore) migrateSegmentLinkEnds(ctx context.Context) error {
+	ok, err := s.hasColumn("segment_links", "exit_end")
+	if err != nil || ok {
+		return err
+	}
+	return s.relink(ctx, s.linkTolerance())
+}
+
+// relink rebuilds segment_links from the segments table, linking ends
+// within tolerance metres of each other.
+func (s sqliteStore) relink(ctx context.Context, tolerance float64) error {
+	if tolerance <= 0 {
+		return fmt.Errorf("snap tolerance must be positive, got %g", tolerance)
+	}
+
+	segs, err := s.filterSegments(ctx, segmentFilter{})
+	if err != nil {
+		return err
+	}
+
+	// Replace the links all at once, so a failure leaves the old ones.
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		"drop index if exists segment_links_id",
+		"drop table if exists segment_links",
+		"create table segment_links (id integer, route_id integer, next_id integer, exit_end text, entry_end text)",
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+
+	if err := insertSegmentLinks(tx, segs, tolerance); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("create index segment_links_id on segment_links(id)"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateNormFullName adds and populates the norm_full_name column if
+// it's missing.
+func (s sqliteStore) migrateNormFullName() error {
+	ok, err := s.hasColumn("segments", "norm_full_name")
+	if err != nil || ok {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("alter table segments add column norm_full_name text"); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("select id, full_name from segments")
+	if err != nil {
+		return err
+	}
+	names := make(map[int]string)
+	for rows.Next() {
+		var (
+			id   int
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		names[id] = name
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, name := range names {
+		if _, err := tx.Exec("update segments set norm_full_name = ? where id = ?", normalizeStreetName(name), id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("create index segments_norm_full_name on segments(norm_full_name)"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// migrateSegmentLengths adds and fills in the length and midpoint of
+// each segment.
+func (s sqliteStore) migrateSegmentLengths() error {
+	ok, err := s.hasColumn("segments", "length_m")
+	if err != nil || ok {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, col := range []string{"length_m", "mid_lon", "mid_lat"} {
+		if _, err := tx.Exec("alter table segments add column " + col + " real"); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("select id, line_string from segments")
+	if err != nil {
+		return err
+	}
+	lines := make(map[int]orb.LineString)
+	for rows.Next() {
+		var (
+			id  int
+			lsb []byte
+		)
+		if err := rows.Scan(&id, &lsb); err != nil {
+			rows.Close()
+			return err
+		}
+		var jls geojson.LineString
+		if err := json.Unmarshal(lsb, &jls); err != nil {
+			rows.Close()
+			return err
+		}
+		lines[id] = orb.LineString(jls)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, ls := range lines {
+		mid := lineMidpoint(ls)
+		if _, err := tx.Exec("update segments set length_m = ?, mid_lon = ?, mid_lat = ? where id = ?", geo.Length(ls), mid.Lon(), mid.Lat(), id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateSegmentBounds adds and fills in the bounding box of each
+// segment, and its index.
+func (s sqliteStore) migrateSegmentBounds() error {
+	ok, err := s.hasColumn("segments", "min_lon")
+	if err != nil || ok {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, col := range []string{"min_lon", "min_lat", "max_lon", "max_lat"} {
+		if _, err := tx.Exec("alter table segments add column " + col + " real"); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("select id, line_string from segments")
+	if err != nil {
+		return err
+	}
+	bounds := make(map[int]orb.Bound)
+	for rows.Next() {
+		var (
+			id  int
+			lsb []byte
+		)
+		if err := rows.Scan(&id, &lsb); err != nil {
+			rows.Close()
+			return err
+		}
+		var jls geojson.LineString
+		if err := json.Unmarshal(lsb, &jls); err != nil {
+			rows.Close()
+			return err
+		}
+		bounds[id] = orb.LineString(jls).Bound()
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, b := range bounds {
+		if _, err := tx.Exec("update segments set min_lon = ?, min_lat = ?, max_lon = ?, max_lat = ? where id = ?", b.Min.Lon(), b.Min.Lat(), b.Max.Lon(), b.Max.Lat(), id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("create index segments_bbox on segments(min_lon, max_lon, min_lat, max_lat)"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s sqliteStore) loadSegments(segments []segment) error {
+	if kept, dups := dedupeSegments(segments); len(dups) > 0 {
+		ids := make([]int, len(dups))
+		for i, seg := range dups {
+			ids[i] = seg.id
+		}
+		slog.Warn("found duplicate segments", "count", len(dups), "ids", ids, "dropped", s.dropDuplicates)
+		if s.dropDuplicates {
+			segments = kept
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, seg := range segments {
+		lsb, err := json.Marshal(geojson.LineString(seg.lineString))
+		if err != nil {
+			return err
+		}
+
+		fpb, err := json.Marshal(geojson.Point(seg.firstPoint))
+		if err != nil {
+			return err
+		}
+
+		lpb, err := json.Marshal(geojson.Point(seg.lastPoint))
+		if err != nil {
+			return err
+		}
+
+		bound := seg.lineString.Bound()
+		mid := lineMidpoint(seg.lineString)
+
+		if _, err := tx.Exec("insert into segments (id, str_name, str_type, st_class, full_name, from_str, to_str, route_id, direction, line_string, first_point, last_point, min_lon, min_lat, max_lon, max_lat, norm_full_name, length_m, mid_lon, mid_lat) values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16, ?17, ?18, ?19, ?20)",
+			seg.id,
+			seg.streetName,
+			seg.streetType,
+			seg.streetClass,
+			seg.name,
+			seg.from,
+			seg.to,
+			seg.routeID,
+			seg.direction,
+			lsb,
+			fpb,
+			lpb,
+			bound.Min.Lon(),
+			bound.Min.Lat(),
+			bound.Max.Lon(),
+			bound.Max.Lat(),
+			normalizeStreetName(seg.name),
+			geo.Length(seg.lineString),
+			mid.Lon(),
+			mid.Lat(),
+		); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := s.linkSegments(segments, s.linkTolerance()); err != nil {
+		return err
+	}
+
+	for _, q := range []string{
+		"create index segment_links_id on segment_links(id)",
+		"create index segments_bbox on segments(min_lon, max_lon, min_lat, max_lat)",
+		"create index segments_norm_full_name on segments(norm_full_name)",
+	} {
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// linkSegments records in segment_links how travel can pass between the
+// segments of each route, where their ends are within tolerance metres.
+func (s sqliteStore) linkSegments(segments []segment, tolerance float64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertSegmentLinks(tx, segments, tolerance); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertSegmentLinks inserts the links between segments, route by route,
+// into segment_links within tx.
+func insertSegmentLinks(tx *sql.Tx, segments []segment, tolerance float64) error {
+	routeSegments := make(map[int][]segment)
+	for _, seg := range segments {
+		routeSegments[seg.routeID] = append(routeSegments[seg.routeID], seg)
+	}
+
+	for routeID, routeSegs := range routeSegments {
+		links, err := linkRouteSegments(routeSegs, tolerance)
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			if _, err := tx.Exec("insert into segment_links (id, route_id, next_id, exit_end, entry_end) values (?, ?, ?, ?, ?)",
+				link.exit.id, routeID, link.entry.id, link.exit.end, link.entry.end,
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// linkViolation is a segment link that shouldn't exist.
+type linkViolation struct {
+	id, nextID int
+	problem    string
+}
+
+// verifySegmentLinks logs each of st's invalid segment links, returning an
+// error if there are any.
+func verifySegmentLinks(ctx context.Context, st *sqliteStore) error {
+	violations, err := st.checkSegmentLinks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, v := range violations {
+		slog.Error("invalid segment link", "id", v.id, "next_id", v.nextID, "problem", v.problem)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("found %d invalid segment links", len(violations))
+	}
+	return nil
+}
+
+// checkSegmentLinks returns the links in segment_links that link a segment
+// to itself, refer to a segment that doesn't exist, or cross between
+// routes, which linkSegments should never produce.
+func (s sqliteStore) checkSegmentLinks(ctx context.Context) ([]linkViolation, error) {
+	var out []linkViolation
+	for _, check := range []struct {
+		problem, q string
+	}{
+		{"links to itself", "select id, next_id from segment_links where id = next_id"},
+		{"refers to a missing segment", "select l.id, l.next_id from segment_links l left join segments a on a.id = l.id left join segments b on b.id = l.next_id where a.id is null or b.id is null"},
+		{"crosses routes", "select l.id, l.next_id from segment_links l join segments a on a.id = l.id join segments b on b.id = l.next_id where a.route_id != b.route_id or l.route_id != a.route_id"},
+	} {
+		rows, err := s.db.QueryContext(ctx, check.q+" order by 1, 2")
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			v := linkViolation{problem: check.problem}
+			if err := rows.Scan(&v.id, &v.nextID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// linkRouteSegments returns the links by which travel can leave each of
+// segs, all on one route, and enter another, where their ends are within
+// tolerance metres.
+func linkRouteSegments(segs []segment, tolerance float64) ([]segmentLink, error) {
+	var out []segmentLink
+	for _, cur := range segs {
+		exits, _, err := segmentEnds(cur.direction)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cur, err)
+		}
+
+		for _, next := range segs {
+			if cur.id == next.id {
+				continue
+			}
+
+			_, entries, err := segmentEnds(next.direction)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", next, err)
+			}
+
+			for _, exit := range exits {
+				for _, entry := range entries {
+					if geo.Distance(cur.endPoint(exit), next.endPoint(entry)) < tolerance {
+						out = append(out, segmentLink{exit: segmentEnd{id: cur.id, end: exit}, entry: segmentEnd{id: next.id, end: entry}})
+					}
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+func (s sqliteStore) loadRequests(reqs []request) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, req := range reqs {
+		if req.streetName == "" {
+			return fmt.Errorf("request with rank %d has empty street name", req.rank)
+		}
+
+		var start, end sql.NullString
+		if req.from != "" {
+			start.String = req.from
+			start.Valid = true
+		}
+		if req.to != "" {
+			end.String = req.to
+			end.Valid = true
+		}
+
+		var extra sql.NullString
+		if len(req.extra) > 0 {
+			b, err := json.Marshal(req.extra)
+			if err != nil {
+				return err
+			}
+			extra.String, extra.Valid = string(b), true
+		}
+
+		if _, err := tx.Exec("insert into requests (street_name, start, end, district, rank, raw_start, raw_end, extra) values (?, ?, ?, ?, ?, ?, ?, ?)",
+			req.streetName, start, end, normalizeDistrict(req.district), req.rank, req.rawFrom, req.rawTo, extra,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// normalizeDistrict prepares a district for matching, ignoring case and
+// surrounding whitespace.
+func normalizeDistrict(district string) string {
+	return strings.ToUpper(strings.TrimSpace(district))
+}
+
+// kmzMagic is the header of a zip file, which is what a KMZ is.
+var kmzMagic = []byte("PK\x03\x04")
+
+type kmlOptions struct {
+	// skipErrors skips placemarks that can't be read as segments, rather
+	// than failing the load.
+	skipErrors bool
+
+	// fields names the SimpleData holding each segment field, as
+	// defaultKMLFields does if nil.
+	fields kmlFields
+}
+
+// kmlFields maps segment fields to the names of the placemark SimpleData
+// holding them.
+type kmlFields map[string]string
+
+// kmlFieldKeys are the segment fields read from placemarks.
+var kmlFieldKeys = []string{"id", "route_id", "street_name", "street_type", "street_class", "full_name", "from", "to", "direction"}
+
+// defaultKMLFields are the names Halifax's street centreline data uses.
+var defaultKMLFields = kmlFields{
+	"id":           "FDMID",
+	"route_id":     "ROUTE_ID",
+	"street_name":  "STR_NAME",
+	"street_type":  "STR_TYPE",
+	"street_class": "ST_CLASS",
+	"full_name":    "FULL_NAME",
+	"from":         "FROM_STR",
+	"to":           "TO_STR",
+	"direction":    "STR_DIR",
+}
+
+// parseKMLFields returns defaultKMLFields with the fields named in s, as
+// comma-separated field=NAME pairs, replaced.
+func parseKMLFields(s string) (kmlFields, error) {
+	fields := make(kmlFields, len(defaultKMLFields))
+	for k, v := range defaultKMLFields {
+		fields[k] = v
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !ok || v == "" {
+			return nil, fmt.Errorf("invalid KML field %q, want field=NAME", pair)
+		}
+		if _, known := fields[k]; !known {
+			return nil, fmt.Errorf("unknown KML field %q, want one of %s", k, strings.Join(kmlFieldKeys, ", "))
+		}
+		fields[k] = v
+	}
+	return fields, nil
+}
+
+// recordError is an error reading one record of an input, such as a
+// placemark or a row.
+type recordError struct {
+	record string
+	err    error
+}
+
+func (e recordError) Error() string {
+	return e.record + ": " + e.err.Error()
+}
+
+func (e recordError) Unwrap() error {
+	return e.err
+}
+
+// loadKMLSegments loads segments from KML, or KMZ if kmlReader
+// starts with a zip header.
+func loadKMLSegments(st *sqliteStore, kmlReader io.Reader, opts kmlOptions) ([]recordError, error) {
+	br := bufio.NewReader(kmlReader)
+	if magic, _ := br.Peek(len(kmzMagic)); bytes.Equal(magic, kmzMagic) {
+		kr, err := openKMZ(br)
+		if err != nil {
+			return nil, err
+		}
+		defer kr.Close()
+		kmlReader = kr
+	} else {
+		kmlReader = br
+	}
+
+	var d kmlContainer
+	if err := xml.NewDecoder(kmlReader).Decode(&d); err != nil {
+		return nil, err
+	}
+
+	fields := opts.fields
+	if fields == nil {
+		fields = defaultKMLFields
+	}
+
+	placemarks := d.placemarks()
+	segments := make([]segment, 0, len(placemarks))
+	var (
+		skipped []recordError
+		cleaned []int
+	)
+	for i, p := range placemarks {
+		seg, err := p.segment(fields)
+		if err == nil {
+			// Linking compares segment ends, which degenerate geometry
+			// makes meaningless.
+			ls, removed := dedupeConsecutivePoints(seg.lineString)
+			switch {
+			case len(ls) < 2:
+				err = fmt.Errorf("segment %d has fewer than two distinct points", seg.id)
+			case removed > 0:
+				seg.lineString, seg.firstPoint, seg.lastPoint = ls, ls[0], ls[len(ls)-1]
+				cleaned = append(cleaned, seg.id)
+			}
+		}
+		if err != nil {
+			rerr := recordError{record: fmt.Sprintf("placemark %d", i+1), err: err}
+			if !opts.skipErrors {
+				return nil, rerr
+			}
+			skipped = append(skipped, rerr)
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	if len(cleaned) > 0 {
+		slog.Warn("removed repeated consecutive points from segments", "count", len(cleaned), "ids", cleaned)
+	}
+
+	return skipped, st.loadSegments(segments)
+}
+
+// dedupeConsecutivePoints returns ls without points equal to the one
+// before, and how many were removed.
+func dedupeConsecutivePoints(ls orb.LineString) (orb.LineString, int) {
+	out := make(orb.LineString, 0, len(ls))
+	for _, p := range ls {
+		if len(out) > 0 && p.Equal(out[len(out)-1]) {
+			continue
 		}
-		where = append(where, "("+strings.Join(fnw, " or ")+")")
+		out = append(out, p)
 	}
+	return out, len(ls) - len(out)
+}
 
-	if len(filter.routeIDs) > 0 {
-		var idw []string
-		for _, id := range filter.routeIDs {
-			idw = append(idw, "route_id = ?")
-			args = append(args, id)
+// dedupeSegments splits segs into those kept and the duplicates of an
+// earlier one, having its ID or the same geometry in either direction,
+// as when a segment is repeated on more than one route.
+func dedupeSegments(segs []segment) (kept, dups []segment) {
+	seenIDs := make(map[int]bool)
+	seenGeoms := make(map[string]bool)
+	for _, seg := range segs {
+		ls := seg.lineString
+		if len(ls) > 0 && (ls[0].Lon() > ls[len(ls)-1].Lon() || (ls[0].Lon() == ls[len(ls)-1].Lon() && ls[0].Lat() > ls[len(ls)-1].Lat())) {
+			ls = ls.Clone()
+			ls.Reverse()
 		}
-		where = append(where, "("+strings.Join(idw, " or ")+")")
-	}
+		geom := fmt.Sprint(ls)
 
-	if len(filter.endStreets) > 0 {
-		var esw []string
-		for _, es := range filter.endStreets {
-			esw = append(esw, "upper(?) in (from_str, to_str)")
-			args = append(args, es)
+		if seenIDs[seg.id] || seenGeoms[geom] {
+			dups = append(dups, seg)
+			continue
 		}
-		where = append(where, "("+strings.Join(esw, " or ")+")")
+		seenIDs[seg.id] = true
+		seenGeoms[geom] = true
+		kept = append(kept, seg)
 	}
+	return kept, dups
+}
 
-	q := "select id, full_name, from_str, to_str, route_id, direction, line_string, first_point, last_point, str_name, str_type, st_class from segments where "
-	q += strings.Join(where, " and ")
+// openKMZ returns a reader for the KML document within the KMZ in r. It
+// prefers doc.kml, falling back to the first .kml entry.
+func openKMZ(r io.Reader) (io.ReadCloser, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := s.db.Query(q, args...)
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var segs []segment
-	for rows.Next() {
-		var seg segment
-		var (
-			lsb []byte
-			fpb []byte
-			lpb []byte
-		)
-		if err := rows.Scan(&seg.id, &seg.name, &seg.from, &seg.to, &seg.routeID, &seg.direction, &lsb, &fpb, &lpb, &seg.streetName, &seg.streetType, &seg.streetClass); err != nil {
-			return nil, err
+	var kf *zip.File
+	for _, f := range zr.File {
+		if f.Name == "doc.kml" {
+			kf = f
+			break
 		}
-
-		var jls geojson.LineString
-		if err := json.Unmarshal(lsb, &jls); err != nil {
-			return nil, err
+		if kf == nil && strings.HasSuffix(strings.ToLower(f.Name), ".kml") {
+			kf = f
 		}
-		seg.lineString = orb.LineString(jls)
+	}
+	if kf == nil {
+		return nil, fmt.Errorf("no KML document found in KMZ")
+	}
 
-		var fpt geojson.Point
-		if err := json.Unmarshal(fpb, &fpt); err != nil {
-			return nil, err
-		}
-		seg.firstPoint = orb.Point(fpt)
+	return kf.Open()
+}
 
-		var lpt geojson.Point
-		if err := json.Unmarshal(lpb, &lpt); err != nil {
-			return nil, err
-		}
-		seg.lastPoint = orb.Point(lpt)
+// tsvColumns maps normalized TSV header names to the request field they
+// hold.
+var tsvColumns = map[string]string{
+	"rank":        "rank",
+	"street":      "street_name",
+	"street_name": "street_name",
+	"from":        "from",
+	"limit_from":  "from",
+	"to":          "to",
+	"limit_to":    "to",
+	"district":    "district",
+}
 
-		segs = append(segs, seg)
+// parseTSVHeader returns the index of each request field in header.
+func parseTSVHeader(header []string) (map[string]int, error) {
+	cols := make(map[string]int)
+	for i, h := range header {
+		name := strings.Join(strings.Fields(strings.ToLower(h)), "_")
+		if col, ok := tsvColumns[name]; ok {
+			if _, dup := cols[col]; !dup {
+				cols[col] = i
+			}
+		}
 	}
 
-	return segs, rows.Err()
-}
-
-func (s sqliteStore) init() error {
-	for _, q := range []string{
-		"create table segments (id integer primary key, str_name text, str_type text, st_class, full_name text, from_str text, to_str text, route_id integer, direction text, line_string json, first_point json, last_point json)",
-		"create table segment_links (id integer, route_id integer, next_id integer)",
-		"create table requests (id integer primary key, street_name text not null, start text, end text, district text, rank integer)",
-	} {
-		if _, err := s.db.Exec(q); err != nil {
-			return err
+	for _, col := range []string{"rank", "street_name", "from", "to", "district"} {
+		if _, ok := cols[col]; !ok {
+			return nil, fmt.Errorf("missing required column %q in TSV header", col)
 		}
 	}
 
-	return nil
+	return cols, nil
 }
 
-func (s sqliteStore) loadSegments(segments []segment) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
+// extraColumns returns the non-empty fields of a requests file row in
+// columns cols doesn't map, by their header, or nil if there are none.
+func extraColumns(header []string, cols map[string]int, fields []string) map[string]string {
+	mapped := make(map[int]bool, len(cols))
+	for _, i := range cols {
+		mapped[i] = true
 	}
-	defer tx.Rollback()
-
-	routeSegments := make(map[int][]segment)
 
-	for _, seg := range segments {
-		routeSegments[seg.routeID] = append(routeSegments[seg.routeID], seg)
-
-		lsb, err := json.Marshal(geojson.LineString(seg.lineString))
-		if err != nil {
-			return err
+	var extra map[string]string
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		if mapped[i] || h == "" || i >= len(fields) {
+			continue
 		}
-
-		fpb, err := json.Marshal(geojson.Point(seg.firstPoint))
-		if err != nil {
-			return err
+		v := strings.TrimSpace(fields[i])
+		if v == "" {
+			continue
 		}
-
-		lpb, err := json.Marshal(geojson.Point(seg.lastPoint))
-		if err != nil {
-			return err
+		if extra == nil {
+			extra = make(map[string]string)
 		}
-
-		if _, err := tx.Exec("insert into segments (id, str_name, str_type, st_class, full_name, from_str, to_str, route_id, direction, line_string, first_point, last_point) values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12)",
-			seg.id,
-			seg.streetName,
-			seg.streetType,
-			seg.streetClass,
-			seg.name,
-			seg.from,
-			seg.to,
-			seg.routeID,
-			seg.direction,
-			lsb,
-			fpb,
-			lpb,
-		); err != nil {
-			return err
+		if _, dup := extra[h]; !dup {
+			extra[h] = v
 		}
 	}
+	return extra
+}
 
-	if err := tx.Commit(); err != nil {
-		return err
+// extraData returns KML data for req's extra columns, ordered by name.
+func extraData(req request) []kml.Element {
+	names := make([]string, 0, len(req.extra))
+	for name := range req.extra {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	isClose := func(a, b orb.Point) bool {
-		return geo.Distance(a, b) < 1.0
+	data := make([]kml.Element, 0, len(names))
+	for _, name := range names {
+		data = append(data, kmlData(name, req.extra[name]))
 	}
+	return data
+}
 
-	matches := func(segs []segment, cur segment) ([]segment, error) {
-		var out []segment
-		for _, next := range segs {
-			if cur.id == next.id {
-				continue
-			}
+// Default words meaning a request runs from the start or to the end of
+// its street, rather than naming a cross street.
+var (
+	defaultFromSentinels = []string{"all", "entire", "whole"}
+	defaultToSentinels   = []string{"end", "terminus"}
+)
 
-			switch cur.direction + " " + next.direction {
-			case "BOTH BOTH":
-				if isClose(cur.firstPoint, next.firstPoint) || isClose(cur.firstPoint, next.lastPoint) || isClose(cur.lastPoint, next.firstPoint) || isClose(cur.lastPoint, next.lastPoint) {
-					out = append(out, next)
-				}
-			case "BOTH FOTD":
-				if isClose(next.firstPoint, cur.firstPoint) || isClose(next.firstPoint, cur.lastPoint) {
-					out = append(out, next)
-				}
-			case "BOTH FDTO":
-			case "FOTD FOTD":
-				if isClose(next.firstPoint, cur.lastPoint) {
-					out = append(out, next)
-				}
-			case "FOTD BOTH":
-				if isClose(cur.lastPoint, next.firstPoint) || isClose(cur.lastPoint, next.lastPoint) {
-					out = append(out, next)
-				}
-			case "FDTO BOTH":
-			default:
-				return nil, fmt.Errorf("unknown direction pair: %s and %s, %s / %s", cur.direction, next.direction, cur, next)
-			}
-		}
-		return out, nil
-	}
+type tsvOptions struct {
+	// fromSentinels and toSentinels are the words, ignoring case, that
+	// leave a request's from or to unbounded. Nil uses the defaults.
+	fromSentinels, toSentinels []string
 
-	tx, err = s.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
+	// csv reads comma-separated values, with quoting, as exported from a
+	// spreadsheet, rather than tab-separated.
+	csv bool
 
-	for _, routeSegs := range routeSegments {
-		for _, seg := range routeSegs {
-			nextSegs, err := matches(routeSegs, seg)
-			if err != nil {
-				return err
-			}
-			for _, next := range nextSegs {
-				if _, err := tx.Exec("insert into segment_links (id, route_id, next_id) values (?, ?, ?)",
-					seg.id, seg.routeID, next.id,
-				); err != nil {
-					return err
-				}
-			}
-		}
-	}
+	// skipErrors skips rows that can't be read as requests, rather than
+	// failing the load.
+	skipErrors bool
+}
 
-	if err := tx.Commit(); err != nil {
-		return err
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
 	}
+	return out
+}
 
-	for _, q := range []string{
-		"create index segment_links_id on segment_links(id)",
-	} {
-		if _, err := s.db.Exec(q); err != nil {
-			return err
+// isSentinel reports whether f is one of sentinels, ignoring case and
+// surrounding space.
+func isSentinel(f string, sentinels []string) bool {
+	for _, s := range sentinels {
+		if strings.EqualFold(f, strings.TrimSpace(s)) {
+			return true
 		}
 	}
-
-	return nil
+	return false
 }
 
-func (s sqliteStore) loadRequests(reqs []request) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
+// loadTSVRequests loads requests from requestReader, returning the rows
+// skipped for being unusable: those with an empty street name and, with
+// skipErrors, those that couldn't be read. Columns are found by name using
+// the header line.
+func loadTSVRequests(st *sqliteStore, requestReader io.Reader, opts tsvOptions) ([]recordError, error) {
+	fromSentinels, toSentinels := opts.fromSentinels, opts.toSentinels
+	if fromSentinels == nil {
+		fromSentinels = defaultFromSentinels
 	}
-	defer tx.Rollback()
-
-	for _, req := range reqs {
-		var start, end sql.NullString
-		if req.from != "" {
-			start.String = req.from
-			start.Valid = true
-		}
-		if req.to != "" {
-			end.String = req.to
-			end.Valid = true
-		}
-
-		if _, err := tx.Exec("insert into requests (street_name, start, end, district, rank) values (?, ?, ?, ?, ?)",
-			req.streetName, start, end, req.district, req.rank,
-		); err != nil {
-			return err
-		}
+	if toSentinels == nil {
+		toSentinels = defaultToSentinels
 	}
 
-	return tx.Commit()
-}
+	var (
+		reqs    []request
+		skipped []recordError
+		cols    map[string]int
+		header  []string
+		row     int
+	)
 
-func loadKMLSegments(st *sqliteStore, kmlReader io.Reader) error {
-	var d document
-	if err := xml.NewDecoder(kmlReader).Decode(&d); err != nil {
-		return err
+	// skip records a bad row, returning an error instead unless bad rows
+	// are being skipped.
+	skip := func(err error) error {
+		rerr := recordError{record: fmt.Sprintf("row %d", row), err: err}
+		if !opts.skipErrors {
+			return rerr
+		}
+		skipped = append(skipped, rerr)
+		return nil
 	}
 
-	segments := make([]segment, 0, len(d.Document.Folder.Placemark))
-	for _, p := range d.Document.Folder.Placemark {
-		var ls orb.LineString
-		for _, lsf := range strings.Fields(p.MultiGeometry.LineString) {
-			var pt orb.Point
-			if _, err := fmt.Sscanf(lsf, "%f,%f", &pt[0], &pt[1]); err != nil {
-				return err
+	var readRow func() ([]string, error)
+	if opts.csv {
+		cr := csv.NewReader(requestReader)
+		cr.FieldsPerRecord = -1
+		readRow = cr.Read
+	} else {
+		sc := bufio.NewScanner(requestReader)
+		readRow = func() ([]string, error) {
+			if !sc.Scan() {
+				if err := sc.Err(); err != nil {
+					return nil, err
+				}
+				return nil, io.EOF
 			}
-			ls = append(ls, pt)
+			return strings.Split(sc.Text(), "\t"), nil
 		}
+	}
 
-		data := p.data()
-
-		id, err := strconv.Atoi(data["FDMID"])
-		if err != nil {
-			return err
+	for {
+		fields, err := readRow()
+		if err == io.EOF {
+			break
+		}
+		row++
+		var perr *csv.ParseError
+		if errors.As(err, &perr) && cols != nil {
+			if err := skip(err); err != nil {
+				return nil, err
+			}
+			continue
 		}
-		routeID, err := strconv.Atoi(data["ROUTE_ID"])
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		seg := segment{
-			id:          id,
-			streetName:  data["STR_NAME"],
-			streetType:  data["STR_TYPE"],
-			streetClass: data["ST_CLASS"],
-			name:        data["FULL_NAME"],
-			from:        data["FROM_STR"],
-			to:          data["TO_STR"],
-			routeID:     routeID,
-			direction:   data["STR_DIR"],
-			lineString:  ls,
-			firstPoint:  ls[0],
-			lastPoint:   ls[len(ls)-1],
+		if cols == nil {
+			var err error
+			cols, err = parseTSVHeader(fields)
+			if err != nil {
+				return nil, err
+			}
+			header = fields
+			continue
 		}
-		segments = append(segments, seg)
-	}
-
-	return st.loadSegments(segments)
-}
-
-func loadTSVRequests(st *sqliteStore, requestReader io.Reader) error {
-	var reqs []request
 
-	sc := bufio.NewScanner(requestReader)
-	first := true
-	for sc.Scan() {
-		if first {
-			first = false // header
-			continue
+		field := func(col string) string {
+			if i := cols[col]; i < len(fields) {
+				return strings.TrimSpace(fields[i])
+			}
+			return ""
 		}
-		line := sc.Text()
-		fields := strings.Split(line, "\t")
 
 		var start, end string
-		if fields[2] != "" && strings.ToLower(fields[2]) != "all" {
-			start = fields[2]
+		rawFrom, rawTo := field("from"), field("to")
+		if f := rawFrom; f != "" && !isSentinel(f, fromSentinels) {
+			start = f
 		}
-		if fields[3] != "" && strings.ToLower(fields[3]) != "end" {
-			end = fields[3]
+		if f := rawTo; f != "" && !isSentinel(f, toSentinels) {
+			end = f
 		}
-		rank, err := strconv.Atoi(fields[0])
+		rank, err := strconv.Atoi(field("rank"))
 		if err != nil {
-			return err
+			if err := skip(fmt.Errorf("rank: %w", err)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		streetName := field("street_name")
+		if streetName == "" {
+			skipped = append(skipped, recordError{record: fmt.Sprintf("row %d", row), err: fmt.Errorf("request with rank %d has empty street name", rank)})
+			continue
 		}
 
 		req := request{
-			streetName: fields[1],
+			streetName: streetName,
 			from:       start,
 			to:         end,
 			rank:       rank,
-			district:   fields[4],
+			district:   field("district"),
+			rawFrom:    rawFrom,
+			rawTo:      rawTo,
+			extra:      extraColumns(header, cols, fields),
 		}
 		reqs = append(reqs, req)
 	}
 
-	if sc.Err() != nil {
-		return sc.Err()
-	}
-
-	return st.loadRequests(reqs)
+	return skipped, st.loadRequests(reqs)
 }
 
-type document struct {
-	Document struct {
-		Folder folder
-	}
+// kmlContainer is the root kml element, a Document or a Folder, any of
+// which may hold placemarks directly or within nested containers.
+type kmlContainer struct {
+	Document  []kmlContainer
+	Folder    []kmlContainer
+	Placemark []placemark
 }
 
-type folder struct {
-	Placemark []placemark
+// placemarks returns the placemarks within c at any depth, in document
+// order of their containers.
+func (c kmlContainer) placemarks() []placemark {
+	out := slices.Clone(c.Placemark)
+	for _, cs := range [][]kmlContainer{c.Document, c.Folder} {
+		for _, child := range cs {
+			out = append(out, child.placemarks()...)
+		}
+	}
+	return out
 }
 
 type placemark struct {
@@ -949,8 +4683,75 @@ type placemark struct {
 	}
 
 	MultiGeometry struct {
-		LineString string `xml:">coordinates"`
+		LineString []struct {
+			Coordinates string `xml:"coordinates"`
+		}
+	}
+}
+
+// segment reads the placemark as a segment, with its data named by
+// fields.
+func (p placemark) segment(fields kmlFields) (segment, error) {
+	all := p.data()
+	data := make(map[string]string, len(fields))
+	for k, name := range fields {
+		data[k] = all[name]
+	}
+
+	id, err := strconv.Atoi(data["id"])
+	if err != nil {
+		return segment{}, fmt.Errorf("%s: %w", fields["id"], err)
+	}
+	routeID, err := strconv.Atoi(data["route_id"])
+	if err != nil {
+		return segment{}, fmt.Errorf("segment %d %s: %w", id, fields["route_id"], err)
+	}
+	if _, _, err := segmentEnds(data["direction"]); err != nil {
+		return segment{}, fmt.Errorf("segment %d: %w", id, err)
+	}
+
+	var parts []segment
+	for _, pls := range p.MultiGeometry.LineString {
+		var ls orb.LineString
+		for _, lsf := range strings.Fields(pls.Coordinates) {
+			var pt orb.Point
+			if _, err := fmt.Sscanf(lsf, "%f,%f", &pt[0], &pt[1]); err != nil {
+				return segment{}, fmt.Errorf("segment %d coordinates: %w", id, err)
+			}
+			ls = append(ls, pt)
+		}
+		parts = append(parts, segment{lineString: ls})
+	}
+
+	// A segment is a single line string, so the parts of a multi-part
+	// geometry must join end to end. Bridging a gap would invent geometry
+	// that routing then links across.
+	runs := mergeLineStrings(parts)
+	if len(runs) > 1 {
+		return segment{}, fmt.Errorf("segment %d geometry has %d disconnected parts", id, len(runs))
+	}
+	var ls orb.LineString
+	if len(runs) == 1 {
+		ls = runs[0]
 	}
+	if len(ls) == 0 {
+		return segment{}, fmt.Errorf("segment %d has no coordinates", id)
+	}
+
+	return segment{
+		id:          id,
+		streetName:  data["street_name"],
+		streetType:  data["street_type"],
+		streetClass: data["street_class"],
+		name:        data["full_name"],
+		from:        data["from"],
+		to:          data["to"],
+		routeID:     routeID,
+		direction:   data["direction"],
+		lineString:  ls,
+		firstPoint:  ls[0],
+		lastPoint:   ls[len(ls)-1],
+	}, nil
 }
 
 func (p placemark) data() map[string]string {
@@ -966,6 +4767,22 @@ type simpleData struct {
 	Data string `xml:",innerxml"`
 }
 
+// snapTolerance is how close, in metres, segment ends must be to link.
+const snapTolerance = 1.0
+
+// isClose reports whether a and b are within snapTolerance of each other.
+func isClose(a, b orb.Point) bool {
+	return geo.Distance(a, b) < snapTolerance
+}
+
+func reverseSegments(segs []segment) []segment {
+	out := make([]segment, 0, len(segs))
+	for i := len(segs) - 1; i >= 0; i-- {
+		out = append(out, segs[i])
+	}
+	return out
+}
+
 func contains(x []int, y int) bool {
 	for _, z := range x {
 		if z == y {
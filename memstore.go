@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+)
+
+// inMemoryStore is a store over segments and requests held in memory,
+// for tests and small datasets. It has the same semantics as sqliteStore
+// and, as it's never modified once built, is safe for concurrent use.
+type inMemoryStore struct {
+	segments []segment
+	byID     map[int]segment
+	reqs     []request
+
+	// links are every link between segments, ordered as segment_links
+	// is queried.
+	links []segmentLink
+
+	// maxExplored and avoidClasses are as for sqliteStore.
+	maxExplored  int
+	avoidClasses []string
+}
+
+var _ store = (*inMemoryStore)(nil)
+
+// newInMemoryStore returns a store of segments and reqs, linking the
+// segments as loading them into sqliteStore does.
+func newInMemoryStore(segments []segment, reqs []request) (*inMemoryStore, error) {
+	s := &inMemoryStore{byID: make(map[int]segment)}
+
+	routeSegments := make(map[int][]segment)
+	for _, seg := range segments {
+		if _, ok := s.byID[seg.id]; ok {
+			return nil, fmt.Errorf("duplicate segment id %d", seg.id)
+		}
+		seg.length, seg.midpoint = geo.Length(seg.lineString), lineMidpoint(seg.lineString)
+		s.segments = append(s.segments, seg)
+		s.byID[seg.id] = seg
+		routeSegments[seg.routeID] = append(routeSegments[seg.routeID], seg)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	for _, routeSegs := range routeSegments {
+		links, err := linkRouteSegments(routeSegs, snapTolerance)
+		if err != nil {
+			return nil, err
+		}
+		s.links = append(s.links, links...)
+	}
+	sort.SliceStable(s.links, func(i, j int) bool {
+		a, b := s.links[i], s.links[j]
+		if a.exit.id != b.exit.id {
+			return a.exit.id < b.exit.id
+		}
+		return a.entry.id < b.entry.id
+	})
+
+	for _, req := range reqs {
+		if req.streetName == "" {
+			return nil, fmt.Errorf("request with rank %d has empty street name", req.rank)
+		}
+		req.district = normalizeDistrict(req.district)
+		s.reqs = append(s.reqs, req)
+	}
+	sort.SliceStable(s.reqs, func(i, j int) bool { return s.reqs[i].rank < s.reqs[j].rank })
+
+	return s, nil
+}
+
+func (s *inMemoryStore) requests(ctx context.Context, filter requestFilter) ([]request, error) {
+	var reqs []request
+	for _, req := range s.reqs {
+		whole := req.from == "" && req.to == ""
+		switch {
+		case filter.wholeStreetOnly != nil && *filter.wholeStreetOnly != whole,
+			filter.rankMin > 0 && req.rank < filter.rankMin,
+			filter.rankMax > 0 && req.rank > filter.rankMax,
+			filter.district != "" && req.district != normalizeDistrict(filter.district):
+			continue
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, ctx.Err()
+}
+
+func (s *inMemoryStore) filterSegments(ctx context.Context, filter segmentFilter) ([]segment, error) {
+	normalized := func(names []string) []string {
+		out := make([]string, len(names))
+		for i, n := range names {
+			out[i] = normalizeStreetName(n)
+		}
+		return out
+	}
+	fullNames, baseNames := normalized(filter.fullNames), normalized(filter.baseNames)
+
+	streetTypes := make([]string, len(filter.streetTypes))
+	for i, st := range filter.streetTypes {
+		streetTypes[i] = strings.ToUpper(st)
+	}
+
+	endStreets := make([]string, len(filter.endStreets))
+	for i, es := range filter.endStreets {
+		endStreets[i] = strings.ToUpper(es)
+	}
+
+	var segs []segment
+	for _, seg := range s.segments {
+		switch {
+		case len(filter.ids) > 0 && !contains(filter.ids, seg.id),
+			len(fullNames) > 0 && !slices.Contains(fullNames, normalizeStreetName(seg.name)),
+			len(baseNames) > 0 && !slices.Contains(baseNames, strings.ReplaceAll(strings.ToUpper(seg.streetName), "'", "")),
+			len(streetTypes) > 0 && !slices.Contains(streetTypes, strings.ToUpper(seg.streetType)),
+			len(filter.routeIDs) > 0 && !contains(filter.routeIDs, seg.routeID),
+			len(endStreets) > 0 && !slices.Contains(endStreets, strings.ToUpper(seg.from)) && !slices.Contains(endStreets, strings.ToUpper(seg.to)),
+			filter.bbox != nil && !filter.bbox.Intersects(seg.lineString.Bound()):
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	return segs, ctx.Err()
+}
+
+func (s *inMemoryStore) segmentsInBounds(ctx context.Context, b orb.Bound) ([]segment, error) {
+	return s.filterSegments(ctx, segmentFilter{bbox: &b})
+}
+
+func (s *inMemoryStore) routeLinks(ctx context.Context, routeID int) (map[int][]int, error) {
+	links := make(map[int][]int)
+	for _, l := range s.links {
+		if s.byID[l.exit.id].routeID != routeID {
+			continue
+		}
+		// Segments may be linked through more than one pair of ends.
+		if !contains(links[l.exit.id], l.entry.id) {
+			links[l.exit.id] = append(links[l.exit.id], l.entry.id)
+		}
+	}
+	return links, ctx.Err()
+}
+
+func (s *inMemoryStore) segmentLinks(ctx context.Context, id int) ([]segmentLink, error) {
+	var links []segmentLink
+	for _, l := range s.links {
+		if l.exit.id == id || l.entry.id == id {
+			links = append(links, l)
+		}
+	}
+	return links, ctx.Err()
+}
+
+func (s *inMemoryStore) streetNames(ctx context.Context) ([]string, error) {
+	var names []string
+	for _, seg := range s.segments {
+		names = append(names, normalizeStreetName(seg.name))
+	}
+	slices.Sort(names)
+	return slices.Compact(names), ctx.Err()
+}
+
+func (s *inMemoryStore) streetNamesWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	for _, seg := range s.segments {
+		if strings.HasPrefix(strings.ToUpper(seg.name), strings.ToUpper(prefix)) {
+			names = append(names, seg.name)
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names), ctx.Err()
+}
+
+// route finds a route as sqliteStore.route does.
+func (s *inMemoryStore) route(ctx context.Context, fromSegments []segment, toSegments []segment) ([]segment, error) {
+	if len(fromSegments) == 0 || len(toSegments) == 0 {
+		return nil, fmt.Errorf("empty fromSegments or empty toSegments")
+	}
+
+	from, ok := s.byID[fromSegments[0].id]
+	if !ok {
+		return nil, fmt.Errorf("from segment %d not found", fromSegments[0].id)
+	}
+
+	g := newRouteGraph(from)
+	for _, l := range s.links {
+		if s.byID[l.exit.id].routeID != from.routeID {
+			continue
+		}
+		class := s.byID[l.entry.id].streetClass
+		g.add(l, slices.ContainsFunc(s.avoidClasses, func(c string) bool { return strings.EqualFold(c, class) }))
+	}
+
+	ids, err := g.search(ctx, from, toSegments, s.maxExplored)
+	if err != nil {
+		return nil, err
+	}
+
+	route := make([]segment, 0, len(ids))
+	for _, id := range ids {
+		route = append(route, s.byID[id])
+	}
+	return route, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/paulmach/orb"
+)
+
+// Minimap cell contents, with later layers drawn over earlier ones.
+const (
+	mapEmpty = iota
+	mapRoute
+	mapStart
+	mapEnd
+)
+
+// mapCells maps cell contents to how they're drawn, with tview color tags.
+var mapCells = map[int]string{
+	mapEmpty: " ",
+	mapRoute: "[green]#[-]",
+	mapStart: "[blue]S[-]",
+	mapEnd:   "[red]E[-]",
+}
+
+// plainMapCells draws cells like mapCells, without color.
+var plainMapCells = map[int]string{
+	mapEmpty: " ",
+	mapRoute: "#",
+	mapStart: "S",
+	mapEnd:   "E",
+}
+
+// plotSegments rasterizes the line strings of each layer of segments onto
+// a width by height grid fitted to their bounds, north up. Cells hold the
+// index of the last layer drawn there, plus one, or mapEmpty.
+func plotSegments(width, height int, layers ...[]segment) [][]int {
+	grid := make([][]int, height)
+	for y := range grid {
+		grid[y] = make([]int, width)
+	}
+
+	var (
+		bound orb.Bound
+		found bool
+	)
+	for _, segs := range layers {
+		for _, seg := range segs {
+			if len(seg.lineString) == 0 {
+				continue
+			}
+			if !found {
+				bound, found = seg.lineString.Bound(), true
+				continue
+			}
+			bound = bound.Union(seg.lineString.Bound())
+		}
+	}
+	if !found || width < 1 || height < 1 {
+		return grid
+	}
+
+	cell := func(p orb.Point) (int, int) {
+		x, y := 0, 0
+		if w := bound.Max.Lon() - bound.Min.Lon(); w > 0 {
+			x = int((p.Lon() - bound.Min.Lon()) / w * float64(width-1))
+		}
+		if h := bound.Max.Lat() - bound.Min.Lat(); h > 0 {
+			y = int((bound.Max.Lat() - p.Lat()) / h * float64(height-1))
+		}
+		return x, y
+	}
+
+	for i, segs := range layers {
+		for _, seg := range segs {
+			ls := seg.lineString
+			for j := range ls {
+				x0, y0 := cell(ls[j])
+				grid[y0][x0] = i + 1
+				if j == 0 {
+					continue
+				}
+
+				// Fill in the cells between this point and the last.
+				x1, y1 := cell(ls[j-1])
+				steps := abs(x1 - x0)
+				if dy := abs(y1 - y0); dy > steps {
+					steps = dy
+				}
+				for s := 1; s < steps; s++ {
+					x := x0 + (x1-x0)*s/steps
+					y := y0 + (y1-y0)*s/steps
+					grid[y][x] = i + 1
+				}
+			}
+		}
+	}
+
+	return grid
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// minimap draws the route, start and end segments of a request as text,
+// with cells drawn as in cells.
+func minimap(cells map[int]string, width, height int, route, start, end []segment) string {
+	var b strings.Builder
+	for _, row := range plotSegments(width, height, route, start, end) {
+		for _, c := range row {
+			b.WriteString(cells[c])
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
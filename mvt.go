@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/clip"
+	"github.com/paulmach/orb/maptile"
+)
+
+// mvtExtent is the size of a vector tile in its own coordinates.
+const mvtExtent = 4096
+
+// parseTile parses a tile given as z/x/y.
+func parseTile(s string) (maptile.Tile, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 3 {
+		return maptile.Tile{}, fmt.Errorf("tile %q isn't z/x/y", s)
+	}
+
+	var n [3]uint64
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return maptile.Tile{}, fmt.Errorf("tile %q: %w", s, err)
+		}
+		n[i] = v
+	}
+
+	z, x, y := n[0], n[1], n[2]
+	if z > 32 {
+		return maptile.Tile{}, fmt.Errorf("tile %q: zoom must be at most 32", s)
+	}
+	if x >= 1<<z || y >= 1<<z {
+		return maptile.Tile{}, fmt.Errorf("tile %q: x and y must be less than %d at zoom %d", s, uint64(1)<<z, z)
+	}
+	return maptile.New(uint32(x), uint32(y), maptile.Zoom(z)), nil
+}
+
+// exportMVT writes the routes of requests within tile, clipped to it, as a
+// Mapbox Vector Tile with one "requests" layer.
+func exportMVT(ctx context.Context, st store, w io.Writer, opts exportOptions, tile maptile.Tile) error {
+	layer, err := requestTileLayer(ctx, st, opts, tile)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(layer.marshal())
+	return err
+}
+
+// requestTileLayer resolves requests and returns a layer of their routes
+// clipped to tile, leaving out those entirely outside it.
+func requestTileLayer(ctx context.Context, st store, opts exportOptions, tile maptile.Tile) (*mvtLayer, error) {
+	reqs, err := st.requests(ctx, opts.requestFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	layer := &mvtLayer{name: "requests"}
+	bound := tile.Bound()
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		res, err := newDefaultRequestHandler(st, req, opts.handlerOptions).handle(ctx)
+		if err != nil {
+			logRequestError(req, err)
+			continue
+		}
+
+		clipped := clip.MultiLineString(bound, orb.MultiLineString(mergeLineStrings(res.routeSegments)))
+		geometry := mvtLineGeometry(tile, clipped)
+		if len(geometry) == 0 {
+			continue
+		}
+		layer.add(uint64(req.rank), geometry, map[string]interface{}{
+			"rank":     req.rank,
+			"street":   req.streetName,
+			"from":     req.from,
+			"to":       req.to,
+			"district": req.district,
+		})
+	}
+	return layer, nil
+}
+
+// mvtLayer is a vector tile layer of line features.
+type mvtLayer struct {
+	name     string
+	features []mvtFeature
+
+	// keys and values are the layer's property names and values, which
+	// features' tags index.
+	keys   []string
+	values []interface{}
+}
+
+type mvtFeature struct {
+	id       uint64
+	tags     []uint32
+	geometry []uint32
+}
+
+// add adds a line feature with geometry encoded by mvtLineGeometry and
+// properties, which are strings or ints.
+func (l *mvtLayer) add(id uint64, geometry []uint32, properties map[string]interface{}) {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f := mvtFeature{id: id, geometry: geometry}
+	for _, name := range names {
+		f.tags = append(f.tags, l.keyIndex(name), l.valueIndex(properties[name]))
+	}
+	l.features = append(l.features, f)
+}
+
+// keyIndex returns the index of k in l's keys, adding it if it's missing.
+func (l *mvtLayer) keyIndex(k string) uint32 {
+	for i, e := range l.keys {
+		if e == k {
+			return uint32(i)
+		}
+	}
+	l.keys = append(l.keys, k)
+	return uint32(len(l.keys) - 1)
+}
+
+// valueIndex returns the index of v in l's values, adding it if it's
+// missing.
+func (l *mvtLayer) valueIndex(v interface{}) uint32 {
+	for i, e := range l.values {
+		if e == v {
+			return uint32(i)
+		}
+	}
+	l.values = append(l.values, v)
+	return uint32(len(l.values) - 1)
+}
+
+// marshal returns l encoded as a vector tile protobuf, in a tile of its
+// own.
+func (l *mvtLayer) marshal() []byte {
+	var lb protoBuffer
+	lb.varint(15, 2) // version
+	lb.string(1, l.name)
+	for _, f := range l.features {
+		var fb protoBuffer
+		fb.varint(1, f.id)
+		fb.packed(2, f.tags)
+		fb.varint(3, 2) // LINESTRING
+		fb.packed(4, f.geometry)
+		lb.bytes(2, fb)
+	}
+	for _, k := range l.keys {
+		lb.string(3, k)
+	}
+	for _, v := range l.values {
+		var vb protoBuffer
+		switch v := v.(type) {
+		case string:
+			vb.string(1, v)
+		case int:
+			vb.varint(4, uint64(v))
+		}
+		lb.bytes(4, vb)
+	}
+	lb.varint(5, mvtExtent)
+
+	var tb protoBuffer
+	tb.bytes(3, lb)
+	return tb
+}
+
+// mvtLineGeometry returns the vector tile geometry commands drawing mls,
+// in lon/lat, within tile. Lines shorter than a tile unit are dropped.
+func mvtLineGeometry(tile maptile.Tile, mls orb.MultiLineString) []uint32 {
+	var (
+		geometry []uint32
+		cursor   [2]int64
+	)
+	for _, ls := range mls {
+		var pts [][2]int64
+		for _, p := range ls {
+			q := tilePosition(tile, p)
+			if len(pts) == 0 || q != pts[len(pts)-1] {
+				pts = append(pts, q)
+			}
+		}
+		if len(pts) < 2 {
+			continue
+		}
+
+		geometry = append(geometry, mvtCommand(1, 1)) // MoveTo
+		for i, q := range pts {
+			if i == 1 {
+				geometry = append(geometry, mvtCommand(2, len(pts)-1)) // LineTo
+			}
+			geometry = append(geometry, zigzag(q[0]-cursor[0]), zigzag(q[1]-cursor[1]))
+			cursor = q
+		}
+	}
+	return geometry
+}
+
+// tilePosition returns p, in lon/lat, in the coordinates of tile, from its
+// top left corner.
+func tilePosition(tile maptile.Tile, p orb.Point) [2]int64 {
+	n := math.Exp2(float64(tile.Z))
+	lat := p.Lat() * math.Pi / 180
+	x := (p.Lon()+180)/360*n - float64(tile.X)
+	y := (1-math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi)/2*n - float64(tile.Y)
+	return [2]int64{int64(math.Round(x * mvtExtent)), int64(math.Round(y * mvtExtent))}
+}
+
+func mvtCommand(id, count int) uint32 {
+	return uint32(id&0x7 | count<<3)
+}
+
+func zigzag(v int64) uint32 {
+	return uint32((v << 1) ^ (v >> 63))
+}
+
+// protoBuffer accumulates an encoded protobuf message.
+type protoBuffer []byte
+
+func (b *protoBuffer) key(field, wireType int) {
+	*b = binary.AppendUvarint(*b, uint64(field<<3|wireType))
+}
+
+func (b *protoBuffer) varint(field int, v uint64) {
+	b.key(field, 0)
+	*b = binary.AppendUvarint(*b, v)
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.key(field, 2)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) string(field int, v string) {
+	b.bytes(field, []byte(v))
+}
+
+func (b *protoBuffer) packed(field int, vs []uint32) {
+	var p []byte
+	for _, v := range vs {
+		p = binary.AppendUvarint(p, uint64(v))
+	}
+	b.bytes(field, p)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+type networkOptions struct {
+	// pretty indents the GeoJSON for reading rather than writing it
+	// compactly.
+	pretty bool
+	// crs is the coordinate system to write, lon/lat if unset. GeoJSON
+	// readers assume lon/lat, so others must be set by hand.
+	crs crs
+}
+
+// exportNetwork writes every segment as a GeoJSON FeatureCollection, for
+// use as base map context beneath exported routes.
+func exportNetwork(ctx context.Context, st store, w io.Writer, opts networkOptions, _ []string) error {
+	segs, err := st.filterSegments(ctx, segmentFilter{})
+	if err != nil {
+		return err
+	}
+
+	fc := geojson.NewFeatureCollection()
+	for _, seg := range segs {
+		g, err := opts.crs.projectGeometry(seg.lineString)
+		if err != nil {
+			return err
+		}
+		f := geojson.NewFeature(g)
+		f.ID = seg.id
+		f.Properties = geojson.Properties{
+			"name":         seg.name,
+			"direction":    seg.direction,
+			"route_id":     seg.routeID,
+			"street_class": seg.streetClass,
+		}
+		fc.Append(f)
+	}
+
+	enc := json.NewEncoder(w)
+	if opts.pretty {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(fc)
+}
+
+// exportNDJSON writes each resolved request's route as a GeoJSON feature
+// on its own line, as tippecanoe reads to build vector tiles.
+func exportNDJSON(ctx context.Context, st store, w io.Writer, opts exportOptions) error {
+	reqs, err := st.requests(ctx, opts.requestFilter)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		res, err := newDefaultRequestHandler(st, req, opts.handlerOptions).handle(ctx)
+		if err != nil {
+			logRequestError(req, err)
+			continue
+		}
+
+		g, err := opts.crs.projectGeometry(orb.MultiLineString(mergeLineStrings(res.routeSegments)))
+		if err != nil {
+			return err
+		}
+		f := geojson.NewFeature(g)
+		f.ID = req.stableID()
+		f.Properties = geojson.Properties{
+			"rank":     req.rank,
+			"street":   req.streetName,
+			"from":     req.from,
+			"to":       req.to,
+			"district": req.district,
+		}
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// orderTerm is one weighted term of an ordering score.
+type orderTerm struct {
+	name   string
+	weight float64
+}
+
+// orderTermNames are the terms an ordering may use. Each is scaled from 0
+// to 1 across the requests being ordered, with lower ordered first:
+//
+//   - rank: the request's rank from the source data
+//   - length: the route's length, longest first
+//   - class: the fraction of the route not on local streets
+var orderTermNames = []string{"rank", "length", "class"}
+
+// parseOrderBy parses a comma-separated list of terms, each optionally
+// weighted as term=weight, such as "rank=0.7,length=0.3".
+func parseOrderBy(s string) ([]orderTerm, error) {
+	var terms []orderTerm
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+
+		t := orderTerm{name: f, weight: 1}
+		if name, weight, ok := strings.Cut(f, "="); ok {
+			w, err := strconv.ParseFloat(weight, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad weight for order term %q: %w", name, err)
+			}
+			t = orderTerm{name: name, weight: w}
+		}
+		if !slices.Contains(orderTermNames, t.name) {
+			return nil, fmt.Errorf("unknown order term %q, want one of %s", t.name, strings.Join(orderTermNames, ", "))
+		}
+		terms = append(terms, t)
+	}
+	if len(terms) == 0 {
+		terms = []orderTerm{{name: "rank", weight: 1}}
+	}
+	return terms, nil
+}
+
+// isRankOrder reports whether terms order by source rank alone.
+func isRankOrder(terms []orderTerm) bool {
+	return len(terms) == 1 && terms[0].name == "rank"
+}
+
+// rankedResult is a resolved request and its rank in the chosen ordering.
+type rankedResult struct {
+	req         request
+	res         requestResult
+	displayRank int
+}
+
+// orderResults sorts results by their score under terms and sets their
+// displayRank. Ordering by rank alone keeps the source ranks.
+func orderResults(results []rankedResult, terms []orderTerm) {
+	if isRankOrder(terms) {
+		sort.SliceStable(results, func(i, j int) bool { return results[i].req.rank < results[j].req.rank })
+		for i := range results {
+			results[i].displayRank = results[i].req.rank
+		}
+		return
+	}
+
+	type values struct{ rank, length, class float64 }
+	vals := make([]values, len(results))
+	var top values
+	for i, r := range results {
+		var length, other float64
+		for _, seg := range r.res.routeSegments {
+			length += seg.length
+			if seg.streetClass != "LOCAL" {
+				other += seg.length
+			}
+		}
+
+		v := values{rank: float64(r.req.rank), length: length}
+		if length > 0 {
+			v.class = other / length
+		}
+		vals[i] = v
+
+		if v.rank > top.rank {
+			top.rank = v.rank
+		}
+		if v.length > top.length {
+			top.length = v.length
+		}
+	}
+
+	scale := func(v, top float64) float64 {
+		if top == 0 {
+			return 0
+		}
+		return v / top
+	}
+
+	scores := make([]float64, len(results))
+	for i := range results {
+		for _, t := range terms {
+			var v float64
+			switch t.name {
+			case "rank":
+				v = scale(vals[i].rank, top.rank)
+			case "length":
+				v = 1 - scale(vals[i].length, top.length)
+			case "class":
+				v = vals[i].class
+			}
+			scores[i] += t.weight * v
+		}
+	}
+
+	idx := make([]int, len(results))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		if sa, sb := scores[idx[a]], scores[idx[b]]; sa != sb {
+			return sa < sb
+		}
+		return results[idx[a]].req.rank < results[idx[b]].req.rank
+	})
+
+	ordered := make([]rankedResult, len(results))
+	for i, j := range idx {
+		ordered[i] = results[j]
+		ordered[i].displayRank = i + 1
+	}
+	copy(results, ordered)
+}
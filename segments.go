@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/paulmach/orb/encoding/wkt"
+)
+
+// listSegments prints the segments whose full name matches the street
+// name in args, as a table or, with format wkt, as each segment's ID and
+// geometry in well-known text.
+func listSegments(ctx context.Context, st store, w io.Writer, format string, args []string) error {
+	if format != "table" && format != "wkt" {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("need street name")
+	}
+	name := normalizeStreetName(strings.Join(args, " "))
+
+	segs, err := st.filterSegments(ctx, segmentFilter{fullNames: []string{name}})
+	if err != nil {
+		return err
+	}
+
+	if len(segs) == 0 {
+		return fmt.Errorf("no segments found for %q", name)
+	}
+
+	if format == "wkt" {
+		for _, seg := range segs {
+			if _, err := fmt.Fprintf(w, "%d\t%s\n", seg.id, wkt.MarshalString(seg.lineString)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tFROM\tTO\tDIRECTION\tROUTE ID")
+	for _, seg := range segs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\n", seg.id, seg.from, seg.to, seg.direction, seg.routeID)
+	}
+	return tw.Flush()
+}
+
+// completeStreetNames prints the street names starting with the prefix in
+// args, one per line.
+func completeStreetNames(ctx context.Context, st store, w io.Writer, args []string) error {
+	names, err := st.streetNamesWithPrefix(ctx, strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, err := fmt.Fprintln(w, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/mazznoer/colorgrad"
+	"github.com/twpayne/go-kml"
+)
+
+// exportSplitFiles writes each request's route to its own KML, or KMZ,
+// file in dir, named by rank and selected and coloured as export would.
+// Requests that fail to resolve are written to unresolved.kml with
+// includeErrors. With resume, files that already exist aren't rewritten,
+// so an interrupted export can be continued.
+func exportSplitFiles(ctx context.Context, st store, dir string, opts exportOptions, resume bool) error {
+	if opts.gradientSteps < 1 {
+		return fmt.Errorf("gradient steps must be at least 1, got %d", opts.gradientSteps)
+	}
+	gradient := opts.gradient
+	if len(gradient) == 0 {
+		gradient = defaultGradient
+	}
+	grad, err := colorgrad.NewGradient().HtmlColors(gradient...).Build()
+	if err != nil {
+		return err
+	}
+	colors := grad.Colors(uint(opts.gradientSteps))
+
+	sel, err := selectExportResults(ctx, st, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	ext := ".kml"
+	if opts.kmz {
+		ext = ".kmz"
+	}
+
+	var written, skipped int
+	for i, group := range sel.groups {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		r := group[0]
+		path := filepath.Join(dir, fmt.Sprintf("%d%s", r.req.rank, ext))
+		if resume {
+			if _, err := os.Stat(path); err == nil {
+				skipped++
+				continue
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+
+		col := colors[sel.colorGroup(r, len(colors))]
+		doc := kml.Document(
+			kml.SharedStyle("line", routeLineStyle(col, opts)),
+			kml.Placemark(
+				kml.Name(r.req.String()),
+				kml.StyleURL("#line"),
+				kml.MultiGeometry(routeLineStrings(r.res.routeSegments, opts.mergeSegments, opts.coordPrecision)...),
+			),
+		)
+		if err := writeFileAtomic(path, func(f *os.File) error {
+			return writeKML(f, kml.KML(doc), opts.kmz, opts.pretty)
+		}); err != nil {
+			return err
+		}
+		written++
+
+		slog.Info("exported request", "rank", r.req.rank, "path", path, "done", i+1, "total", len(sel.groups))
+	}
+
+	if len(sel.unresolved) > 0 {
+		doc := kml.Document(kml.Folder(kml.Name("Unresolved")).Add(sel.unresolved...))
+		if err := writeFileAtomic(filepath.Join(dir, "unresolved"+ext), func(f *os.File) error {
+			return writeKML(f, kml.KML(doc), opts.kmz, opts.pretty)
+		}); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("split export summary", "written", written, "skipped", skipped, "errors", len(sel.failed))
+	if err := sel.checkRequired(opts.requireRanks); err != nil {
+		return outputWrittenError{err}
+	}
+	if err := sel.checkFailures(opts.maxFailures); err != nil {
+		return outputWrittenError{err}
+	}
+	return nil
+}
+
+// writeFileAtomic writes path using write on a temporary file that's
+// renamed into place once complete, so an interrupted write never leaves
+// a partial file behind.
+func writeFileAtomic(path string, write func(*os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes files only their owner can read.
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+type topOptions struct {
+	handlerOptions handlerOptions
+
+	// by is what to rank requests by. Only length is supported.
+	by string
+	// n is how many requests to print.
+	n int
+	// shortest prints the smallest requests rather than the largest.
+	shortest bool
+}
+
+// printTop resolves every request and prints the n with the longest, or
+// shortest, routes along with their ranks and districts.
+func printTop(ctx context.Context, st store, w io.Writer, opts topOptions) error {
+	if opts.by != "length" {
+		return fmt.Errorf("unknown ranking %q, want length", opts.by)
+	}
+	if opts.n < 1 {
+		return fmt.Errorf("n must be at least 1, got %d", opts.n)
+	}
+
+	reqs, err := st.requests(ctx, requestFilter{})
+	if err != nil {
+		return err
+	}
+
+	type row struct {
+		req    request
+		length float64
+	}
+	var rows []row
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		res, err := newDefaultRequestHandler(st, req, opts.handlerOptions).handle(ctx)
+		if err != nil {
+			logRequestError(req, err)
+			continue
+		}
+		rows = append(rows, row{req: req, length: routeLength(res.routeSegments)})
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].length != rows[j].length {
+			return (rows[i].length > rows[j].length) != opts.shortest
+		}
+		return rows[i].req.rank < rows[j].req.rank
+	})
+	rows = rows[:min(opts.n, len(rows))]
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tDISTRICT\tSTREET\tFROM\tTO\tLENGTH M")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%.0f\n", r.req.rank, r.req.district, r.req.streetName, r.req.from, r.req.to, r.length)
+	}
+	return tw.Flush()
+}
+
+// routeLength returns the total length of route in metres.
+func routeLength(route []segment) float64 {
+	var length float64
+	for _, seg := range route {
+		length += seg.length
+	}
+	return length
+}
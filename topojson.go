@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/paulmach/orb"
+)
+
+type topoJSONOptions struct {
+	requestFilter  requestFilter
+	handlerOptions handlerOptions
+
+	// quantization is the number of distinct positions along each axis
+	// coordinates are rounded to, or 0 to write them unrounded.
+	quantization int
+
+	// pretty indents the TopoJSON for reading rather than writing it
+	// compactly.
+	pretty bool
+}
+
+// topology is a TopoJSON topology.
+type topology struct {
+	Type      string                `json:"type"`
+	Transform *topoTransform        `json:"transform,omitempty"`
+	Objects   map[string]topoObject `json:"objects"`
+	Arcs      [][][2]float64        `json:"arcs"`
+}
+
+type topoTransform struct {
+	Scale     [2]float64 `json:"scale"`
+	Translate [2]float64 `json:"translate"`
+}
+
+// topoObject is a TopoJSON geometry. Arcs holds arc indexes for a
+// LineString, or lists of them for a MultiLineString.
+type topoObject struct {
+	Type       string                 `json:"type"`
+	ID         interface{}            `json:"id,omitempty"`
+	Arcs       interface{}            `json:"arcs,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+	Geometries []topoObject           `json:"geometries,omitempty"`
+}
+
+// exportTopoJSON writes the street network and each resolved request's
+// route as TopoJSON. Every segment's geometry is one arc, in the "network"
+// object, which routes in the "requests" object refer to rather than
+// repeat.
+func exportTopoJSON(ctx context.Context, st store, w io.Writer, opts topoJSONOptions) error {
+	if opts.quantization < 0 || opts.quantization == 1 {
+		return fmt.Errorf("quantization must be 0 or at least 2, got %d", opts.quantization)
+	}
+
+	segs, err := st.filterSegments(ctx, segmentFilter{})
+	if err != nil {
+		return err
+	}
+
+	topo := topology{Type: "Topology", Objects: make(map[string]topoObject)}
+
+	var bound orb.Bound
+	for i, seg := range segs {
+		if i == 0 {
+			bound = seg.lineString.Bound()
+		} else {
+			bound = bound.Union(seg.lineString.Bound())
+		}
+	}
+	quantize := func(p orb.Point) [2]float64 { return [2]float64{p.Lon(), p.Lat()} }
+	if opts.quantization > 0 {
+		t := &topoTransform{Translate: [2]float64{bound.Min.Lon(), bound.Min.Lat()}}
+		for i, size := range [2]float64{bound.Max.Lon() - bound.Min.Lon(), bound.Max.Lat() - bound.Min.Lat()} {
+			t.Scale[i] = 1
+			if size > 0 {
+				t.Scale[i] = size / float64(opts.quantization-1)
+			}
+		}
+		topo.Transform = t
+		quantize = func(p orb.Point) [2]float64 {
+			return [2]float64{math.Round((p.Lon() - t.Translate[0]) / t.Scale[0]), math.Round((p.Lat() - t.Translate[1]) / t.Scale[1])}
+		}
+	}
+
+	network := topoObject{Type: "GeometryCollection"}
+	arcIndex := make(map[int]int, len(segs))
+	for _, seg := range segs {
+		arcIndex[seg.id] = len(topo.Arcs)
+		topo.Arcs = append(topo.Arcs, topoArc(seg.lineString, quantize, opts.quantization > 0))
+		network.Geometries = append(network.Geometries, topoObject{
+			Type: "LineString",
+			ID:   seg.id,
+			Arcs: []int{arcIndex[seg.id]},
+			Properties: map[string]interface{}{
+				"name":         seg.name,
+				"direction":    seg.direction,
+				"route_id":     seg.routeID,
+				"street_class": seg.streetClass,
+			},
+		})
+	}
+	topo.Objects["network"] = network
+
+	reqs, err := st.requests(ctx, opts.requestFilter)
+	if err != nil {
+		return err
+	}
+
+	requests := topoObject{Type: "GeometryCollection"}
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		res, err := newDefaultRequestHandler(st, req, opts.handlerOptions).handle(ctx)
+		if err != nil {
+			logRequestError(req, err)
+			continue
+		}
+
+		arcs := make([][]int, 0, len(res.routeSegments))
+		for _, seg := range res.routeSegments {
+			arcs = append(arcs, []int{arcIndex[seg.id]})
+		}
+		resolvedFrom, resolvedTo := resolvedCrossStreets(req, res)
+		requests.Geometries = append(requests.Geometries, topoObject{
+			Type: "MultiLineString",
+			ID:   req.rank,
+			Arcs: arcs,
+			Properties: map[string]interface{}{
+				"rank":          req.rank,
+				"street":        req.streetName,
+				"district":      req.district,
+				"raw_from":      req.rawFrom,
+				"raw_to":        req.rawTo,
+				"resolved_from": resolvedFrom,
+				"resolved_to":   resolvedTo,
+			},
+		})
+	}
+	topo.Objects["requests"] = requests
+
+	enc := json.NewEncoder(w)
+	if opts.pretty {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(topo)
+}
+
+// topoArc returns ls as an arc of positions from quantize. Quantized arcs
+// are delta-encoded, as TopoJSON requires, dropping positions that round to
+// the one before.
+func topoArc(ls orb.LineString, quantize func(orb.Point) [2]float64, quantized bool) [][2]float64 {
+	arc := make([][2]float64, 0, len(ls))
+	var prev [2]float64
+	for i, p := range ls {
+		q := quantize(p)
+		if !quantized {
+			arc = append(arc, q)
+			continue
+		}
+		if i > 0 && q == prev && i < len(ls)-1 {
+			continue
+		}
+		arc = append(arc, [2]float64{q[0] - prev[0], q[1] - prev[1]})
+		prev = q
+	}
+	return arc
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+)
+
+// requestsTouchingSegment resolves requests and returns those whose routes
+// include the segment with id, in rank order.
+func requestsTouchingSegment(ctx context.Context, st store, id int, opts handlerOptions) ([]request, error) {
+	reqs, err := st.requests(ctx, requestFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	var out []request
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		res, err := newDefaultRequestHandler(st, req, opts).handle(ctx)
+		if err != nil {
+			logRequestError(req, err)
+			continue
+		}
+		for _, seg := range res.routeSegments {
+			if seg.id == id {
+				out = append(out, req)
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// printTouching prints the segment with the ID in args, followed by the
+// requests whose routes include it.
+func printTouching(ctx context.Context, st store, w io.Writer, args []string, opts handlerOptions) error {
+	if len(args) == 0 {
+		return fmt.Errorf("need segment id")
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+
+	segs, err := st.filterSegments(ctx, segmentFilter{ids: []int{id}})
+	if err != nil {
+		return err
+	}
+	if len(segs) == 0 {
+		return fmt.Errorf("no segment found with id %d", id)
+	}
+
+	reqs, err := requestsTouchingSegment(ctx, st, id, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s\nrequests: %d\n\n", segs[0], len(reqs))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tSTREET\tFROM\tTO\tDISTRICT")
+	for _, req := range reqs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", req.rank, req.streetName, req.rawFrom, req.rawTo, req.district)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// streetProblem is a request whose start or end segments, as when it's
+// resolved, aren't on its street.
+type streetProblem struct {
+	req  request
+	when string
+	ids  []int
+}
+
+// detour is a request whose resolved route is much longer than the
+// straight-line distance between its ends, which may mean it wanders
+// across a mis-linked network.
+type detour struct {
+	req   request
+	ratio float64
+}
+
+// backtrack is a request whose resolved route doubles back on itself,
+// which routing quirks can cause even when a route resolves.
+type backtrack struct {
+	req request
+	ids []int
+}
+
+// validation is what validateRequests finds.
+type validation struct {
+	streetProblems []streetProblem
+	detours        []detour
+	backtracks     []backtrack
+
+	// resolved and failed are the ranks of requests that did and didn't
+	// resolve.
+	resolved, failed []int
+}
+
+type validateOptions struct {
+	requestFilter
+	handlerOptions
+
+	// detourWarning, if positive, reports routes whose detour ratio
+	// exceeds it.
+	detourWarning float64
+
+	// requireRanks are the ranks of requests validate returns an error
+	// for, after printing its report, if they don't resolve.
+	requireRanks []int
+}
+
+// validateRequests resolves each request opts selects and reports those
+// with segments not on the request's street, which usually means its
+// source row is wrong rather than routing, and those whose routes detour
+// or backtrack.
+func validateRequests(ctx context.Context, st store, opts validateOptions) (validation, error) {
+	reqs, err := st.requests(ctx, opts.requestFilter)
+	if err != nil {
+		return validation{}, err
+	}
+
+	var v validation
+	for _, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return validation{}, err
+		}
+
+		att := newDefaultRequestHandler(st, req, opts.handlerOptions).handleAttempt(ctx)
+		if ids := offStreet(req.streetName, att.startSegments); len(ids) > 0 {
+			v.streetProblems = append(v.streetProblems, streetProblem{req: req, when: "start", ids: ids})
+		}
+		if ids := offStreet(req.streetName, att.endSegments); len(ids) > 0 {
+			v.streetProblems = append(v.streetProblems, streetProblem{req: req, when: "end", ids: ids})
+		}
+		if att.routeErr != nil {
+			v.failed = append(v.failed, req.rank)
+			continue
+		}
+		v.resolved = append(v.resolved, req.rank)
+		if ratio, ok := detourRatio(att.routeSegments); ok && opts.detourWarning > 0 && ratio > opts.detourWarning {
+			v.detours = append(v.detours, detour{req: req, ratio: ratio})
+		}
+		if ids := backtracks(att.routeSegments); len(ids) > 0 {
+			v.backtracks = append(v.backtracks, backtrack{req: req, ids: ids})
+		}
+	}
+	return v, nil
+}
+
+// printValidate prints what validateRequests finds, then returns an
+// error if any of opts' required requests didn't resolve.
+func printValidate(ctx context.Context, st store, w io.Writer, opts validateOptions) error {
+	v, err := validateRequests(ctx, st, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "problems: %d\n\n", len(v.streetProblems))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tSTREET\tFROM\tTO\tWHEN\tSEGMENTS NOT ON STREET")
+	for _, p := range v.streetProblems {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%v\n", p.req.rank, p.req.streetName, p.req.rawFrom, p.req.rawTo, p.when, p.ids)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\ndetours over %.1f: %d\n\n", opts.detourWarning, len(v.detours))
+
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tSTREET\tFROM\tTO\tDETOUR")
+	for _, d := range v.detours {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%.1f\n", d.req.rank, d.req.streetName, d.req.rawFrom, d.req.rawTo, d.ratio)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nbacktracking routes: %d\n\n", len(v.backtracks))
+
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tSTREET\tFROM\tTO\tBACKTRACKING SEGMENTS")
+	for _, b := range v.backtracks {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%v\n", b.req.rank, b.req.streetName, b.req.rawFrom, b.req.rawTo, b.ids)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if err := checkRequiredRanks(opts.requireRanks, v.resolved, v.failed); err != nil {
+		return outputWrittenError{err}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sort"
+)
+
+// Keys in the meta table, recording what a database was built from.
+const (
+	metaCenterlinesSHA256 = "centerlines_sha256"
+	metaRequestsSHA256    = "requests_sha256"
+	metaBuiltAt           = "built_at"
+)
+
+// hashInput passes r to load and returns the hex SHA-256 of all of r,
+// including anything load didn't read.
+func hashInput(r io.Reader, load func(io.Reader) error) (string, error) {
+	h := sha256.New()
+	tr := io.TeeReader(r, h)
+	if err := load(tr); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(io.Discard, tr); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s sqliteStore) setMeta(meta map[string]string) error {
+	for k, v := range meta {
+		if _, err := s.db.Exec("insert or replace into meta (key, value) values (?, ?)", k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// meta returns the database's build metadata, which is empty for
+// databases built before it was recorded.
+func (s sqliteStore) meta() (map[string]string, error) {
+	var n int
+	if err := s.db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = 'meta'").Scan(&n); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	rows, err := s.db.Query("select key, value from meta")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	meta := make(map[string]string)
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		meta[k] = v
+	}
+	return meta, rows.Err()
+}
+
+// printVersion prints the calmmap version and what the database was built
+// from.
+func printVersion(st *sqliteStore, w io.Writer) error {
+	version := "(unknown)"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		version = bi.Main.Version
+	}
+	fmt.Fprintln(w, "calmmap", version)
+
+	meta, err := st.meta()
+	if err != nil {
+		return err
+	}
+	if len(meta) == 0 {
+		fmt.Fprintln(w, "no build metadata, rebuild with builddb to record it")
+		return nil
+	}
+
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s: %s\n", k, meta[k])
+	}
+	return nil
+}